@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/pelletier/go-toml"
+)
+
+// fastlyManifest is the subset of a Fastly CLI package manifest (fastly.toml)
+// that we care about. Other fields, e.g. [local_server] or [setup], are
+// ignored.
+type fastlyManifest struct {
+	ServiceID string `toml:"service_id"`
+}
+
+var serviceIDRegex = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+// readFastlyTOML returns the service ID from each of the Fastly CLI manifests
+// at the given paths, in order. It's an error for a manifest to be missing a
+// valid service_id, since that almost certainly means it hasn't been deployed.
+func readFastlyTOML(paths ...string) ([]string, error) {
+	ids := make([]string, 0, len(paths))
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		var manifest fastlyManifest
+		if err := toml.Unmarshal(buf, &manifest); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		switch {
+		case manifest.ServiceID == "":
+			return nil, fmt.Errorf("%s: no service_id", path)
+		case !serviceIDRegex.MatchString(manifest.ServiceID):
+			return nil, fmt.Errorf("%s: invalid service_id %q", path, manifest.ServiceID)
+		}
+
+		ids = append(ids, manifest.ServiceID)
+	}
+	return ids, nil
+}
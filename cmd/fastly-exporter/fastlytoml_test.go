@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadFastlyTOML(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	var (
+		production = write("fastly.toml", `
+manifest_version = 2
+name = "my-app"
+description = "An application"
+authors = ["someone@example.com"]
+language = "rust"
+service_id = "AbCdEf123"
+
+[local_server]
+  [local_server.backends]
+    [local_server.backends.origin]
+      url = "http://127.0.0.1:8080"
+
+[setup]
+  [setup.backends]
+    [setup.backends.origin]
+      address = "example.com"
+`)
+		staging   = write("fastly.staging.toml", `service_id = "XyZ789"`)
+		missing   = write("undeployed.toml", `name = "my-app"`)
+		invalid   = write("invalid.toml", `service_id = "not a service ID"`)
+		malformed = write("malformed.toml", `service_id = `)
+	)
+
+	for _, testcase := range []struct {
+		name    string
+		paths   []string
+		want    []string
+		wantErr bool
+	}{
+		{"single", []string{production}, []string{"AbCdEf123"}, false},
+		{"multiple", []string{production, staging}, []string{"AbCdEf123", "XyZ789"}, false},
+		{"missing service ID", []string{production, missing}, nil, true},
+		{"invalid service ID", []string{invalid}, nil, true},
+		{"malformed", []string{malformed}, nil, true},
+		{"nonexistent", []string{filepath.Join(dir, "nonexistent.toml")}, nil, true},
+	} {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			have, err := readFastlyTOML(testcase.paths...)
+			if want, have := testcase.wantErr, err != nil; want != have {
+				t.Fatalf("error: want %v, have %v (%v)", want, have, err)
+			}
+			if want := testcase.want; !cmp.Equal(want, have) {
+				t.Error(cmp.Diff(want, have))
+			}
+		})
+	}
+}
@@ -2,13 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
 
@@ -30,18 +40,90 @@ func main() {
 	var (
 		token             string
 		listen            string
+		tlsCertFile       string
+		tlsKeyFile        string
+		tlsMinVersion     string
+		tlsCipherSuites   string
 		namespace         string
 		subsystem         string
 		serviceShard      string
 		serviceIDs        stringslice
+		fastlyTOMLs       stringslice
+		excludedIDs       stringslice
+		customerIDs       stringslice
 		serviceAllowlist  stringslice
 		serviceBlocklist  stringslice
 		metricAllowlist   stringslice
 		metricBlocklist   stringslice
+		alwaysPresent     stringslice
+		dcAllowlist       stringslice
+		dcBlocklist       stringslice
+		dcKnown           stringslice
+		dcCatchAll        string
+		dcOverride        string
+		dcSample          uint64
+		dcLimit           int
+		products          stringslice
+		serviceNamespaces stringslice
+		typeSubsystems    stringslice
+		metricsSelectors  stringslice
+		pollIntervals     stringslice
+		byteSizeFields    stringslice
+		byteSizeBuckets   string
+		httpVersions      stringslice
+		forbiddenLimit    int
+		fleetTotals       bool
+		labelOrder        string
+		environmentRegex  string
+		environmentValue  string
+		servicePairRegex  string
+		stateFile         string
+		textfile          string
+		textfileInterval  time.Duration
 		datacenterRefresh time.Duration
 		serviceRefresh    time.Duration
+		refreshDeadline   time.Duration
+		deadlinePolicy    string
+		maxScrapes        int
+		scrapeCacheTTL    time.Duration
+		sdRegions         bool
+		maxLabels         int
+		topServices       int
+		topWarmup         time.Duration
+		topInterval       time.Duration
+		topOther          bool
+		standby           bool
+		adminEndpoints    bool
+		rateLimit         float64
+		apiRetries        int
+		productTimeout    time.Duration
+		productRetries    int
+		minBucketAge      time.Duration
+		replayFrom        uint64
 		apiTimeout        time.Duration
 		rtTimeout         time.Duration
+		readTimeout       time.Duration
+		apiRedirects      string
+		insecureTLS       bool
+		skipIdleDCs       bool
+		requestRates      bool
+		rateSmoothing     float64
+		dcShares          bool
+		errorRatios       bool
+		renameGrace       time.Duration
+		nameSanitizeRegex string
+		nameSanitizeRepl  string
+		rampInterval      time.Duration
+		pollInterval      time.Duration
+		rampFloor         int
+		reapThreshold     time.Duration
+		directLookup      bool
+		skipMetadata      bool
+		createdTimestamps bool
+		minActiveVersion  int
+		maxActiveVersion  int
+		requireDeployed   bool
+		versionComments   bool
 		debug             bool
 		versionFlag       bool
 		configFileExample bool
@@ -50,20 +132,92 @@ func main() {
 	fs := flag.NewFlagSet("fastly-exporter", flag.ContinueOnError)
 	{
 		fs.StringVar(&token, "token", "", "Fastly API token (required)")
-		fs.StringVar(&listen, "listen", "127.0.0.1:8080", "listen address for Prometheus metrics")
+		fs.StringVar(&listen, "listen", "127.0.0.1:8080", "listen address for Prometheus metrics (empty to disable)")
+		fs.StringVar(&tlsCertFile, "listen-tls-cert-file", "", "if set with -listen-tls-key-file, serve HTTPS on the listen address with this certificate")
+		fs.StringVar(&tlsKeyFile, "listen-tls-key-file", "", "if set with -listen-tls-cert-file, serve HTTPS on the listen address with this private key")
+		fs.StringVar(&tlsMinVersion, "listen-tls-min-version", "1.2", "minimum TLS version accepted when serving HTTPS: 1.0, 1.1, 1.2, or 1.3")
+		fs.StringVar(&tlsCipherSuites, "listen-tls-cipher-suites", "", "if set, comma-separated cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, accepted when serving HTTPS with TLS 1.2 or lower (TLS 1.3 suites aren't configurable)")
+		fs.StringVar(&textfile, "textfile", "", "if set, periodically write metrics to this file in Prometheus text format")
+		fs.DurationVar(&textfileInterval, "textfile-interval", 15*time.Second, "how often to write metrics to -textfile")
+		fs.BoolVar(&standby, "standby", false, "if set, collect metrics but respond to /metrics with 503 until promoted via POST /admin/promote (requires -admin-endpoints)")
+		fs.BoolVar(&adminEndpoints, "admin-endpoints", false, "if set, serve the unauthenticated /admin/* endpoints, e.g. to reshard or promote, on the -listen address")
+		fs.IntVar(&maxScrapes, "max-concurrent-scrapes", 0, "if set, reject scrapes of /metrics beyond this many concurrent requests with 503")
+		fs.DurationVar(&scrapeCacheTTL, "metrics-cache-ttl", 0, "if set, serve scrapes of /metrics within this long of each other, e.g. 500ms, from the same rendered response")
+		fs.BoolVar(&sdRegions, "sd-region-labels", false, "if set, group the targets in /sd by region, i.e. the group of the datacenter serving most of each service's requests, with a region label")
+		fs.IntVar(&topServices, "top-services", 0, "if set, only export per-service metrics for this many services with the most requests")
+		fs.DurationVar(&topWarmup, "top-services-warmup", 5*time.Minute, "with -top-services, export all services for this long before first ranking them")
+		fs.DurationVar(&topInterval, "top-services-interval", 15*time.Minute, "with -top-services, re-rank services by their requests this often")
+		fs.BoolVar(&topOther, "top-services-other", false, "with -top-services, sum the requests of services not exported into an other_requests gauge")
+		fs.IntVar(&maxLabels, "max-labels", 0, "if set, fail at startup if any per-service metric would have more than this many labels per series")
+		fs.StringVar(&stateFile, "state-file", "", "if set, persist counter values to this file, and restore them on startup")
 		fs.StringVar(&namespace, "namespace", "fastly", "Prometheus namespace")
 		fs.StringVar(&subsystem, "subsystem", "rt", "Prometheus subsystem")
+		fs.Var(&serviceNamespaces, "service-namespace", "if set, use a different Prometheus namespace for one service (format 'service ID=namespace', repeatable)")
+		fs.Var(&typeSubsystems, "service-type-subsystem", "if set, use a different Prometheus subsystem for services of one type, e.g. wasm=compute (format 'type=subsystem' with type vcl or wasm, repeatable)")
+		fs.Var(&metricsSelectors, "metrics-selector", "define a named selector for /metrics?selector=name (format 'name=key:value,...' with keys service, datacenter-allowlist, datacenter-blocklist; repeatable)")
+		fs.StringVar(&environmentRegex, "environment-label-regex", "", "if set, add an environment label to per-service metrics from the first capture group of this regex applied to the service name")
+		fs.StringVar(&environmentValue, "environment-label-default", "", "environment label value for service names that don't match -environment-label-regex")
+		fs.StringVar(&servicePairRegex, "service-pair-regex", "", "if set, add service and env labels to per-service metrics from the named capture groups 'service' and 'env' of this regex applied to the service name")
 		fs.StringVar(&serviceShard, "service-shard", "", "if set, only include services whose hashed IDs modulo m equal n-1 (format 'n/m')")
 		fs.Var(&serviceIDs, "service", "if set, only include this service ID (repeatable)")
+		fs.Var(&fastlyTOMLs, "service-fastly-toml", "if set, only include the service ID from this Fastly CLI manifest, e.g. fastly.toml, in addition to any -service (repeatable)")
+		fs.Var(&excludedIDs, "service-exclude", "if set, don't include this service ID (repeatable)")
+		fs.Var(&customerIDs, "service-customer-id", "if set, only include services owned by this customer ID (repeatable)")
 		fs.Var(&serviceAllowlist, "service-allowlist", "if set, only include services whose names match this regex (repeatable)")
 		fs.Var(&serviceBlocklist, "service-blocklist", "if set, don't include services whose names match this regex (repeatable)")
 		fs.Var(&metricAllowlist, "metric-allowlist", "if set, only export metrics whose names match this regex (repeatable)")
 		fs.Var(&metricBlocklist, "metric-blocklist", "if set, don't export metrics whose names match this regex (repeatable)")
+		fs.Var(&alwaysPresent, "always-present-metric", "if set, export this metric with zero values for every service and datacenter before any data is received (repeatable)")
+		fs.Var(&dcAllowlist, "datacenter-allowlist", "if set, only export data for datacenters whose codes match this regex (repeatable)")
+		fs.Var(&dcBlocklist, "datacenter-blocklist", "if set, don't export data for datacenters whose codes match this regex (repeatable)")
+		fs.Var(&dcKnown, "datacenter-known", "if set, export data for datacenters whose codes don't match this regex under the -datacenter-catch-all label (repeatable)")
+		fs.StringVar(&dcCatchAll, "datacenter-catch-all", "other", "datacenter label value for datacenters that don't match -datacenter-known")
+		fs.StringVar(&dcOverride, "datacenter-override", "", "if set, export data for all datacenters under this datacenter label value")
+		fs.Uint64Var(&dcSample, "datacenter-sample", 0, "if greater than 1, export data for only 1 in this many datacenters, chosen by hash of the datacenter code")
+		fs.IntVar(&dcLimit, "datacenter-limit", 0, "if set, export data for at most this many distinct datacenters per service, and for any others under the -datacenter-catch-all label")
+		fs.Var(&products, "product", "if set, export whether this product, e.g. origin_inspector, is enabled for each service, checked every service refresh (repeatable)")
 		fs.DurationVar(&datacenterRefresh, "datacenter-refresh", 10*time.Minute, "how often to poll api.fastly.com for updated datacenter metadata (10m–1h)")
 		fs.DurationVar(&serviceRefresh, "service-refresh", 1*time.Minute, "how often to poll api.fastly.com for updated service metadata (15s–10m)")
+		fs.DurationVar(&refreshDeadline, "service-refresh-deadline", 0, "if set, abort each service refresh which takes longer than this in total, across all pages of results")
+		fs.StringVar(&deadlinePolicy, "service-refresh-deadline-policy", "error", "what to do with a service refresh that exceeds -service-refresh-deadline: error (keep the previous services) or partial (also apply the services fetched so far)")
 		fs.DurationVar(&serviceRefresh, "api-refresh", 1*time.Minute, "DEPRECATED -- use service-refresh instead")
 		fs.DurationVar(&apiTimeout, "api-timeout", 15*time.Second, "HTTP client timeout for api.fastly.com requests (5–60s)")
 		fs.DurationVar(&rtTimeout, "rt-timeout", 45*time.Second, "HTTP client timeout for rt.fastly.com requests (45–120s)")
+		fs.DurationVar(&readTimeout, "body-read-timeout", 0, "if set, abort reading a response body from Fastly APIs when it stalls for this long, even if the overall timeout hasn't passed")
+		fs.Float64Var(&rateLimit, "api-rate-limit", 0, "if set, limit requests to api.fastly.com and rt.fastly.com combined to this many per second")
+		fs.IntVar(&apiRetries, "api-retries", 0, "if set, retry GET requests to Fastly APIs which fail with a network error or a 5xx or 429 response up to this many times")
+		fs.DurationVar(&productTimeout, "product-timeout", 0, "if set, HTTP client timeout for api.fastly.com enabled products requests, instead of -api-timeout")
+		fs.IntVar(&productRetries, "product-retries", -1, "if zero or more, retry failed api.fastly.com enabled products requests up to this many times, instead of -api-retries")
+		fs.StringVar(&apiRedirects, "api-redirect-policy", redirectPolicySameHost, "how to handle HTTP redirects from Fastly APIs: "+redirectPolicySameHost+" (follow only to the same host) or "+redirectPolicyError+" (never follow)")
+		fs.BoolVar(&insecureTLS, "api-insecure-skip-verify", false, "UNSAFE: if set, don't verify the TLS certificates of Fastly APIs, e.g. for lab setups behind a proxy with a self-signed certificate")
+		fs.BoolVar(&directLookup, "service-direct-lookup", false, "if set with -service, fetch metadata for each service individually instead of listing all services")
+		fs.BoolVar(&skipMetadata, "service-skip-metadata", false, "if set with -service, don't fetch service metadata at all, and export an empty service name and version 0")
+		fs.BoolVar(&createdTimestamps, "service-created-timestamps", false, "if set, export the creation time of each service")
+		fs.IntVar(&minActiveVersion, "service-min-active-version", 0, "if set, only include services whose active version is at least this number")
+		fs.IntVar(&maxActiveVersion, "service-max-active-version", 0, "if set, only include services whose active version is at most this number")
+		fs.BoolVar(&requireDeployed, "service-require-deployed", false, "if set, only include services whose active version is marked as deployed")
+		fs.Uint64Var(&replayFrom, "replay-from", 0, "if set, start each service with real-time data from this Unix timestamp, rather than the most recent data")
+		fs.DurationVar(&minBucketAge, "minimum-bucket-age", 0, "if set, defer processing real-time data until it's at least this old, as the newest data may be revised")
+		fs.BoolVar(&skipIdleDCs, "skip-idle-datacenters", false, "if set, don't emit metrics for datacenters that served no traffic in a given second")
+		fs.BoolVar(&requestRates, "request-rates", false, "if set, also emit a requests per second gauge for each datacenter, computed from successive seconds of data")
+		fs.Float64Var(&rateSmoothing, "requests-rate-smoothing", 0, "if set, also emit a requests per second gauge for each service, smoothed with an exponentially weighted moving average with this weight for each second of data (0–1)")
+		fs.BoolVar(&dcShares, "datacenter-shares", false, "if set, also emit each datacenter's share of its service's requests")
+		fs.DurationVar(&renameGrace, "service-rename-grace", 0, "how long to keep series under a renamed service's old name before pruning them")
+		fs.StringVar(&nameSanitizeRegex, "service-name-sanitize-regex", "", "if set, replace matches of this regex in service names, e.g. '[[:space:][:cntrl:]]+', before using them as the service_name label")
+		fs.StringVar(&nameSanitizeRepl, "service-name-sanitize-replacement", "_", "replacement for matches of -service-name-sanitize-regex")
+		fs.BoolVar(&errorRatios, "error-ratios", false, "if set, also emit each datacenter's ratio of 5xx responses to requests")
+		fs.Var(&byteSizeFields, "byte-size-histogram", "if set, also observe the per-second total of this real-time byte field, e.g. resp_body_bytes, in each datacenter in a histogram (repeatable)")
+		fs.StringVar(&labelOrder, "label-order", "", "if set, comma-separated labels to render first, in this order, in /metrics output; other labels follow alphabetically")
+		fs.BoolVar(&fleetTotals, "fleet-totals", false, "if set, also emit the total requests and bytes delivered across all services and datacenters")
+		fs.IntVar(&forbiddenLimit, "forbidden-limit", 0, "if set, stop the subscriber for a service after this many consecutive 403 Forbidden responses from rt.fastly.com, until the next service refresh")
+		fs.Var(&httpVersions, "http-version", "if set, also count requests by HTTP version, 2 or non_http2, with this version getting its own series and the rest folded into other (repeatable)")
+		fs.StringVar(&byteSizeBuckets, "byte-size-buckets", "", "if set, comma-separated bucket boundaries in bytes for -byte-size-histogram, in increasing order (default 1KiB to 1GiB by powers of 10)")
+		fs.DurationVar(&pollInterval, "poll-interval", 0, "if set, minimum interval between real-time stats API requests for each service")
+		fs.Var(&pollIntervals, "service-poll-interval", "if set, override -poll-interval for one service (format 'service ID=interval', repeatable)")
+		fs.DurationVar(&rampInterval, "subscriber-ramp-interval", 0, "if set, start new subscribers beyond -subscriber-ramp-floor one per this interval")
+		fs.IntVar(&rampFloor, "subscriber-ramp-floor", 10, "number of subscribers which start immediately, regardless of -subscriber-ramp-interval")
+		fs.DurationVar(&reapThreshold, "subscriber-reap-threshold", 0, "if set, restart subscribers which haven't completed a real-time stats request for this long (should exceed -poll-interval)")
+		fs.BoolVar(&versionComments, "version-comment", false, "if set, use the comment of a service's active version, when non-empty, as its service_version label")
 		fs.BoolVar(&debug, "debug", false, "log debug information")
 		fs.BoolVar(&versionFlag, "version", false, "print version information and exit")
 		fs.String("config-file", "", "config file (optional)")
@@ -106,6 +260,26 @@ func main() {
 		}
 	}
 
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		level.Error(logger).Log("err", "-listen-tls-cert-file and -listen-tls-key-file must be set together")
+		os.Exit(1)
+	}
+
+	var tlsConfig *tls.Config
+	if tlsCertFile != "" {
+		var err error
+		tlsConfig, err = serverTLSConfig(tlsMinVersion, tlsCipherSuites)
+		if err != nil {
+			level.Error(logger).Log("err", "invalid TLS configuration", "msg", err)
+			os.Exit(1)
+		}
+	}
+
+	if listen == "" && textfile == "" {
+		level.Error(logger).Log("err", "at least one of -listen or -textfile is required")
+		os.Exit(1)
+	}
+
 	fs.Visit(func(f *flag.Flag) {
 		if f.Name == "api-refresh" {
 			level.Warn(logger).Log("msg", "-api-refresh is deprecated and will be removed in a future version, please use -service-refresh instead")
@@ -184,35 +358,65 @@ func main() {
 		}
 	}
 
-	var shardN, shardM uint64
+	var datacenterFilter filter.Filter
 	{
-		if serviceShard != "" {
-			toks := strings.SplitN(serviceShard, "/", 2)
-			if len(toks) != 2 {
-				level.Error(logger).Log("err", "-service-shard must be of the format 'n/m'")
+		for _, expr := range dcAllowlist {
+			if err := datacenterFilter.Allow(expr); err != nil {
+				level.Error(logger).Log("err", "invalid -datacenter-allowlist", "msg", err)
 				os.Exit(1)
 			}
-			var err error
-			shardN, err = strconv.ParseUint(toks[0], 10, 64)
-			if err != nil {
-				level.Error(logger).Log("err", "-service-shard must be of the format 'n/m'")
+			level.Info(logger).Log("filter", "datacenters", "type", "code allowlist", "expr", expr)
+		}
+		for _, expr := range dcBlocklist {
+			if err := datacenterFilter.Block(expr); err != nil {
+				level.Error(logger).Log("err", "invalid -datacenter-blocklist", "msg", err)
 				os.Exit(1)
 			}
-			if shardN <= 0 {
-				level.Error(logger).Log("err", "first part of -service-shard flag should be greater than zero")
+			level.Info(logger).Log("filter", "datacenters", "type", "code blocklist", "expr", expr)
+		}
+	}
+
+	var knownDatacenters filter.Filter
+	{
+		for _, expr := range dcKnown {
+			if err := knownDatacenters.Allow(expr); err != nil {
+				level.Error(logger).Log("err", "invalid -datacenter-known", "msg", err)
 				os.Exit(1)
 			}
-			shardM, err = strconv.ParseUint(toks[1], 10, 64)
+			level.Info(logger).Log("datacenters", "known", "expr", expr, "catch_all", dcCatchAll)
+		}
+		if len(dcKnown) > 0 && dcCatchAll == "" {
+			level.Error(logger).Log("err", "-datacenter-catch-all can't be empty when -datacenter-known is set")
+			os.Exit(1)
+		}
+		if dcLimit > 0 && dcCatchAll == "" {
+			level.Error(logger).Log("err", "-datacenter-catch-all can't be empty when -datacenter-limit is set")
+			os.Exit(1)
+		}
+	}
+
+	{
+		if len(fastlyTOMLs) > 0 {
+			ids, err := readFastlyTOML(fastlyTOMLs...)
 			if err != nil {
-				level.Error(logger).Log("err", "-service-shard must be of the format 'n/m'")
+				level.Error(logger).Log("err", err)
 				os.Exit(1)
 			}
-			if shardN > shardM {
-				level.Error(logger).Log("err", fmt.Sprintf("-service-shard with n=%d m=%d is invalid: n must be less than or equal to m", shardN, shardM))
+			level.Info(logger).Log("services", "read from Fastly CLI manifests", "count", len(ids))
+			serviceIDs = append(serviceIDs, ids...)
+		}
+	}
+
+	var shardN, shardM uint64
+	{
+		if serviceShard != "" {
+			var err error
+			shardN, shardM, err = parseShard(serviceShard)
+			if err != nil {
+				level.Error(logger).Log("err", "invalid -service-shard", "msg", err)
 				os.Exit(1)
 			}
 			level.Info(logger).Log("filter", "services", "type", "by shard", "n", shardN, "m", shardM)
-
 		}
 	}
 
@@ -226,12 +430,104 @@ func main() {
 		userAgent = `Fastly-Exporter (` + programVersion + `)`
 	}
 
+	var (
+		exporterRegistry *prometheus.Registry
+		shardCollectors  []prometheus.Collector
+	)
+	{
+		exporterRegistry = prometheus.NewRegistry()
+
+		start := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "start_timestamp",
+			Help:      "Unix timestamp of when the exporter started.",
+		})
+		start.SetToCurrentTime()
+		exporterRegistry.MustRegister(start)
+		shardCollectors = []prometheus.Collector{
+			shardInfo(namespace, shardN, shardM),
+			filterInfo(namespace, serviceAllowlist, serviceBlocklist, shardN, shardM),
+		}
+		exporterRegistry.MustRegister(shardCollectors...)
+		exporterRegistry.MustRegister(configHashInfo(namespace, configHash(programVersion, fs, "token", "config-file")))
+		exporterRegistry.MustRegister(resourceStats(namespace)...)
+	}
+
+	var checkRedirect func(*http.Request, []*http.Request) error
+	{
+		redirects := prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "api",
+			Name:      "redirects_total",
+			Help:      "Total HTTP redirect responses received from Fastly APIs.",
+		})
+		exporterRegistry.MustRegister(redirects)
+
+		var err error
+		checkRedirect, err = redirectPolicy(apiRedirects, redirects)
+		if err != nil {
+			level.Error(logger).Log("err", "invalid -api-redirect-policy", "msg", err)
+			os.Exit(1)
+		}
+	}
+
+	var transport http.RoundTripper
+	{
+		if insecureTLS {
+			level.Warn(logger).Log("msg", "TLS certificates of Fastly APIs won't be verified; this is unsafe outside of lab setups")
+		}
+		transport = userAgentTransport(baseTransport(insecureTLS), userAgent)
+
+		authFailures := prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "api",
+			Name:      "auth_failures_total",
+			Help:      "Total 401 Unauthorized and 403 Forbidden responses from Fastly APIs, which usually indicate a token problem.",
+		})
+		exporterRegistry.MustRegister(authFailures)
+		transport = authFailureTransport(transport, authFailures)
+
+		if readTimeout > 0 {
+			transport = readTimeoutTransport(transport, readTimeout)
+		}
+
+		if rateLimit > 0 {
+			burst := int(math.Ceil(rateLimit))
+			level.Info(logger).Log("rate_limit", rateLimit, "burst", burst)
+			transport = rateLimitTransport(transport, newTokenBucket(rateLimit, burst))
+		}
+	}
+
+	var retries *prometheus.CounterVec
+	{
+		retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "api",
+			Name:      "retries_total",
+			Help:      "Total re-attempts of failed requests to Fastly APIs.",
+		}, []string{"operation"})
+		exporterRegistry.MustRegister(retries)
+		if apiRetries > 0 {
+			level.Info(logger).Log("api_retries", apiRetries)
+		}
+	}
+
 	var apiClient *http.Client
 	{
-		apiClient = &http.Client{
-			Timeout:   apiTimeout,
-			Transport: userAgentTransport(http.DefaultTransport, userAgent),
+		apiClient = newAPIClient(transport, apiTimeout, apiRetries, retries, checkRedirect)
+	}
+
+	var productClient *http.Client
+	{
+		if productTimeout <= 0 {
+			productTimeout = apiTimeout
+		}
+		if productRetries < 0 {
+			productRetries = apiRetries
 		}
+		level.Debug(logger).Log("product_timeout", productTimeout, "product_retries", productRetries)
+		productClient = newAPIClient(transport, productTimeout, productRetries, retries, checkRedirect)
 	}
 
 	var serviceCache *api.ServiceCache
@@ -246,6 +542,63 @@ func main() {
 			serviceCacheOptions = append(serviceCacheOptions, api.WithExplicitServiceIDs(serviceIDs...))
 		}
 
+		if len(excludedIDs) > 0 {
+			level.Info(logger).Log("filter", "services", "type", "excluded service IDs", "count", len(excludedIDs))
+			serviceCacheOptions = append(serviceCacheOptions, api.WithBlockedServiceIDs(excludedIDs...))
+		}
+
+		if len(customerIDs) > 0 {
+			level.Info(logger).Log("filter", "services", "type", "customer IDs", "count", len(customerIDs))
+			serviceCacheOptions = append(serviceCacheOptions, api.WithCustomerIDs(customerIDs...))
+		}
+
+		if directLookup {
+			if len(serviceIDs) > 0 {
+				level.Info(logger).Log("services", "direct lookup", "count", len(serviceIDs))
+				serviceCacheOptions = append(serviceCacheOptions, api.WithDirectLookup(true))
+			} else {
+				level.Warn(logger).Log("msg", "-service-direct-lookup has no effect without -service")
+			}
+		}
+
+		if skipMetadata {
+			if len(serviceIDs) > 0 {
+				level.Info(logger).Log("services", "skip metadata", "count", len(serviceIDs))
+				serviceCacheOptions = append(serviceCacheOptions, api.WithSkipMetadata(true))
+			} else {
+				level.Warn(logger).Log("msg", "-service-skip-metadata has no effect without -service")
+			}
+		}
+
+		if minActiveVersion > 0 || maxActiveVersion > 0 {
+			level.Info(logger).Log("filter", "services", "type", "active version range", "min", minActiveVersion, "max", maxActiveVersion)
+			serviceCacheOptions = append(serviceCacheOptions, api.WithActiveVersionRange(minActiveVersion, maxActiveVersion))
+		}
+
+		if requireDeployed {
+			level.Info(logger).Log("filter", "services", "type", "active version deployed")
+			serviceCacheOptions = append(serviceCacheOptions, api.WithRequireDeployed(true))
+		}
+
+		if createdTimestamps {
+			serviceCacheOptions = append(serviceCacheOptions, api.WithCreatedTimestamps(true))
+		}
+
+		if refreshDeadline > 0 {
+			var policy api.DeadlinePolicy
+			switch deadlinePolicy {
+			case "error":
+				policy = api.DeadlineError
+			case "partial":
+				policy = api.DeadlinePartial
+			default:
+				level.Error(logger).Log("err", "-service-refresh-deadline-policy must be error or partial")
+				os.Exit(1)
+			}
+			level.Info(logger).Log("services", "refresh deadline", "deadline", refreshDeadline, "policy", deadlinePolicy)
+			serviceCacheOptions = append(serviceCacheOptions, api.WithRefreshDeadline(refreshDeadline, policy))
+		}
+
 		if shardM > 0 {
 			level.Info(logger).Log("filter", "services", "type", "shard", "shard", fmt.Sprintf("%d/%d", shardN, shardM))
 			serviceCacheOptions = append(serviceCacheOptions, api.WithShard(shardN, shardM))
@@ -259,6 +612,11 @@ func main() {
 		datacenterCache = api.NewDatacenterCache(apiClient, token)
 	}
 
+	var productCache *api.ProductCache
+	{
+		productCache = api.NewProductCache(productClient, token, products...)
+	}
+
 	{
 		var g errgroup.Group
 		g.Go(func() error {
@@ -274,6 +632,12 @@ func main() {
 			return nil
 		})
 		g.Wait()
+
+		if len(products) > 0 {
+			if err := productCache.Refresh(context.Background(), serviceCache.ServiceIDs()); err != nil {
+				level.Warn(logger).Log("during", "initial fetch of enabled products", "err", err, "msg", "product metrics unavailable, will retry")
+			}
+		}
 	}
 
 	var defaultGatherers prometheus.Gatherers
@@ -283,25 +647,353 @@ func main() {
 			level.Error(apiLogger).Log("during", "create datacenter gatherer", "err", err)
 			os.Exit(1)
 		}
-		defaultGatherers = append(defaultGatherers, dcs)
+
+		services, err := serviceCache.Gatherer(namespace, "")
+		if err != nil {
+			level.Error(apiLogger).Log("during", "create service gatherer", "err", err)
+			os.Exit(1)
+		}
+
+		defaultGatherers = append(defaultGatherers, dcs, services, exporterRegistry)
+
+		if len(products) > 0 {
+			enabled, err := productCache.Gatherer(namespace, "")
+			if err != nil {
+				level.Error(apiLogger).Log("during", "create product gatherer", "err", err)
+				os.Exit(1)
+			}
+			defaultGatherers = append(defaultGatherers, enabled)
+		}
 	}
 
-	var registry *prom.Registry
+	var (
+		registry  *prom.Registry
+		manager   *rt.Manager              // constructed below, but referenced by the shard handler
+		resharded = make(chan struct{}, 1) // signaled by the shard handler to refresh services
+	)
 	{
-		registry = prom.NewRegistry(programVersion, namespace, subsystem, metricNameFilter, defaultGatherers)
+		registryOptions := []prom.RegistryOption{
+			prom.WithDefaultGatherers(defaultGatherers...),
+			prom.WithMaxConcurrentScrapes(maxScrapes),
+			prom.WithScrapeCache(scrapeCacheTTL),
+		}
+
+		{
+			// POST /admin/shard?shard=n/m moves the exporter to a different
+			// shard without a restart. Services that leave the shard are
+			// dropped, and their subscribers stopped, immediately; services
+			// that join it are picked up by a service refresh, which is
+			// triggered right away. So when replicas are resharded, each
+			// moving service has a brief gap in coverage, rather than a period
+			// where it's exported twice.
+			var mtx sync.Mutex
+			registryOptions = append(registryOptions, prom.WithAdminHandler("shard", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				n, m, err := parseShard(req.URL.Query().Get("shard"))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				mtx.Lock()
+				defer mtx.Unlock()
+
+				level.Info(logger).Log("filter", "services", "type", "by shard", "n", n, "m", m, "msg", "resharding")
+				serviceCache.SetShard(n, m)
+				manager.Refresh()
+				select {
+				case resharded <- struct{}{}:
+				default: // a refresh is already pending
+				}
+
+				for _, c := range shardCollectors {
+					exporterRegistry.Unregister(c)
+				}
+				shardCollectors = []prometheus.Collector{
+					shardInfo(namespace, n, m),
+					filterInfo(namespace, serviceAllowlist, serviceBlocklist, n, m),
+				}
+				exporterRegistry.MustRegister(shardCollectors...)
+
+				w.Header().Set("content-type", "text/plain; charset=utf-8")
+				fmt.Fprintf(w, "shard %d/%d\n", n, m)
+			})))
+		}
+
+		// POST /admin/refresh-service?id=<service ID> fetches the metadata of
+		// a single service, e.g. one that was just created, and starts its
+		// subscriber, without waiting for the next full service refresh.
+		registryOptions = append(registryOptions, prom.WithAdminHandler("refresh-service", refreshServiceHandler(serviceCache, func() { manager.Refresh() }, logger)))
+
+		// GET /admin/filter-test?name_allow=...&name_block=... previews a
+		// service name filter against the services from the last refresh.
+		registryOptions = append(registryOptions, prom.WithAdminQueryHandler("filter-test", filterTestHandler(serviceCache)))
+
+		// GET /debug/errors reports the last error of each subscriber.
+		registryOptions = append(registryOptions, prom.WithDebugHandler("errors", debugErrorsHandler(func() *rt.Manager { return manager })))
+
+		for _, f := range byteSizeFields {
+			if !rt.IsByteSizeField(f) {
+				level.Error(logger).Log("err", "invalid -byte-size-histogram", "msg", fmt.Sprintf("%q isn't a real-time byte field", f))
+				os.Exit(1)
+			}
+		}
+		if byteSizeBuckets != "" {
+			buckets, err := parseBuckets(byteSizeBuckets)
+			if err != nil {
+				level.Error(logger).Log("err", "invalid -byte-size-buckets", "msg", err)
+				os.Exit(1)
+			}
+			level.Info(logger).Log("byte_size_buckets", byteSizeBuckets)
+			registryOptions = append(registryOptions, prom.WithByteSizeBuckets(buckets))
+		}
+
+		if sdRegions {
+			registryOptions = append(registryOptions, prom.WithRegionLabels(datacenterCache))
+		}
+
+		if labelOrder != "" {
+			labels := strings.Split(labelOrder, ",")
+			for i := range labels {
+				labels[i] = strings.TrimSpace(labels[i])
+			}
+			level.Info(logger).Log("label_order", strings.Join(labels, ","))
+			registryOptions = append(registryOptions, prom.WithLabelOrder(labels...))
+		}
+
+		if topServices > 0 {
+			level.Info(logger).Log("top_services", topServices, "warmup", topWarmup, "interval", topInterval, "other", topOther)
+			registryOptions = append(registryOptions, prom.WithTopServices(topServices, topWarmup, topInterval, topOther))
+		}
+
+		if adminEndpoints {
+			level.Warn(logger).Log("admin_endpoints", "enabled", "msg", "the /admin/* endpoints aren't authenticated, so the listen address must be reachable only by trusted clients")
+			registryOptions = append(registryOptions, prom.WithAdminEndpoints())
+		}
+
+		if standby {
+			if !adminEndpoints {
+				level.Error(logger).Log("err", "-standby requires -admin-endpoints, as a standby is promoted via POST /admin/promote")
+				os.Exit(1)
+			}
+			level.Info(logger).Log("mode", "standby", "msg", "metrics will be served once promoted via POST /admin/promote")
+			registryOptions = append(registryOptions, prom.WithStandby())
+		}
+
+		for _, s := range serviceNamespaces {
+			toks := strings.SplitN(s, "=", 2)
+			if len(toks) != 2 || toks[0] == "" || toks[1] == "" {
+				level.Error(logger).Log("err", "-service-namespace must be of the format 'service ID=namespace'")
+				os.Exit(1)
+			}
+			level.Info(logger).Log("service_id", toks[0], "namespace", toks[1])
+			registryOptions = append(registryOptions, prom.WithServiceNamespace(toks[1], toks[0]))
+		}
+
+		for _, s := range typeSubsystems {
+			toks := strings.SplitN(s, "=", 2)
+			if len(toks) != 2 || toks[0] == "" || toks[1] == "" {
+				level.Error(logger).Log("err", "-service-type-subsystem must be of the format 'type=subsystem'")
+				os.Exit(1)
+			}
+			level.Info(logger).Log("service_type", toks[0], "subsystem", toks[1])
+			registryOptions = append(registryOptions, prom.WithServiceTypeSubsystem(serviceCache, toks[0], toks[1]))
+		}
+
+		for _, s := range metricsSelectors {
+			name, selector, err := parseSelector(s)
+			if err != nil {
+				level.Error(logger).Log("err", "invalid -metrics-selector", "msg", err)
+				os.Exit(1)
+			}
+			level.Info(logger).Log("selector", name, "services", len(selector.Targets))
+			registryOptions = append(registryOptions, prom.WithSelector(name, selector))
+		}
+
+		if environmentRegex != "" {
+			re, err := regexp.Compile(environmentRegex)
+			if err != nil {
+				level.Error(logger).Log("err", "invalid -environment-label-regex", "msg", err)
+				os.Exit(1)
+			}
+			if re.NumSubexp() < 1 {
+				level.Error(logger).Log("err", "-environment-label-regex must have a capture group")
+				os.Exit(1)
+			}
+			level.Info(logger).Log("environment_label", re.String(), "default", environmentValue)
+			registryOptions = append(registryOptions, prom.WithEnvironmentLabel(re, environmentValue))
+		}
+
+		if servicePairRegex != "" {
+			re, err := regexp.Compile(servicePairRegex)
+			if err != nil {
+				level.Error(logger).Log("err", "invalid -service-pair-regex", "msg", err)
+				os.Exit(1)
+			}
+			groups := map[string]bool{}
+			for _, name := range re.SubexpNames() {
+				groups[name] = true
+			}
+			if !groups["service"] || !groups["env"] {
+				level.Error(logger).Log("err", "-service-pair-regex must have capture groups named service and env")
+				os.Exit(1)
+			}
+			level.Info(logger).Log("service_pair_labels", re.String())
+			registryOptions = append(registryOptions, prom.WithServicePairLabels(re))
+		}
+
+		registry = prom.NewRegistryWithOptions(programVersion, namespace, subsystem, metricNameFilter, registryOptions...)
+
+		filtered := prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "metrics_filtered_total",
+			Help:      "Total per-service metric families kept from being registered by -metric-allowlist and -metric-blocklist.",
+		})
+		filtered.Add(float64(registry.FilteredMetrics()))
+		exporterRegistry.MustRegister(filtered)
+
+		if maxLabels > 0 {
+			if err := registry.CheckLabels(maxLabels); err != nil {
+				level.Error(logger).Log("err", "-max-labels exceeded", "msg", err)
+				os.Exit(1)
+			}
+		}
+
+		if stateFile != "" {
+			switch f, err := os.Open(stateFile); {
+			case os.IsNotExist(err):
+				level.Info(logger).Log("state_file", stateFile, "msg", "no saved state, starting fresh")
+			case err != nil:
+				level.Warn(logger).Log("state_file", stateFile, "during", "open", "err", err)
+			default:
+				if err := registry.RestoreState(f); err != nil {
+					level.Warn(logger).Log("state_file", stateFile, "during", "restore", "err", err)
+				} else {
+					level.Info(logger).Log("state_file", stateFile, "msg", "restored counter values")
+				}
+				f.Close()
+			}
+		}
 	}
 
-	var manager *rt.Manager
 	{
 		var (
 			rtLogger          = log.With(logger, "component", "rt.fastly.com")
-			rtClient          = &http.Client{Timeout: rtTimeout, Transport: userAgentTransport(http.DefaultTransport, userAgent)}
+			rtClient          = newAPIClient(transport, rtTimeout, apiRetries, retries, checkRedirect)
 			subscriberOptions = []rt.SubscriberOption{
 				rt.WithLogger(rtLogger),
 				rt.WithMetadataProvider(serviceCache),
+				rt.WithSkipIdleDatacenters(skipIdleDCs),
+				rt.WithRequestRates(requestRates),
+				rt.WithDatacenterShares(dcShares),
+				rt.WithErrorRatios(errorRatios),
+				rt.WithRenameGrace(renameGrace),
+				rt.WithMinimumBucketAge(minBucketAge),
+				rt.WithAlwaysPresent(datacenterCache, alwaysPresent...),
+				rt.WithDatacenterFilter(datacenterFilter),
 			}
 		)
-		manager = rt.NewManager(serviceCache, rtClient, token, registry, subscriberOptions, rtLogger)
+		if pollInterval > 0 || len(pollIntervals) > 0 {
+			overrides := map[string]time.Duration{}
+			for _, s := range pollIntervals {
+				toks := strings.SplitN(s, "=", 2)
+				if len(toks) != 2 || toks[0] == "" {
+					level.Error(logger).Log("err", "-service-poll-interval must be of the format 'service ID=interval'")
+					os.Exit(1)
+				}
+				d, err := time.ParseDuration(toks[1])
+				if err != nil {
+					level.Error(logger).Log("err", "invalid -service-poll-interval", "msg", err)
+					os.Exit(1)
+				}
+				overrides[toks[0]] = d
+			}
+			level.Info(logger).Log("poll_interval", pollInterval, "overrides", len(overrides))
+			subscriberOptions = append(subscriberOptions, rt.WithPollInterval(pollInterval, overrides))
+		}
+		if nameSanitizeRegex != "" {
+			re, err := regexp.Compile(nameSanitizeRegex)
+			if err != nil {
+				level.Error(logger).Log("err", "invalid -service-name-sanitize-regex", "msg", err)
+				os.Exit(1)
+			}
+			level.Info(logger).Log("service_name_sanitize", re.String(), "replacement", nameSanitizeRepl)
+			subscriberOptions = append(subscriberOptions, rt.WithServiceNameSanitizer(func(name string) string {
+				return re.ReplaceAllLiteralString(name, nameSanitizeRepl)
+			}))
+		}
+		if rateSmoothing != 0 {
+			if rateSmoothing < 0 || rateSmoothing > 1 {
+				level.Error(logger).Log("err", "-requests-rate-smoothing must be between 0 and 1")
+				os.Exit(1)
+			}
+			subscriberOptions = append(subscriberOptions, rt.WithSmoothedRequestRate(rateSmoothing))
+		}
+		if len(dcKnown) > 0 {
+			subscriberOptions = append(subscriberOptions, rt.WithDatacenterCatchAll(knownDatacenters, dcCatchAll))
+		}
+		if dcOverride != "" {
+			subscriberOptions = append(subscriberOptions, rt.WithDatacenterOverride(dcOverride))
+		}
+		if dcLimit > 0 {
+			level.Info(logger).Log("datacenters", "limit", "k", dcLimit, "catch_all", dcCatchAll)
+			subscriberOptions = append(subscriberOptions, rt.WithDatacenterLimit(dcLimit, dcCatchAll))
+		}
+		if fleetTotals {
+			requests := prometheus.NewCounter(prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "fleet_requests_total",
+				Help:      "Total requests across all services and datacenters.",
+			})
+			bytes := prometheus.NewCounter(prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "fleet_bytes_total",
+				Help:      "Total bytes delivered from Fastly to end users across all services and datacenters.",
+			})
+			exporterRegistry.MustRegister(requests, bytes)
+			subscriberOptions = append(subscriberOptions, rt.WithFleetTotals(requests, bytes))
+		}
+		if forbiddenLimit > 0 {
+			subscriberOptions = append(subscriberOptions, rt.WithForbiddenLimit(forbiddenLimit))
+		}
+		if len(httpVersions) > 0 {
+			level.Info(logger).Log("http_versions", strings.Join(httpVersions, ","))
+			subscriberOptions = append(subscriberOptions, rt.WithHTTPVersions(httpVersions...))
+		}
+		if len(byteSizeFields) > 0 {
+			level.Info(logger).Log("byte_size_histograms", strings.Join(byteSizeFields, ","))
+			subscriberOptions = append(subscriberOptions, rt.WithByteSizeHistograms(byteSizeFields...))
+		}
+		if dcSample > 1 {
+			level.Info(logger).Log("filter", "datacenters", "type", "sample", "k", dcSample)
+			subscriberOptions = append(subscriberOptions, rt.WithDatacenterSampling(dcSample))
+		}
+		if versionComments {
+			subscriberOptions = append(subscriberOptions, rt.WithVersionComments(serviceCache))
+		}
+		if replayFrom > 0 {
+			level.Info(rtLogger).Log("replay_from", replayFrom)
+			subscriberOptions = append(subscriberOptions, rt.WithReplay(rt.NewReplay(replayFrom)))
+		}
+		var managerOptions []rt.ManagerOption
+		if rampInterval > 0 {
+			level.Info(logger).Log("subscribers", "startup ramp", "interval", rampInterval, "floor", rampFloor)
+			managerOptions = append(managerOptions, rt.WithStartupRamp(rampInterval, rampFloor))
+		}
+		if reapThreshold > 0 {
+			restarts := prometheus.NewCounter(prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "exporter",
+				Name:      "subscriber_restarts_total",
+				Help:      "Total subscribers restarted for making no progress within -subscriber-reap-threshold.",
+			})
+			exporterRegistry.MustRegister(restarts)
+			level.Info(logger).Log("subscribers", "reaper", "threshold", reapThreshold)
+			managerOptions = append(managerOptions, rt.WithReaper(reapThreshold, restarts))
+		}
+		manager = rt.NewManager(serviceCache, rtClient, token, registry, subscriberOptions, rtLogger, managerOptions...)
 		manager.Refresh() // populate initial subscribers, based on the initial cache refresh
 	}
 
@@ -329,27 +1021,66 @@ func main() {
 			cancel()
 		})
 	}
+	if reapThreshold > 0 {
+		// Regularly ask the rt.Manager to restart any wedged subscribers.
+		var (
+			ctx, cancel = context.WithCancel(context.Background())
+			ticker      = time.NewTicker(reapThreshold / 2)
+		)
+		g.Add(func() error {
+			for {
+				select {
+				case <-ticker.C:
+					manager.Reap()
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}, func(error) {
+			ticker.Stop()
+			cancel()
+		})
+	}
 	{
-		// Every serviceRefresh, ask the api.ServiceCache to refresh the set of
-		// services we should be exporting data for. Then, ask the rt.Manager to
-		// refresh its set of rt.Subscribers, based on those latest services.
+		// Every serviceRefresh, or immediately on SIGUSR1 or resharding, ask the
+		// api.ServiceCache to refresh the set of services we should be
+		// exporting data for. Then, ask the rt.Manager to refresh its set of
+		// rt.Subscribers, based on those latest services, and the
+		// api.ProductCache to check their enabled products, if any. Both
+		// triggers are handled by this one loop, so refreshes never overlap.
 		var (
 			ctx, cancel = context.WithCancel(context.Background())
 			ticker      = time.NewTicker(serviceRefresh)
+			signals     = make(chan os.Signal, 1)
 		)
+		if len(refreshSignals) > 0 {
+			signal.Notify(signals, refreshSignals...)
+		}
+		refresh := func() {
+			refreshServices(ctx, serviceCache, manager, apiLogger)
+			if len(products) > 0 {
+				if err := productCache.Refresh(ctx, serviceCache.ServiceIDs()); err != nil {
+					level.Warn(apiLogger).Log("during", "product refresh", "err", err, "msg", "enabled products may be stale")
+				}
+			}
+		}
 		g.Add(func() error {
 			for {
 				select {
 				case <-ticker.C:
-					if err := serviceCache.Refresh(ctx); err != nil {
-						level.Warn(apiLogger).Log("during", "service refresh", "err", err, "msg", "the set of exported services and their metadata may be stale")
-					}
-					manager.Refresh() // safe to do with stale data in the cache
+					refresh()
+				case sig := <-signals:
+					level.Info(apiLogger).Log("signal", sig, "msg", "refreshing services")
+					refresh()
+				case <-resharded:
+					level.Info(apiLogger).Log("msg", "refreshing services after resharding")
+					refresh()
 				case <-ctx.Done():
 					return ctx.Err()
 				}
 			}
 		}, func(error) {
+			signal.Stop(signals)
 			ticker.Stop()
 			cancel()
 		})
@@ -366,14 +1097,59 @@ func main() {
 			cancel()
 		})
 	}
-	{
+	if stateFile != "" {
+		// Every minute, and on shutdown, save counter values to the state file,
+		// so that they can be restored after a restart.
+		var (
+			ctx, cancel = context.WithCancel(context.Background())
+			ticker      = time.NewTicker(time.Minute)
+		)
+		g.Add(func() error {
+			for {
+				select {
+				case <-ticker.C:
+					if err := saveState(registry, stateFile); err != nil {
+						level.Warn(logger).Log("state_file", stateFile, "during", "save", "err", err)
+					}
+				case <-ctx.Done():
+					if err := saveState(registry, stateFile); err != nil {
+						level.Warn(logger).Log("state_file", stateFile, "during", "save", "err", err)
+					}
+					return ctx.Err()
+				}
+			}
+		}, func(error) {
+			ticker.Stop()
+			cancel()
+		})
+	}
+	if textfile != "" {
+		// Periodically write all metrics to a file, for environments where
+		// an agent collects them rather than Prometheus scraping us.
+		var (
+			ctx, cancel = context.WithCancel(context.Background())
+			writer      = prom.NewTextfileWriter(registry, textfile, textfileInterval, logger)
+		)
+		g.Add(func() error {
+			level.Info(logger).Log("textfile", textfile, "interval", textfileInterval)
+			return writer.Run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if listen != "" {
 		// The HTTP server that Prometheus will scrape.
 		serverLogger := log.With(logger, "component", "server")
 		server := http.Server{
-			Addr:    listen,
-			Handler: registry,
+			Addr:      listen,
+			Handler:   registry,
+			TLSConfig: tlsConfig,
 		}
 		g.Add(func() error {
+			if tlsConfig != nil {
+				level.Info(serverLogger).Log("listen", listen, "tls", true, "tls_min_version", tlsMinVersion)
+				return server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+			}
 			level.Info(serverLogger).Log("listen", listen)
 			return server.ListenAndServe()
 		}, func(error) {
@@ -394,6 +1170,350 @@ func main() {
 	level.Info(logger).Log("exit", g.Run())
 }
 
+// refreshServices asks the api.ServiceCache to refresh the set of services we
+// should be exporting data for, and then asks the rt.Manager to refresh its set
+// of rt.Subscribers based on those latest services.
+func refreshServices(ctx context.Context, cache *api.ServiceCache, manager *rt.Manager, logger log.Logger) {
+	if err := cache.Refresh(ctx); err != nil {
+		level.Warn(logger).Log("during", "service refresh", "err", err, "msg", "the set of exported services and their metadata may be stale")
+	}
+	manager.Refresh() // safe to do with stale data in the cache
+}
+
+// shardInfo returns a static gauge identifying the shard of services this
+// exporter is responsible for, so replicas can be told apart. Without a shard,
+// the exporter is responsible for all services, i.e. shard 1/1.
+func shardInfo(namespace string, n, m uint64) prometheus.Collector {
+	if m == 0 {
+		n, m = 1, 1
+	}
+	shard := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "shard",
+		Help:      "Static gauge identifying the shard of services handled by this exporter.",
+	}, []string{"n", "m"})
+	shard.WithLabelValues(strconv.FormatUint(n, 10), strconv.FormatUint(m, 10)).Set(1)
+	return shard
+}
+
+// filterInfo returns a static gauge describing the service filters, so that
+// what each exporter is configured to watch can be audited via Prometheus. The
+// allow and block patterns are joined with "|", which yields a regex with the
+// same meaning as the set of patterns.
+func filterInfo(namespace string, nameAllow, nameBlock []string, n, m uint64) prometheus.Collector {
+	if m == 0 {
+		n, m = 1, 1
+	}
+	info := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "filter_info",
+		Help:      "Static gauge with the service name allowlist and blocklist patterns, and shard, configured for this exporter.",
+	}, []string{"name_allow", "name_block", "shard"})
+	info.WithLabelValues(strings.Join(nameAllow, "|"), strings.Join(nameBlock, "|"), fmt.Sprintf("%d/%d", n, m)).Set(1)
+	return info
+}
+
+// configHash returns a stable digest of the program version and the effective
+// value of every flag, except the excluded ones, e.g. secrets. Replicas with the
+// same version and configuration have the same hash, wherever the
+// configuration came from.
+func configHash(version string, fs *flag.FlagSet, exclude ...string) string {
+	excluded := map[string]bool{}
+	for _, name := range exclude {
+		excluded[name] = true
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "version=%s\n", version)
+	fs.VisitAll(func(f *flag.Flag) { // in lexicographical order
+		if !excluded[f.Name] {
+			fmt.Fprintf(h, "%s=%s\n", f.Name, f.Value.String())
+		}
+	})
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// configHashInfo returns a static gauge carrying the config hash, so that
+// drift between replicas can be spotted with a single query.
+func configHashInfo(namespace, hash string) prometheus.Collector {
+	info := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "config_hash",
+		Help:      "Static gauge with a digest of the exporter's version and configuration, excluding secrets.",
+	}, []string{"hash"})
+	info.WithLabelValues(hash).Set(1)
+	return info
+}
+
+// resourceStats returns gauges of the exporter's own goroutines and heap bytes,
+// read at gather time, so the exporter can be monitored without a Go collector.
+func resourceStats(namespace string) []prometheus.Collector {
+	var collectors []prometheus.Collector
+	for _, r := range []struct {
+		kind string
+		f    func() float64
+	}{
+		{"goroutines", func() float64 { return float64(runtime.NumGoroutine()) }},
+		{"heap_bytes", func() float64 {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			return float64(stats.HeapAlloc)
+		}},
+	} {
+		collectors = append(collectors, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "resource",
+			Help:        "Resource usage of the exporter itself, by kind: goroutines, or heap_bytes allocated.",
+			ConstLabels: prometheus.Labels{"kind": r.kind},
+		}, r.f))
+	}
+	return collectors
+}
+
+// parseShard parses a shard of the form n/m, where 0 < n <= m.
+func parseShard(s string) (n, m uint64, err error) {
+	toks := strings.SplitN(s, "/", 2)
+	if len(toks) != 2 {
+		return 0, 0, fmt.Errorf("%q: must be of the format 'n/m'", s)
+	}
+	if n, err = strconv.ParseUint(toks[0], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("%q: must be of the format 'n/m'", s)
+	}
+	if m, err = strconv.ParseUint(toks[1], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("%q: must be of the format 'n/m'", s)
+	}
+	if n == 0 {
+		return 0, 0, fmt.Errorf("%q: n must be greater than zero", s)
+	}
+	if n > m {
+		return 0, 0, fmt.Errorf("%q: n must be less than or equal to m", s)
+	}
+	return n, m, nil
+}
+
+// filterTestHandler responds with the services that would be selected if the
+// service name filter were replaced with the allowlist and blocklist in the
+// name_allow and name_block query parameters, each of which may be repeated.
+func filterTestHandler(cache *api.ServiceCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var f filter.Filter
+		for _, expr := range req.URL.Query()["name_allow"] {
+			if err := f.Allow(expr); err != nil {
+				http.Error(w, fmt.Sprintf("name_allow: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, expr := range req.URL.Query()["name_block"] {
+			if err := f.Block(expr); err != nil {
+				http.Error(w, fmt.Sprintf("name_block: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		type service struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		}
+		selected := []service{}
+		for _, s := range cache.TryNameFilter(f) {
+			selected = append(selected, service{s.ID, s.Name})
+		}
+
+		w.Header().Set("content-type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(struct {
+			Services []service `json:"services"`
+		}{selected})
+	})
+}
+
+// refreshServiceHandler refreshes the service in the id query parameter, and
+// then calls refreshed, e.g. to start its subscriber. Failures are reported
+// with a status that tells a bad request apart from a failure upstream.
+func refreshServiceHandler(cache *api.ServiceCache, refreshed func(), logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := cache.RefreshService(req.Context(), id); err != nil {
+			level.Warn(logger).Log("service_id", id, "during", "refresh service", "err", err)
+			http.Error(w, err.Error(), refreshServiceStatus(err))
+			return
+		}
+		refreshed()
+
+		name, version, _ := cache.Metadata(id)
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "service %s %q version %d\n", id, name, version)
+	})
+}
+
+// refreshServiceStatus returns the HTTP status to respond with when refreshing
+// a single service fails with err: 404 or 403 if the Fastly API says the
+// service doesn't exist or the token can't access it, 422 if the service
+// filters reject it, and 502 for any other failure of the Fastly API, or of the
+// request to it.
+func refreshServiceStatus(err error) int {
+	var apiErr *api.Error
+	switch {
+	case errors.Is(err, api.ErrServiceRejected):
+		return http.StatusUnprocessableEntity
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+		return http.StatusNotFound
+	case errors.As(err, &apiErr) && (apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden):
+		return http.StatusForbidden
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// debugErrorsHandler serves the most recent error of each subscriber of the
+// manager returned by the function, as JSON. The manager is constructed after
+// the handler, so it's resolved on each request; until then, no errors are
+// reported.
+func debugErrorsHandler(manager func() *rt.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		type serviceError struct {
+			ServiceID string    `json:"service_id"`
+			Error     string    `json:"error"`
+			Time      time.Time `json:"time"`
+		}
+		errs := []serviceError{}
+		if m := manager(); m != nil {
+			for _, e := range m.LastErrors() {
+				errs = append(errs, serviceError{e.ServiceID, e.Err, e.Time})
+			}
+		}
+
+		w.Header().Set("content-type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(struct {
+			Errors []serviceError `json:"errors"`
+		}{errs})
+	})
+}
+
+// newAPIClient returns an HTTP client for Fastly APIs with the given timeout.
+// If retries is positive, failed requests are retried up to that many times,
+// and each retry is counted.
+func newAPIClient(transport http.RoundTripper, timeout time.Duration, retries int, counter *prometheus.CounterVec, checkRedirect func(*http.Request, []*http.Request) error) *http.Client {
+	if retries > 0 {
+		transport = retryTransport(transport, retries, time.Second, counter)
+	}
+	return &http.Client{
+		Timeout:       timeout,
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// serverTLSConfig returns the TLS configuration for the HTTPS server, which
+// accepts only the given minimum TLS version and up, e.g. "1.2", and if any are
+// given, only the comma-separated cipher suites, by their standard names.
+func serverTLSConfig(minVersion, cipherSuites string) (*tls.Config, error) {
+	versions := map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+	version, ok := versions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported minimum TLS version %q (supported: 1.0, 1.1, 1.2, 1.3)", minVersion)
+	}
+
+	config := &tls.Config{MinVersion: version}
+	if cipherSuites == "" {
+		return config, nil
+	}
+
+	ids := map[string]uint16{}
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids[cs.Name] = cs.ID
+	}
+	for _, name := range strings.Split(cipherSuites, ",") {
+		id, ok := ids[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	return config, nil
+}
+
+// parseBuckets parses comma-separated histogram bucket boundaries, which must
+// be in strictly increasing order.
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, tok := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(tok), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", tok, err)
+		}
+		if n := len(buckets); n > 0 && f <= buckets[n-1] {
+			return nil, fmt.Errorf("%q: buckets must be in increasing order", s)
+		}
+		buckets = append(buckets, f)
+	}
+	return buckets, nil
+}
+
+// parseSelector parses a named selector of the form name=key:value,... where
+// each key is service, datacenter-allowlist, or datacenter-blocklist, and may be
+// repeated. Values can't contain commas.
+func parseSelector(s string) (name string, selector prom.Selector, err error) {
+	toks := strings.SplitN(s, "=", 2)
+	if len(toks) != 2 || toks[0] == "" || toks[1] == "" {
+		return "", prom.Selector{}, fmt.Errorf("%q: must be of the format 'name=key:value,...'", s)
+	}
+
+	name = toks[0]
+	for _, pair := range strings.Split(toks[1], ",") {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return "", prom.Selector{}, fmt.Errorf("%q: %q must be of the format 'key:value'", s, pair)
+		}
+		switch key, value := kv[0], kv[1]; key {
+		case "service":
+			selector.Targets = append(selector.Targets, value)
+		case "datacenter-allowlist":
+			err = selector.Datacenters.Allow(value)
+		case "datacenter-blocklist":
+			err = selector.Datacenters.Block(value)
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return "", prom.Selector{}, fmt.Errorf("%q: %w", s, err)
+		}
+	}
+
+	return name, selector, nil
+}
+
+// saveState writes the registry's counter values to path, via a temporary file
+// so that a crash mid-write doesn't clobber the previous state.
+func saveState(registry *prom.Registry, path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := registry.SaveState(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 type stringslice []string
 
 func (ss *stringslice) Set(s string) error {
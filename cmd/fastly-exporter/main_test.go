@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fastly/fastly-exporter/pkg/api"
+	"github.com/fastly/fastly-exporter/pkg/filter"
+	"github.com/fastly/fastly-exporter/pkg/prom"
+	"github.com/fastly/fastly-exporter/pkg/rt"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestShardInfo(t *testing.T) {
+	for _, testcase := range []struct {
+		name string
+		n, m uint64
+		want string
+	}{
+		{"configured", 2, 3, `fastly_exporter_shard{m="3",n="2"} 1`},
+		{"unconfigured", 0, 0, `fastly_exporter_shard{m="1",n="1"} 1`},
+	} {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			want := strings.NewReader(`
+# HELP fastly_exporter_shard Static gauge identifying the shard of services handled by this exporter.
+# TYPE fastly_exporter_shard gauge
+` + testcase.want + "\n")
+			if err := testutil.CollectAndCompare(shardInfo("fastly", testcase.n, testcase.m), want); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestFilterInfo(t *testing.T) {
+	for _, testcase := range []struct {
+		name         string
+		allow, block []string
+		n, m         uint64
+		want         string
+	}{
+		{"configured", []string{"^Production"}, []string{"TEST", "staging$"}, 2, 3, `fastly_exporter_filter_info{name_allow="^Production",name_block="TEST|staging$",shard="2/3"} 1`},
+		{"unconfigured", nil, nil, 0, 0, `fastly_exporter_filter_info{name_allow="",name_block="",shard="1/1"} 1`},
+	} {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			want := strings.NewReader(`
+# HELP fastly_exporter_filter_info Static gauge with the service name allowlist and blocklist patterns, and shard, configured for this exporter.
+# TYPE fastly_exporter_filter_info gauge
+` + testcase.want + "\n")
+			if err := testutil.CollectAndCompare(filterInfo("fastly", testcase.allow, testcase.block, testcase.n, testcase.m), want); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestResourceStats(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(resourceStats("fastly")...)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "fastly_exporter_resource" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() == "kind" {
+					have[pair.GetValue()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+
+	for _, kind := range []string{"goroutines", "heap_bytes"} {
+		kind := kind
+		t.Run(kind, func(t *testing.T) {
+			value, ok := have[kind]
+			if !ok {
+				t.Fatalf(`fastly_exporter_resource{kind=%q}: missing`, kind)
+			}
+			if value <= 0 {
+				t.Errorf(`fastly_exporter_resource{kind=%q}: want positive value, have %v`, kind, value)
+			}
+		})
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	for _, testcase := range []struct {
+		input   string
+		name    string
+		targets []string
+		permit  map[string]bool
+		err     bool
+	}{
+		{"one=service:AAA", "one", []string{"AAA"}, map[string]bool{"NYC": true}, false},
+		{"two=service:AAA,service:BBB,datacenter-allowlist:^(NYC|LHR)$,datacenter-blocklist:^LHR$", "two", []string{"AAA", "BBB"}, map[string]bool{"NYC": true, "LHR": false, "AMS": false}, false},
+		{"=service:AAA", "", nil, nil, true},
+		{"three", "", nil, nil, true},
+		{"four=target:AAA", "", nil, nil, true},
+		{"five=datacenter-allowlist:(", "", nil, nil, true},
+	} {
+		testcase := testcase
+		t.Run(testcase.input, func(t *testing.T) {
+			name, selector, err := parseSelector(testcase.input)
+			if want, have := testcase.err, err != nil; want != have {
+				t.Fatalf("error: want %v, have %v", want, err)
+			}
+			if want, have := testcase.name, name; want != have {
+				t.Errorf("name: want %q, have %q", want, have)
+			}
+			if want, have := testcase.targets, selector.Targets; !reflect.DeepEqual(want, have) {
+				t.Errorf("targets: want %v, have %v", want, have)
+			}
+			for code, want := range testcase.permit {
+				if have := selector.Datacenters.Permit(code); want != have {
+					t.Errorf("datacenter %s: want %v, have %v", code, want, have)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	newFlagSet := func(args ...string) *flag.FlagSet {
+		t.Helper()
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String("token", "", "")
+		fs.String("service-shard", "", "")
+		fs.Duration("poll-interval", 0, "")
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	}
+
+	var (
+		base      = configHash("1.0.0", newFlagSet("-token", "aaa", "-service-shard", "1/3"), "token")
+		same      = configHash("1.0.0", newFlagSet("-service-shard", "1/3", "-token", "aaa"), "token")
+		secret    = configHash("1.0.0", newFlagSet("-token", "bbb", "-service-shard", "1/3"), "token")
+		changed   = configHash("1.0.0", newFlagSet("-token", "aaa", "-service-shard", "2/3"), "token")
+		defaulted = configHash("1.0.0", newFlagSet("-token", "aaa", "-service-shard", "1/3", "-poll-interval", "0s"), "token")
+		upgraded  = configHash("1.1.0", newFlagSet("-token", "aaa", "-service-shard", "1/3"), "token")
+	)
+
+	if base != same {
+		t.Errorf("identical config: %s != %s", base, same)
+	}
+	if base != secret {
+		t.Errorf("different secret: %s != %s", base, secret)
+	}
+	if base != defaulted {
+		t.Errorf("explicit default: %s != %s", base, defaulted)
+	}
+	if base == changed {
+		t.Errorf("different config: both %s", base)
+	}
+	if base == upgraded {
+		t.Errorf("different version: both %s", base)
+	}
+}
+
+func TestRefreshServiceHandler(t *testing.T) {
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		respond := func(code int, body string) (*http.Response, error) {
+			return &http.Response{StatusCode: code, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+		}
+		switch strings.TrimPrefix(req.URL.Path, "/service/") {
+		case "AAA":
+			return respond(http.StatusOK, `{"id":"AAA","name":"www-prod","version":1}`)
+		case "BBB":
+			return respond(http.StatusOK, `{"id":"BBB","name":"api-prod","version":1}`)
+		case "CCC":
+			return respond(http.StatusForbidden, `{"msg":"Forbidden"}`)
+		case "DDD":
+			return respond(http.StatusServiceUnavailable, `{"msg":"Service Unavailable"}`)
+		case "EEE":
+			return respond(http.StatusTooManyRequests, `{"msg":"Too Many Requests"}`)
+		case "FFF":
+			return nil, errors.New("connection refused")
+		default:
+			return respond(http.StatusNotFound, `{"msg":"Record not found"}`)
+		}
+	})}
+	var nameFilter filter.Filter
+	nameFilter.Allow(`^www-`)
+
+	for _, testcase := range []struct {
+		name string
+		id   string
+		code int
+	}{
+		{"found", "AAA", http.StatusOK},
+		{"missing id", "", http.StatusBadRequest},
+		{"rejected by filters", "BBB", http.StatusUnprocessableEntity},
+		{"unknown", "ZZZ", http.StatusNotFound},
+		{"forbidden", "CCC", http.StatusForbidden},
+		{"upstream error", "DDD", http.StatusBadGateway},
+		{"upstream rate limit", "EEE", http.StatusBadGateway},
+		{"transport error", "FFF", http.StatusBadGateway},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			var (
+				cache     = api.NewServiceCache(client, "irrelevant_token", api.WithNameFilter(nameFilter))
+				refreshed bool
+				handler   = refreshServiceHandler(cache, func() { refreshed = true }, log.NewNopLogger())
+				rec       = httptest.NewRecorder()
+			)
+			handler.ServeHTTP(rec, httptest.NewRequest("POST", "/admin/refresh-service?id="+testcase.id, nil))
+
+			if want, have := testcase.code, rec.Code; want != have {
+				t.Errorf("code: want %d, have %d (%s)", want, have, strings.TrimSpace(rec.Body.String()))
+			}
+			if want, have := testcase.code == http.StatusOK, refreshed; want != have {
+				t.Errorf("refreshed: want %v, have %v", want, have)
+			}
+		})
+	}
+}
+
+func TestFilterTestHandler(t *testing.T) {
+	client := &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		body := `[{"id":"AAA","name":"www-prod"},{"id":"BBB","name":"www-staging"},{"id":"CCC","name":"api-prod"}]`
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	})}
+	var nameFilter filter.Filter
+	nameFilter.Allow(`^www-`)
+	cache := api.NewServiceCache(client, "irrelevant_token", api.WithNameFilter(nameFilter))
+	if err := cache.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testcase := range []struct {
+		name  string
+		query string
+		code  int
+		want  string
+	}{
+		{"no filter", "", 200, `{"services":[{"id":"AAA","name":"www-prod"},{"id":"BBB","name":"www-staging"},{"id":"CCC","name":"api-prod"}]}`},
+		{"allow", "name_allow=prod$", 200, `{"services":[{"id":"AAA","name":"www-prod"},{"id":"CCC","name":"api-prod"}]}`},
+		{"allow and block", "name_allow=prod$&name_block=^api", 200, `{"services":[{"id":"AAA","name":"www-prod"}]}`},
+		{"none", "name_allow=nothing", 200, `{"services":[]}`},
+		{"invalid", "name_block=(", 400, ""},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/admin/filter-test?"+testcase.query, nil)
+			filterTestHandler(cache).ServeHTTP(rec, req)
+
+			if want, have := testcase.code, rec.Code; want != have {
+				t.Fatalf("code: want %d, have %d", want, have)
+			}
+			if testcase.code != 200 {
+				return
+			}
+			if want, have := testcase.want, strings.TrimSpace(rec.Body.String()); want != have {
+				t.Errorf("\nwant %s\nhave %s", want, have)
+			}
+		})
+	}
+
+	if want, have := []string{"AAA", "BBB"}, cache.ServiceIDs(); !reflect.DeepEqual(want, have) {
+		t.Errorf("cached services changed: want %v, have %v", want, have)
+	}
+}
+
+func TestDebugErrorsHandler(t *testing.T) {
+	apiClient := &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		body := `[{"id":"AAA","name":"Service One"},{"id":"BBB","name":"Service Two"}]`
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	})}
+	cache := api.NewServiceCache(apiClient, "irrelevant_token")
+	if err := cache.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rtClient := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.Path, "/BBB/") {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		body := `{"Error":"bad key secret_token"}`
+		return &http.Response{StatusCode: http.StatusInternalServerError, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	})}
+	var (
+		registry = prom.NewRegistry("dev", "fastly", "rt", filter.Filter{})
+		manager  = rt.NewManager(cache, rtClient, "secret_token", registry, nil, log.NewNopLogger())
+		handler  = debugErrorsHandler(func() *rt.Manager { return manager })
+	)
+	manager.Refresh()
+	defer manager.StopAll()
+
+	t.Run("failing service", func(t *testing.T) {
+		var body string
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/errors", nil))
+			if body = rec.Body.String(); strings.Contains(body, "BBB") {
+				break
+			}
+		}
+
+		if want := `"service_id":"BBB","error":"status code 500: bad key \u003credacted\u003e"`; !strings.Contains(body, want) {
+			t.Errorf("want %s, have %s", want, body)
+		}
+		if strings.Contains(body, "AAA") {
+			t.Errorf("healthy service AAA reported: %s", body)
+		}
+	})
+}
+
+func TestRefreshServices(t *testing.T) {
+	var body atomic.Value
+	body.Store(`[{"id":"AAA","name":"Service One"}]`)
+	apiClient := &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body.Load().(string)))}, nil
+	})}
+	rtClient := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})}
+	var (
+		cache    = api.NewServiceCache(apiClient, "irrelevant_token")
+		registry = prom.NewRegistry("dev", "fastly", "rt", filter.Filter{})
+		manager  = rt.NewManager(cache, rtClient, "irrelevant_token", registry, nil, log.NewNopLogger())
+	)
+	defer manager.StopAll()
+
+	refreshServices(context.Background(), cache, manager, log.NewNopLogger())
+	if want, have := []string{"AAA"}, manager.Active(); !reflect.DeepEqual(want, have) {
+		t.Errorf("first refresh: want %v, have %v", want, have)
+	}
+
+	body.Store(`[{"id":"BBB","name":"Service Two"},{"id":"CCC","name":"Service Three"}]`)
+	refreshServices(context.Background(), cache, manager, log.NewNopLogger())
+	if want, have := []string{"BBB", "CCC"}, manager.Active(); !reflect.DeepEqual(want, have) {
+		t.Errorf("second refresh: want %v, have %v", want, have)
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	config, err := serverTLSConfig("1.2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.TLS = config
+	server.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0) // expected handshake errors
+	server.StartTLS()
+	defer server.Close()
+
+	for _, testcase := range []struct {
+		name       string
+		maxVersion uint16
+		ok         bool
+	}{
+		{"TLS 1.1", tls.VersionTLS11, false},
+		{"TLS 1.2", tls.VersionTLS12, true},
+		{"TLS 1.3", tls.VersionTLS13, true},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			client := server.Client()
+			transport := client.Transport.(*http.Transport).Clone()
+			transport.TLSClientConfig.MinVersion = tls.VersionTLS10
+			transport.TLSClientConfig.MaxVersion = testcase.maxVersion
+			client.Transport = transport
+
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if want, have := testcase.ok, err == nil; want != have {
+				t.Errorf("handshake succeeded: want %v, have %v (%v)", want, have, err)
+			}
+		})
+	}
+
+	config, err = serverTLSConfig("1.2", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, config.CipherSuites; !reflect.DeepEqual(want, have) {
+		t.Errorf("cipher suites: want %v, have %v", want, have)
+	}
+
+	for _, testcase := range []struct{ minVersion, cipherSuites string }{
+		{"1.4", ""},
+		{"1.2", "TLS_NOT_A_CIPHER"},
+	} {
+		if _, err := serverTLSConfig(testcase.minVersion, testcase.cipherSuites); err == nil {
+			t.Errorf("%q %q: want error, have none", testcase.minVersion, testcase.cipherSuites)
+		}
+	}
+}
+
+func TestProductClientTimeout(t *testing.T) {
+	var (
+		slow = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			select {
+			case <-time.After(100 * time.Millisecond):
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(`[]`))}, nil
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		})
+		retries       = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "retries_total"}, []string{"operation"})
+		apiClient     = newAPIClient(slow, time.Second, 0, retries, nil)
+		productClient = newAPIClient(slow, 10*time.Millisecond, 0, retries, nil)
+		ctx           = context.Background()
+	)
+
+	if err := api.NewServiceCache(apiClient, "irrelevant_token").Refresh(ctx); err != nil {
+		t.Errorf("service listing: %v", err)
+	}
+
+	var timeout interface{ Timeout() bool }
+	err := api.NewProductCache(productClient, "irrelevant_token", "origin_inspector").Refresh(ctx, []string{"AAA"})
+	if !errors.As(err, &timeout) || !timeout.Timeout() {
+		t.Errorf("products: want timeout, have %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// refreshSignals trigger an immediate service refresh.
+var refreshSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// refreshSignals trigger an immediate service refresh. Windows has no SIGUSR1.
+var refreshSignals []os.Signal
@@ -1,14 +1,248 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 type roundTripperFunc func(*http.Request) (*http.Response, error)
 
 func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
 
+// baseTransport returns the transport underlying every request to Fastly APIs.
+// If insecureSkipVerify is true, TLS certificates aren't verified, which is
+// unsafe, as anyone on the network path can intercept requests, including the
+// token. That's only meant for lab setups behind a proxy with a self-signed
+// certificate.
+func baseTransport(insecureSkipVerify bool) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if insecureSkipVerify {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return t
+}
+
 func userAgentTransport(next http.RoundTripper, userAgent string) http.RoundTripper {
 	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
 		req.Header.Set("User-Agent", userAgent)
 		return next.RoundTrip(req)
 	})
 }
+
+// authFailureTransport counts responses with status 401 Unauthorized or 403
+// Forbidden, which usually mean the token is invalid, revoked, or lacks the
+// required permissions.
+func authFailureTransport(next http.RoundTripper, failures prometheus.Counter) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+		if err == nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			failures.Inc()
+		}
+		return resp, err
+	})
+}
+
+func rateLimitTransport(next http.RoundTripper, limiter *tokenBucket) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if err := limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+		return next.RoundTrip(req)
+	})
+}
+
+// retryTransport re-attempts GET requests which fail with a network error or a
+// 5xx or 429 response, up to the given number of retries, waiting backoff times
+// the attempt number between each. Every re-attempt increments the retries
+// counter, labeled with the operation of the request.
+func retryTransport(next http.RoundTripper, retries int, backoff time.Duration, counter *prometheus.CounterVec) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+		if req.Method != http.MethodGet {
+			return resp, err
+		}
+		for attempt := 1; attempt <= retries && retryable(resp, err); attempt++ {
+			if err == nil {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			if err := contextSleep(req.Context(), time.Duration(attempt)*backoff); err != nil {
+				return nil, err
+			}
+			counter.WithLabelValues(retryOperation(req)).Inc()
+			resp, err = next.RoundTrip(req)
+		}
+		return resp, err
+	})
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// retryOperation classifies a request to a Fastly API by what it's for.
+func retryOperation(req *http.Request) string {
+	switch path := req.URL.Path; {
+	case req.URL.Host == "rt.fastly.com":
+		return "rt"
+	case strings.HasPrefix(path, "/service"):
+		return "services"
+	case strings.HasPrefix(path, "/enabled-products"):
+		return "products"
+	case strings.HasPrefix(path, "/datacenters"):
+		return "datacenters"
+	default:
+		return "other"
+	}
+}
+
+// readTimeoutTransport aborts reading a response body if any single read from
+// it takes longer than the timeout. Unlike the client timeout, which bounds the
+// whole exchange, this catches bodies that stall after the headers arrive.
+func readTimeoutTransport(next http.RoundTripper, timeout time.Duration) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = &timeoutReadCloser{ReadCloser: resp.Body, timeout: timeout}
+		return resp, nil
+	})
+}
+
+// errReadTimeout is returned by reads from a body that stalled.
+var errReadTimeout = errors.New("timeout reading response body")
+
+type timeoutReadCloser struct {
+	io.ReadCloser
+	timeout  time.Duration
+	timedOut int32
+}
+
+func (r *timeoutReadCloser) Read(p []byte) (int, error) {
+	t := time.AfterFunc(r.timeout, func() {
+		atomic.StoreInt32(&r.timedOut, 1)
+		r.ReadCloser.Close() // unblocks the read
+	})
+	n, err := r.ReadCloser.Read(p)
+	t.Stop()
+	if atomic.LoadInt32(&r.timedOut) == 1 {
+		return n, errReadTimeout
+	}
+	return n, err
+}
+
+// tokenBucket is a rate limiter shared by every outbound request. It holds up
+// to burst tokens, refilled at rate tokens per second, and each request takes
+// one token, waiting for it if necessary.
+type tokenBucket struct {
+	mtx    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(context.Context, time.Duration) error
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  contextSleep,
+	}
+}
+
+// Wait blocks until a token is available, or the context is canceled.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	b.mtx.Lock()
+	now := b.now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens-- // reserve a token, possibly one that hasn't been refilled yet
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mtx.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	if err := b.sleep(ctx, wait); err != nil {
+		b.mtx.Lock()
+		b.tokens++ // return the reservation
+		b.mtx.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+func contextSleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+const (
+	redirectPolicySameHost = "same-host"
+	redirectPolicyError    = "error"
+)
+
+// redirectPolicy returns a CheckRedirect function for an http.Client which
+// counts every redirect it sees. With the same-host policy, redirects are
+// followed only if they point to the same host as the original request. With
+// the error policy, redirects are never followed.
+func redirectPolicy(policy string, redirects prometheus.Counter) (func(*http.Request, []*http.Request) error, error) {
+	switch policy {
+	case redirectPolicySameHost:
+		return func(req *http.Request, via []*http.Request) error {
+			redirects.Inc()
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			if from, to := via[0].URL.Host, req.URL.Host; from != to {
+				return fmt.Errorf("refusing to follow redirect from %s to different host %s", from, to)
+			}
+			return nil
+		}, nil
+
+	case redirectPolicyError:
+		return func(req *http.Request, via []*http.Request) error {
+			redirects.Inc()
+			return fmt.Errorf("refusing to follow redirect to %s", req.URL.Redacted())
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown redirect policy %q", policy)
+	}
+}
@@ -1,11 +1,45 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	stdlog "log"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
+func TestBaseTransport(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0) // expected handshake errors
+	server.StartTLS()
+	defer server.Close()
+
+	for _, insecure := range []bool{false, true} {
+		transport := baseTransport(insecure)
+		if want, have := insecure, transport.TLSClientConfig != nil && transport.TLSClientConfig.InsecureSkipVerify; want != have {
+			t.Errorf("insecure %v: InsecureSkipVerify: want %v, have %v", insecure, want, have)
+		}
+
+		client := &http.Client{Transport: transport}
+		_, err := client.Get(server.URL)
+		if want, have := insecure, err == nil; want != have {
+			t.Errorf("insecure %v: request to self-signed server succeeded: want %v, have %v (%v)", insecure, want, have, err)
+		}
+	}
+
+	if c := http.DefaultTransport.(*http.Transport).TLSClientConfig; c != nil && c.InsecureSkipVerify {
+		t.Errorf("default transport was modified")
+	}
+}
+
 func TestUserAgentTransport(t *testing.T) {
 	c := make(chan string, 1)
 	handler := func(_ http.ResponseWriter, r *http.Request) { c <- r.Header.Get("User-Agent") }
@@ -23,3 +57,175 @@ func TestUserAgentTransport(t *testing.T) {
 		t.Fatalf("want %q, have %q", want, have)
 	}
 }
+
+func TestRedirectPolicy(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/same-host":
+			http.Redirect(w, r, "/target", http.StatusFound)
+		case "/cross-host":
+			http.Redirect(w, r, other.URL+"/target", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	for _, testcase := range []struct {
+		policy  string
+		path    string
+		wantErr bool
+	}{
+		{policy: redirectPolicySameHost, path: "/same-host", wantErr: false},
+		{policy: redirectPolicySameHost, path: "/cross-host", wantErr: true},
+		{policy: redirectPolicyError, path: "/same-host", wantErr: true},
+		{policy: redirectPolicyError, path: "/cross-host", wantErr: true},
+	} {
+		t.Run(testcase.policy+testcase.path, func(t *testing.T) {
+			redirects := prometheus.NewCounter(prometheus.CounterOpts{Name: "redirects_total"})
+			checkRedirect, err := redirectPolicy(testcase.policy, redirects)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client := &http.Client{CheckRedirect: checkRedirect}
+			resp, err := client.Get(server.URL + testcase.path)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if want, have := testcase.wantErr, err != nil; want != have {
+				t.Errorf("error: want %v, have %v (%v)", want, have, err)
+			}
+
+			if want, have := 1.0, testutil.ToFloat64(redirects); want != have {
+				t.Errorf("redirects: want %v, have %v", want, have)
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		if _, err := redirectPolicy("bogus", prometheus.NewCounter(prometheus.CounterOpts{Name: "x"})); err == nil {
+			t.Error("want error, have none")
+		}
+	})
+}
+
+func TestAuthFailureTransport(t *testing.T) {
+	var (
+		code = http.StatusOK
+		next = roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: code, Body: http.NoBody}, nil
+		})
+		failures = prometheus.NewCounter(prometheus.CounterOpts{Name: "auth_failures_total"})
+		client   = &http.Client{Transport: authFailureTransport(next, failures)}
+	)
+
+	for _, c := range []int{http.StatusOK, http.StatusUnauthorized, http.StatusNotFound, http.StatusForbidden, http.StatusUnauthorized} {
+		code = c
+		resp, err := client.Get("http://example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if want, have := 3.0, testutil.ToFloat64(failures); want != have {
+		t.Errorf("auth failures: want %v, have %v", want, have)
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	var (
+		calls int
+		next  = roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			if calls++; calls == 1 {
+				return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		})
+		retries = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "retries_total"}, []string{"operation"})
+		client  = &http.Client{Transport: retryTransport(next, 3, time.Millisecond, retries)}
+	)
+
+	resp, err := client.Get("https://api.fastly.com/service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if want, have := http.StatusOK, resp.StatusCode; want != have {
+		t.Errorf("status code: want %d, have %d", want, have)
+	}
+	if want, have := 2, calls; want != have {
+		t.Errorf("calls: want %d, have %d", want, have)
+	}
+	if want, have := 1.0, testutil.ToFloat64(retries.WithLabelValues("services")); want != have {
+		t.Errorf("retries: want %v, have %v", want, have)
+	}
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	var (
+		clock   = time.Unix(0, 0)
+		limiter = newTokenBucket(2, 1)
+		times   []time.Duration
+	)
+	limiter.last = clock
+	limiter.now = func() time.Time { return clock }
+	limiter.sleep = func(_ context.Context, d time.Duration) error { clock = clock.Add(d); return nil }
+
+	next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		times = append(times, clock.Sub(time.Unix(0, 0)))
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	client := &http.Client{Transport: rateLimitTransport(next, limiter)}
+
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get("http://example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	want := []time.Duration{0, 500 * time.Millisecond, time.Second, 1500 * time.Millisecond, 2 * time.Second}
+	if !reflect.DeepEqual(want, times) {
+		t.Errorf("request times: want %v, have %v", want, times)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limiter.sleep = contextSleep
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://example.com", nil)
+	if _, err := client.Do(req); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled request: want %v, have %v", context.Canceled, err)
+	}
+}
+
+func TestReadTimeoutTransport(t *testing.T) {
+	stall := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"Data":[`))
+		w.(http.Flusher).Flush()
+		<-stall // headers and part of the body have arrived, then nothing
+	}))
+	defer server.Close()
+	defer close(stall)
+
+	client := &http.Client{Transport: readTimeoutTransport(http.DefaultTransport, 50*time.Millisecond)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	begin := time.Now()
+	if _, err := io.ReadAll(resp.Body); !errors.Is(err, errReadTimeout) {
+		t.Errorf("read: want %v, have %v", errReadTimeout, err)
+	}
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("read took %s, want about 50ms", took)
+	}
+}
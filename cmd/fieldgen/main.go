@@ -87,6 +87,8 @@ func exec() error {
 		}
 	}
 
+	all := append(builtinMetrics, metrics...)
+
 	var buf = bytes.NewBuffer(nil)
 
 	fmt.Fprintln(buf, "// Code generated by fieldgen; DO NOT EDIT.")
@@ -106,10 +108,7 @@ func exec() error {
 	fmt.Fprintln(buf)
 	fmt.Fprintln(buf, "// Metrics collects all of the Prometheus metrics exported by this service.")
 	fmt.Fprintln(buf, "type Metrics struct {")
-	fmt.Fprintln(buf, "\tRealtimeAPIRequestsTotal *prometheus.CounterVec")
-	fmt.Fprintln(buf, "\tServiceInfo *prometheus.GaugeVec")
-	fmt.Fprintln(buf, "\tLastSuccessfulResponse *prometheus.GaugeVec")
-	for _, m := range metrics {
+	for _, m := range all {
 		fmt.Fprintf(buf, "\t%s *prometheus.%sVec\n", m.FieldName, m.Type)
 	}
 	fmt.Fprintln(buf, "}")
@@ -118,10 +117,7 @@ func exec() error {
 	fmt.Fprintln(buf, "// Only metrics whose names pass the name filter are registered.")
 	fmt.Fprintln(buf, "func NewMetrics(namespace, subsystem string, nameFilter filter.Filter, r prometheus.Registerer) *Metrics {")
 	fmt.Fprintln(buf, "\tm := Metrics{")
-	fmt.Fprintln(buf, "\t\t"+`RealtimeAPIRequestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "realtime_api_requests_total", Help: "Total requests made to the real-time stats API.", }, []string{"service_id", "service_name", "result"}),`)
-	fmt.Fprintln(buf, "\t\t"+`ServiceInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "service_info", Help: "Static gauge with service ID, name, and version information.", }, []string{"service_id", "service_name", "service_version"}),`)
-	fmt.Fprintln(buf, "\t\t"+`LastSuccessfulResponse: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "last_successful_response", Help: "Unix timestamp of the last successful response received from the real-time stats API.", }, []string{"service_id", "service_name"}),`)
-	for _, m := range metrics {
+	for _, m := range all {
 		fmt.Fprintf(buf, "\t\t%s: %s,\n", m.FieldName, m.create())
 	}
 	fmt.Fprintln(buf, "\t}")
@@ -130,35 +126,64 @@ func exec() error {
 	fmt.Fprintln(buf, "\treturn &m")
 	fmt.Fprintln(buf, "}")
 	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "// MetricLabels maps the name of each metric, without its namespace and")
+	fmt.Fprintln(buf, "// subsystem, to the labels of every one of its series, including the le label")
+	fmt.Fprintln(buf, "// of histograms. None of the metrics have constant labels.")
+	fmt.Fprintln(buf, "var MetricLabels = map[string][]string{")
+	for _, m := range all {
+		fmt.Fprintf(buf, "\t%q: {%s},\n", m.MetricName, quoteList(m.seriesLabels()))
+	}
+	fmt.Fprintln(buf, "}")
+	fmt.Fprintln(buf)
 	fmt.Fprintln(buf, getNameBlock)
 	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, byNameBlock)
+	fmt.Fprintln(buf)
 	fmt.Fprintln(buf, "// Process updates the metrics with data from the API response.")
 	fmt.Fprintln(buf, "func Process(response *APIResponse, serviceID, serviceName, serviceVersion string, m *Metrics) {")
 	fmt.Fprintln(buf, "\tfor _, d := range response.Data {")
 	fmt.Fprintln(buf, "\t\tfor datacenter, stats := range d.Datacenter {")
+	fmt.Fprintln(buf, "\t\t\tProcessDatacenter(&stats, serviceID, serviceName, datacenter, m)")
+	fmt.Fprintln(buf, "\t\t}")
+	fmt.Fprintln(buf, "\t}")
+	fmt.Fprintln(buf, "}")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "// ProcessDatacenter updates the metrics with data from a single datacenter")
+	fmt.Fprintln(buf, "// in a single bucket of the API response.")
+	fmt.Fprintln(buf, "func ProcessDatacenter(stats *Datacenter, serviceID, serviceName, datacenter string, m *Metrics) {")
 	for _, m := range mappings {
 		switch m.Kind {
 		case "Counter":
-			fmt.Fprintf(buf, "\t\t\tm.%s.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.%s))\n", m.ExporterMetric, m.APIField)
+			fmt.Fprintf(buf, "\tm.%s.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.%s))\n", m.ExporterMetric, m.APIField)
 		case "Counter1000":
-			fmt.Fprintf(buf, "\t\t\tm.%s.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.%s) / 10000.0)\n", m.ExporterMetric, m.APIField)
+			fmt.Fprintf(buf, "\tm.%s.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.%s) / 10000.0)\n", m.ExporterMetric, m.APIField)
 		case "CounterLabels":
 			for _, pair := range m.APIFieldLabels {
-				fmt.Fprintf(buf, "\t\t\tm.%s.WithLabelValues(serviceID, serviceName, datacenter, \"%s\").Add(float64(stats.%s))\n", m.ExporterMetric, pair[1], pair[0])
+				fmt.Fprintf(buf, "\tm.%s.WithLabelValues(serviceID, serviceName, datacenter, \"%s\").Add(float64(stats.%s))\n", m.ExporterMetric, pair[1], pair[0])
 			}
 		case "Histogram":
-			fmt.Fprintf(buf, "\t\t\tprocessHistogram(stats.%s, m.%s.WithLabelValues(serviceID, serviceName, datacenter))\n", m.APIField, m.ExporterMetric)
+			fmt.Fprintf(buf, "\tprocessHistogram(stats.%s, m.%s.WithLabelValues(serviceID, serviceName, datacenter))\n", m.APIField, m.ExporterMetric)
 		case "ObjectSize":
-			fmt.Fprintf(buf, "\t\t\tprocessObjectSizes(stats.ObjectSize1k, stats.ObjectSize10k, stats.ObjectSize100k, stats.ObjectSize1m, stats.ObjectSize10m, stats.ObjectSize100m, stats.ObjectSize1g, m.%s.WithLabelValues(serviceID, serviceName, datacenter))\n", m.ExporterMetric) // hacky hack
+			fmt.Fprintf(buf, "\tprocessObjectSizes(stats.ObjectSize1k, stats.ObjectSize10k, stats.ObjectSize100k, stats.ObjectSize1m, stats.ObjectSize10m, stats.ObjectSize100m, stats.ObjectSize1g, m.%s.WithLabelValues(serviceID, serviceName, datacenter))\n", m.ExporterMetric) // hacky hack
 		case "Ignored":
 			//
 		default:
-			fmt.Fprintf(buf, "\t\t\t// %s: unknown mapping kind %q\n", m.ExporterMetric, m.Kind)
+			fmt.Fprintf(buf, "\t// %s: unknown mapping kind %q\n", m.ExporterMetric, m.Kind)
 		}
 	}
-
-	fmt.Fprintln(buf, "\t\t}")
-	fmt.Fprintln(buf, "\t}")
+	fmt.Fprintln(buf, "}")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "// Empty returns true if every field of the datacenter is zero, which means")
+	fmt.Fprintln(buf, "// the datacenter served no traffic in the corresponding bucket.")
+	fmt.Fprintln(buf, "func (d *Datacenter) Empty() bool {")
+	conds := make([]string, len(fields))
+	for i, f := range fields {
+		conds[i] = fmt.Sprintf("d.%s == 0", f.FieldName)
+		if strings.HasPrefix(f.Type, "map[") {
+			conds[i] = fmt.Sprintf("len(d.%s) == 0", f.FieldName)
+		}
+	}
+	fmt.Fprintf(buf, "\treturn %s\n", strings.Join(conds, " &&\n\t\t"))
 	fmt.Fprintln(buf, "}")
 	fmt.Fprintln(buf)
 	fmt.Fprintln(buf, processBlock)
@@ -183,10 +208,54 @@ type exporterMetric struct {
 	ExtraLabels []string  `json:"extra_labels"`
 	Help        string    `json:"help"`
 	Buckets     []float64 `json:"buckets"`
+	Labels      []string  `json:"-"` // if set, replaces the standard and extra labels
 }
 
 var standardLabels = []string{"service_id", "service_name", "datacenter"}
 
+// builtinMetrics are the metrics about the exporter's handling of each service,
+// rather than fields of the real-time stats API, which come first in Metrics.
+var builtinMetrics = []exporterMetric{
+	{FieldName: "RealtimeAPIRequestsTotal", Type: "Counter", MetricName: "realtime_api_requests_total", Help: "Total requests made to the real-time stats API.", Labels: []string{"service_id", "service_name", "result"}},
+	{FieldName: "ServiceInfo", Type: "Gauge", MetricName: "service_info", Help: "Static gauge with service ID, name, and version information.", Labels: []string{"service_id", "service_name", "service_version"}},
+	{FieldName: "LastSuccessfulResponse", Type: "Gauge", MetricName: "last_successful_response", Help: "Unix timestamp of the last successful response received from the real-time stats API.", Labels: []string{"service_id", "service_name"}},
+	{FieldName: "DatacentersFilteredTotal", Type: "Counter", MetricName: "datacenters_filtered_total", Help: "Total datacenters dropped from real-time responses by the datacenter filter, counted once per bucket.", Labels: []string{"service_id", "service_name"}},
+	{FieldName: "DecodeErrorsTotal", Type: "Counter", MetricName: "decode_errors_total", Help: "Total real-time stats API responses that couldn't be decoded, by kind of error.", Labels: []string{"service_id", "service_name", "kind"}},
+	{FieldName: "ClockSkewSeconds", Type: "Gauge", MetricName: "clock_skew_seconds", Help: "Difference between the local clock and the real-time stats API's clock, per the Date header of the last response. Positive values mean the local clock is ahead.", Labels: []string{"service_id", "service_name"}},
+	{FieldName: "EmptyResponsesTotal", Type: "Counter", MetricName: "empty_responses_total", Help: "Total successful real-time stats API responses with an empty body. These aren't counted as errors. Responses with no buckets of data, e.g. No data available, aren't counted.", Labels: []string{"service_id", "service_name"}},
+	{FieldName: "OldestPendingBucketAgeSeconds", Type: "Gauge", MetricName: "oldest_pending_bucket_age_seconds", Help: "Age of the oldest bucket of real-time data not yet processed, either because it's deferred or because it hasn't been fetched. Grows when the subscriber falls behind.", Labels: []string{"service_id", "service_name"}},
+	{FieldName: "RequestsPerSecond", Type: "Gauge", MetricName: "requests_per_second", Help: "Requests per second, computed from the requests in a bucket and the time since the previous bucket. Only updated if request rates are enabled.", Labels: []string{"service_id", "service_name", "datacenter"}},
+	{FieldName: "DatacenterShare", Type: "Gauge", MetricName: "datacenter_share", Help: "Share of the service's requests served by each datacenter in the most recent bucket, from 0 to 1. Only updated if datacenter shares are enabled.", Labels: []string{"service_id", "service_name", "datacenter"}},
+	{FieldName: "ErrorRatio", Type: "Gauge", MetricName: "error_ratio", Help: "Ratio of 5xx responses to requests in each datacenter in the most recent bucket. Only present for datacenters with requests in that bucket.", Labels: []string{"service_id", "service_name", "datacenter"}},
+	{FieldName: "PollIntervalSeconds", Type: "Gauge", MetricName: "poll_interval_seconds", Help: "Effective minimum interval between real-time stats API requests. Zero means requests are made back to back.", Labels: []string{"service_id", "service_name"}},
+	{FieldName: "FirstBucketLatencySeconds", Type: "Gauge", MetricName: "first_bucket_latency_seconds", Help: "Time from the start of the subscriber to the first bucket of real-time data received for the service.", Labels: []string{"service_id", "service_name"}},
+	{FieldName: "ByteSizeBytes", Type: "Histogram", MetricName: "byte_size_bytes", Help: "Histogram of the per-second byte totals of selected real-time fields in each datacenter. Only observed for fields configured as byte size histograms.", Buckets: []float64{1024, 10240, 102400, 1.024e+06, 1.024e+07, 1.024e+08, 1.024e+09}, Labels: []string{"service_id", "service_name", "datacenter", "field"}},
+	{FieldName: "HTTPVersionRequestsTotal", Type: "Counter", MetricName: "http_version_requests_total", Help: "Total requests by HTTP version, with versions outside the allowlist folded into other. Only counted if HTTP versions are tracked.", Labels: []string{"service_id", "service_name", "datacenter", "version"}},
+	{FieldName: "Forbidden", Type: "Gauge", MetricName: "forbidden", Help: "1 if the subscriber for the service stopped after repeated 403 Forbidden responses from the real-time stats API. Cleared once the service responds successfully again.", Labels: []string{"service_id", "service_name"}},
+	{FieldName: "DatacenterOverflowTotal", Type: "Counter", MetricName: "datacenter_overflow_total", Help: "Total datacenters folded into the catch-all datacenter label because the service reached the datacenter limit, counted once per bucket.", Labels: []string{"service_id", "service_name"}},
+	{FieldName: "LastBucketTimestamp", Type: "Gauge", MetricName: "last_bucket_timestamp", Help: "Unix timestamp of the last bucket of real-time data processed. A flat value reveals a stall, and a regressing one a reset.", Labels: []string{"service_id", "service_name"}},
+	{FieldName: "ServiceNameInfo", Type: "Gauge", MetricName: "service_name_info", Help: "Static gauge mapping the sanitized service name used in labels to the raw service name, when service name sanitization is enabled.", Labels: []string{"service_id", "service_name", "raw_service_name"}},
+	{FieldName: "RequestsRateSmoothed", Type: "Gauge", MetricName: "requests_rate_smoothed", Help: "Requests per second across all datacenters, smoothed over successive buckets with an exponentially weighted moving average. Only updated if smoothed request rates are enabled.", Labels: []string{"service_id", "service_name"}},
+}
+
+// labels returns the variable labels of the metric.
+func (m exporterMetric) labels() []string {
+	if m.Labels != nil {
+		return m.Labels
+	}
+	return append(append([]string{}, standardLabels...), m.ExtraLabels...)
+}
+
+// seriesLabels returns every label of each series of the metric, which for a
+// histogram includes the bucket label.
+func (m exporterMetric) seriesLabels() []string {
+	labels := m.labels()
+	if m.Type == "Histogram" {
+		labels = append(append([]string{}, labels...), "le")
+	}
+	return labels
+}
+
 func quoteList(a []string) string {
 	b := make([]string, len(a))
 	for i, s := range a {
@@ -206,7 +275,7 @@ func (m exporterMetric) create() string {
 	if len(m.Buckets) > 0 {
 		fmt.Fprintf(&sb, `, Buckets: []float64{%s}`, renderFloats(m.Buckets))
 	}
-	fmt.Fprintf(&sb, `}, []string{%s}`, quoteList(append(standardLabels, m.ExtraLabels...)))
+	fmt.Fprintf(&sb, `}, []string{%s}`, quoteList(m.labels()))
 	fmt.Fprintf(&sb, `)`)
 
 	return sb.String()
@@ -279,6 +348,18 @@ func getName(c prometheus.Collector) string {
 	return ""
 }`
 
+const byNameBlock = `
+// ByName returns the metric with the given fully-qualified name, or nil if
+// there's no such metric.
+func (m *Metrics) ByName(name string) prometheus.Collector {
+	for i, v := 0, reflect.ValueOf(*m); i < v.NumField(); i++ {
+		if c, ok := v.Field(i).Interface().(prometheus.Collector); ok && getName(c) == name {
+			return c
+		}
+	}
+	return nil
+}`
+
 const processBlock = `
 func processHistogram(src map[string]uint64, obs prometheus.Observer) {
 	for str, count := range src {
@@ -9,8 +9,11 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/json-iterator/go v1.1.11
 	github.com/oklog/run v1.1.0
+	github.com/pelletier/go-toml v1.6.0
 	github.com/peterbourgon/ff/v3 v3.0.0
 	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.26.0
 	github.com/spaolacci/murmur3 v1.1.0 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 )
@@ -2,9 +2,14 @@ package api_test
 
 import (
 	"fmt"
+	"hash/fnv"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/fastly/fastly-exporter/pkg/api"
 )
 
 type fixedResponseClient struct {
@@ -21,6 +26,21 @@ func (c fixedResponseClient) Do(req *http.Request) (*http.Response, error) {
 	return rec.Result(), nil
 }
 
+// agedResponseClient is a fixedResponseClient whose responses carry an Age
+// header, as if served by a caching proxy.
+type agedResponseClient struct {
+	fixedResponseClient
+	age string
+}
+
+func (c agedResponseClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := c.fixedResponseClient.Do(req)
+	if err == nil {
+		resp.Header.Set("Age", c.age)
+	}
+	return resp, err
+}
+
 //
 //
 //
@@ -54,3 +74,91 @@ func (c paginatedResponseClient) Do(req *http.Request) (*http.Response, error) {
 	}).ServeHTTP(rec, req)
 	return rec.Result(), nil
 }
+
+// etagResponseClient is a paginatedResponseClient whose pages carry an ETag of
+// their content. It responds 304 Not Modified, without a body or Link header,
+// to requests whose If-None-Match is the current ETag of the page.
+type etagResponseClient struct {
+	responses   []string
+	notModified int32
+}
+
+func (c *etagResponseClient) Do(req *http.Request) (*http.Response, error) {
+	etag := func(page int) string {
+		h := fnv.New64a()
+		h.Write([]byte(c.responses[page-1]))
+		return fmt.Sprintf(`"%x"`, h.Sum64())
+	}
+
+	page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+	if page > 0 && page <= len(c.responses) && req.Header.Get("If-None-Match") == etag(page) {
+		atomic.AddInt32(&c.notModified, 1)
+		rec := httptest.NewRecorder()
+		rec.WriteHeader(http.StatusNotModified)
+		return rec.Result(), nil
+	}
+
+	resp, err := paginatedResponseClient{c.responses}.Do(req)
+	if err == nil && resp.StatusCode == http.StatusOK {
+		resp.Header.Set("ETag", etag(page))
+	}
+	return resp, err
+}
+
+//
+//
+//
+
+type slowResponseClient struct {
+	client   api.HTTPClient
+	delay    time.Duration
+	requests *int32
+}
+
+func (c slowResponseClient) Do(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(c.requests, 1)
+	select {
+	case <-time.After(c.delay):
+		return c.client.Do(req)
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+//
+//
+//
+
+// sequenceResponseClient responds to each request with the next response, and
+// repeats the last response once they run out.
+type sequenceResponseClient struct {
+	responses []string
+	n         int32
+}
+
+func (c *sequenceResponseClient) Do(req *http.Request) (*http.Response, error) {
+	n := int(atomic.AddInt32(&c.n, 1)) - 1
+	if n >= len(c.responses) {
+		n = len(c.responses) - 1
+	}
+	return fixedResponseClient{code: 200, response: c.responses[n]}.Do(req)
+}
+
+type pathResponseClient struct {
+	responses map[string]string
+	requested *[]string
+}
+
+func (c pathResponseClient) Do(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*c.requested = append(*c.requested, r.URL.Path)
+		response, ok := c.responses[r.URL.Path]
+		if !ok {
+			http.Error(w, "not found", 404)
+			return
+		}
+		fmt.Fprint(w, response)
+	}).ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
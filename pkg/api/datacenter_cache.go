@@ -89,6 +89,30 @@ func (c *DatacenterCache) Datacenters() []Datacenter {
 	return dcs
 }
 
+// DatacenterCodes returns the codes of the currently cached datacenters.
+func (c *DatacenterCache) DatacenterCodes() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	codes := make([]string, len(c.dcs))
+	for i, dc := range c.dcs {
+		codes[i] = dc.Code
+	}
+	return codes
+}
+
+// DatacenterGroup returns the group, i.e. region, of the datacenter with the
+// given code. If the cache doesn't contain that datacenter, found will be false.
+func (c *DatacenterCache) DatacenterGroup(code string) (group string, found bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, dc := range c.dcs {
+		if dc.Code == code {
+			return dc.Group, true
+		}
+	}
+	return "", false
+}
+
 // Gatherer returns a Prometheus gatherer which will yield current metadata
 // about Fastly datacenters as labels on a gauge metric.
 func (c *DatacenterCache) Gatherer(namespace, subsystem string) (prometheus.Gatherer, error) {
@@ -3,10 +3,12 @@ package api_test
 import (
 	"context"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/fastly/fastly-exporter/pkg/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestDatacenterCache(t *testing.T) {
@@ -52,6 +54,34 @@ func TestDatacenterCache(t *testing.T) {
 	}
 }
 
+func TestDatacenterCacheGatherer(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx    = context.Background()
+		client = fixedResponseClient{code: http.StatusOK, response: datacentersResponseSmall}
+		cache  = api.NewDatacenterCache(client, "irrelevant token")
+	)
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	gatherer, err := cache.Gatherer("fastly", "rt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `
+# HELP fastly_rt_datacenter_info Metadata about Fastly datacenters.
+# TYPE fastly_rt_datacenter_info gauge
+fastly_rt_datacenter_info{datacenter="AMS",group="Europe",latitude="52.308613",longitude="4.763889",name="Amsterdam"} 1
+fastly_rt_datacenter_info{datacenter="WLG",group="Asia/Pacific",latitude="-41.327221",longitude="174.805278",name="Wellington"} 1
+`
+	if err := testutil.GatherAndCompare(gatherer, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
 const datacentersResponseSmall = `
 [
   {
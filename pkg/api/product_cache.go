@@ -0,0 +1,137 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProductCache polls api.fastly.com/enabled-products to determine which of a
+// fixed set of products, e.g. origin_inspector, are enabled for each service.
+// That information is exposed as Prometheus metrics.
+type ProductCache struct {
+	client   HTTPClient
+	token    string
+	products []string
+
+	mtx     sync.Mutex
+	enabled map[string][]string // service ID to enabled products
+}
+
+// NewProductCache returns an empty cache of the enabled products for each
+// service. Only the given products are checked. Use the Refresh method to
+// update the cache.
+func NewProductCache(client HTTPClient, token string, products ...string) *ProductCache {
+	return &ProductCache{
+		client:   client,
+		token:    token,
+		products: products,
+		enabled:  map[string][]string{},
+	}
+}
+
+// Refresh the cache with the enabled products for each of the given services,
+// retrieved from the Fastly API. Services not given are removed from the cache.
+// On error, the cache is unchanged.
+func (c *ProductCache) Refresh(ctx context.Context, serviceIDs []string) error {
+	enabled := make(map[string][]string, len(serviceIDs))
+	for _, serviceID := range serviceIDs {
+		products := []string{}
+		for _, product := range c.products {
+			ok, err := c.isEnabled(ctx, product, serviceID)
+			if err != nil {
+				return err
+			}
+			if ok {
+				products = append(products, product)
+			}
+		}
+		sort.Strings(products)
+		enabled[serviceID] = products
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.enabled = enabled
+
+	return nil
+}
+
+func (c *ProductCache) isEnabled(ctx context.Context, product, serviceID string) (bool, error) {
+	uri := fmt.Sprintf("https://api.fastly.com/enabled-products/v1/%s/services/%s", url.PathEscape(product), url.PathEscape(serviceID))
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return false, fmt.Errorf("error constructing API enabled products request: %w", err)
+	}
+
+	req.Header.Set("Fastly-Key", c.token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("error executing API enabled products request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusBadRequest, http.StatusNotFound: // the API's way of saying "not enabled"
+		return false, nil
+	default:
+		return false, NewError(resp)
+	}
+}
+
+// EnabledProducts returns the currently cached enabled products for the given
+// service, in sorted order.
+func (c *ProductCache) EnabledProducts(serviceID string) []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	products := make([]string, len(c.enabled[serviceID]))
+	copy(products, c.enabled[serviceID])
+	return products
+}
+
+// Gatherer returns a Prometheus gatherer which will yield a gauge metric with
+// value 1 for each enabled product of each service.
+func (c *ProductCache) Gatherer(namespace, subsystem string) (prometheus.Gatherer, error) {
+	var (
+		fqName      = prometheus.BuildFQName(namespace, subsystem, "service_products")
+		help        = "Products enabled for each service."
+		labels      = []string{"service_id", "product"}
+		constLabels = prometheus.Labels{}
+		desc        = prometheus.NewDesc(fqName, help, labels, constLabels)
+		collector   = &productCollector{desc: desc, cache: c}
+	)
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		return nil, fmt.Errorf("registering product collector: %w", err)
+	}
+
+	return registry, nil
+}
+
+type productCollector struct {
+	desc  *prometheus.Desc
+	cache *ProductCache
+}
+
+func (c *productCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *productCollector) Collect(ch chan<- prometheus.Metric) {
+	c.cache.mtx.Lock()
+	defer c.cache.mtx.Unlock()
+	for serviceID, products := range c.cache.enabled {
+		for _, product := range products {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1, serviceID, product)
+		}
+	}
+}
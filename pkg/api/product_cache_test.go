@@ -0,0 +1,72 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/fastly/fastly-exporter/pkg/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProductCache(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx       = context.Background()
+		requested = []string{}
+		enabled   = `{"product":{"id":"x","object":"product"},"service":{"id":"AAA","object":"service"}}`
+		client    = pathResponseClient{
+			responses: map[string]string{
+				"/enabled-products/v1/origin_inspector/services/AAA": enabled,
+				"/enabled-products/v1/websockets/services/AAA":       enabled,
+			},
+			requested: &requested,
+		}
+		cache = api.NewProductCache(client, "irrelevant token", "websockets", "origin_inspector", "image_optimizer")
+	)
+
+	if err := cache.Refresh(ctx, []string{"AAA", "BBB"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := []string{"origin_inspector", "websockets"}, cache.EnabledProducts("AAA"); !cmp.Equal(want, have) {
+		t.Error(cmp.Diff(want, have))
+	}
+	if want, have := []string{}, cache.EnabledProducts("BBB"); !cmp.Equal(want, have) {
+		t.Error(cmp.Diff(want, have))
+	}
+	if want, have := 6, len(requested); want != have {
+		t.Errorf("requests: want %d, have %d", want, have)
+	}
+
+	gatherer, err := cache.Gatherer("fastly", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `
+# HELP fastly_service_products Products enabled for each service.
+# TYPE fastly_service_products gauge
+fastly_service_products{product="origin_inspector",service_id="AAA"} 1
+fastly_service_products{product="websockets",service_id="AAA"} 1
+`
+	if err := testutil.GatherAndCompare(gatherer, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProductCacheError(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx   = context.Background()
+		cache = api.NewProductCache(fixedResponseClient{code: http.StatusUnauthorized}, "bad token", "websockets")
+	)
+
+	if want, have := (&api.Error{Code: http.StatusUnauthorized}), cache.Refresh(ctx, []string{"AAA"}); !cmp.Equal(want, have) {
+		t.Error(cmp.Diff(want, have))
+	}
+}
@@ -3,9 +3,12 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -13,6 +16,7 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/fastly/fastly-exporter/pkg/filter"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // maxServicePageSize is the maximum amount of results that can be requested
@@ -22,9 +26,60 @@ const maxServicePageSize = 1000
 // Service metadata associated with a single service.
 // Also serves as a DTO for api.fastly.com/service.
 type Service struct {
-	ID      string `json:"id"`
-	Name    string `json:"name"`
-	Version int    `json:"version"`
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"` // "vcl" or "wasm"
+	CustomerID string    `json:"customer_id"`
+	Version    int       `json:"version"`
+	Versions   []Version `json:"versions"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// LatestVersion returns the highest-numbered version of the service, which may
+// be newer than the active version if it hasn't been deployed yet.
+func (s Service) LatestVersion() int {
+	latest := s.Version
+	for _, v := range s.Versions {
+		if v.Number > latest {
+			latest = v.Number
+		}
+	}
+	return latest
+}
+
+// activeVersionDeployed returns true if the service's active version is among
+// its versions and is marked as deployed.
+func (s Service) activeVersionDeployed() bool {
+	for _, v := range s.Versions {
+		if v.Number == s.Version {
+			return v.Deployed
+		}
+	}
+	return false
+}
+
+// trimVersions returns a copy of the service which retains only the active and
+// latest versions. Long-lived services can have thousands of versions, and
+// nothing else is used after the service is fetched.
+func (s Service) trimVersions() Service {
+	latest := s.LatestVersion()
+	versions := make([]Version, 0, 2)
+	for _, v := range s.Versions {
+		if v.Number == s.Version || v.Number == latest {
+			versions = append(versions, v)
+		}
+	}
+	s.Versions = versions
+	return s
+}
+
+// Version metadata associated with a single version of a service.
+// Also serves as a DTO for the versions in api.fastly.com/service.
+type Version struct {
+	Number   int    `json:"number"`
+	Active   bool   `json:"active"`
+	Deployed bool   `json:"deployed"`
+	Comment  string `json:"comment"`
 }
 
 // ServiceCache polls api.fastly.com/service to keep metadata about
@@ -33,13 +88,39 @@ type ServiceCache struct {
 	client HTTPClient
 	token  string
 
-	serviceIDs stringSet
-	nameFilter filter.Filter
-	shard      shardSlice
-	logger     log.Logger
+	serviceIDs   stringSet
+	blockedIDs   stringSet
+	customerIDs  stringSet
+	directLookup bool
+	skipMetadata bool
+	nameFilter   filter.Filter
+	minVersion   int
+	maxVersion   int
+	deployedOnly bool
+	shard        shardSlice
+	deadline     time.Duration
+	policy       DeadlinePolicy
+	createdAt    bool
+	onChange     func(added, removed []string)
+	logger       log.Logger
+
+	mtx         sync.RWMutex
+	services    map[string]Service
+	fetched     []Service // every service from the last complete refresh
+	discovered  int
+	responseAge time.Duration
+	changes     map[string]uint64      // service ID: active version changes observed, while cached
+	pages       map[string]servicePage // page URI: last successful response
+	modified    bool
+}
 
-	mtx      sync.RWMutex
-	services map[string]Service
+// servicePage is a page of the service listing, kept along with its cache
+// validators, so the page can be requested conditionally on the next refresh.
+type servicePage struct {
+	etag         string
+	lastModified string
+	services     []Service
+	next         string
 }
 
 // NewServiceCache returns an empty cache of service metadata. By default, it
@@ -68,12 +149,70 @@ func WithExplicitServiceIDs(ids ...string) ServiceCacheOption {
 	return func(c *ServiceCache) { c.serviceIDs = newStringSet(ids) }
 }
 
+// WithBlockedServiceIDs prevents the cache from fetching metadata for the
+// provided service IDs, even if they're allowed by every other option. By
+// default, no service IDs are blocked.
+func WithBlockedServiceIDs(ids ...string) ServiceCacheOption {
+	return func(c *ServiceCache) { c.blockedIDs = newStringSet(ids) }
+}
+
+// WithCustomerIDs restricts the cache to services owned by the provided
+// customer IDs, i.e. Fastly accounts, for tokens that can read services across
+// several accounts. By default, services of any customer ID are allowed.
+func WithCustomerIDs(ids ...string) ServiceCacheOption {
+	return func(c *ServiceCache) { c.customerIDs = newStringSet(ids) }
+}
+
+// WithDirectLookup causes the cache to fetch metadata for each service ID
+// provided via WithExplicitServiceIDs individually, rather than listing all
+// services available to the token. This is useful for tokens that can read
+// specific services but lack permission to list them. It has no effect if no
+// explicit service IDs are provided. By default, services are listed.
+func WithDirectLookup(direct bool) ServiceCacheOption {
+	return func(c *ServiceCache) { c.directLookup = direct }
+}
+
+// WithSkipMetadata causes the cache to use the service IDs provided via
+// WithExplicitServiceIDs as-is, without fetching any metadata from the Fastly
+// API. Every service has an empty name, version 0, and no customer ID, so name
+// filters reject them all unless they permit the empty string, and customer ID
+// filters reject them all. It has no effect if no explicit service IDs are
+// provided. By default, metadata is fetched.
+func WithSkipMetadata(skip bool) ServiceCacheOption {
+	return func(c *ServiceCache) { c.skipMetadata = skip }
+}
+
+// WithCreatedTimestamps causes the cache's gatherer to yield the creation time
+// of each service, for lifecycle dashboards. Services with no known creation
+// time, e.g. when metadata is skipped, are omitted. By default, creation times
+// aren't yielded.
+func WithCreatedTimestamps(enabled bool) ServiceCacheOption {
+	return func(c *ServiceCache) { c.createdAt = enabled }
+}
+
 // WithNameFilter restricts the cache to fetch metadata only for the services
 // whose names pass the provided filter. By default, no name filtering occurs.
 func WithNameFilter(f filter.Filter) ServiceCacheOption {
 	return func(c *ServiceCache) { c.nameFilter = f }
 }
 
+// WithActiveVersionRange restricts the cache to fetch metadata only for those
+// services whose active version is within the inclusive range [min, max], e.g.
+// to monitor a rollout. Zero means the range is unbounded on that side. Services
+// without metadata have version 0, so they're rejected by any nonzero min. By
+// default, no version filtering occurs.
+func WithActiveVersionRange(min, max int) ServiceCacheOption {
+	return func(c *ServiceCache) { c.minVersion, c.maxVersion = min, max }
+}
+
+// WithRequireDeployed restricts the cache to services whose active version is
+// marked as deployed, e.g. for change-freeze monitoring. Services without
+// version metadata, e.g. when metadata is skipped, are rejected. By default,
+// the deployed state is ignored.
+func WithRequireDeployed(require bool) ServiceCacheOption {
+	return func(c *ServiceCache) { c.deployedOnly = require }
+}
+
 // WithShard restricts the cache to fetch metadata only for those services whose
 // IDs, when hashed and taken modulo m, equal (n-1). By default, no sharding
 // occurs.
@@ -85,6 +224,37 @@ func WithShard(n, m uint64) ServiceCacheOption {
 	return func(c *ServiceCache) { c.shard = shardSlice{n, m} }
 }
 
+// DeadlinePolicy determines what a refresh does when it exceeds its deadline.
+type DeadlinePolicy int
+
+const (
+	// DeadlineError aborts the refresh with an error, and leaves the cache
+	// unchanged.
+	DeadlineError DeadlinePolicy = iota
+
+	// DeadlinePartial aborts the refresh, and updates the cache with the
+	// services fetched before the deadline. Previously cached services that
+	// weren't fetched are kept as they were, rather than removed.
+	DeadlinePartial
+)
+
+// WithRefreshDeadline caps the total time taken by each refresh, across all
+// pages of results, at d. A refresh that exceeds the deadline is handled per
+// the policy. By default, there's no overall deadline, and each request is
+// bounded only by the client's timeout.
+func WithRefreshDeadline(d time.Duration, policy DeadlinePolicy) ServiceCacheOption {
+	return func(c *ServiceCache) { c.deadline, c.policy = d, policy }
+}
+
+// WithOnChange sets a function which is called whenever the set of cached
+// service IDs changes, i.e. the IDs that passed every filter, with the IDs that
+// were added and removed, each sorted. It's called after the cache is updated,
+// by Refresh, RefreshService, and SetShard, and may call back into the cache.
+// By default, no function is called.
+func WithOnChange(f func(added, removed []string)) ServiceCacheOption {
+	return func(c *ServiceCache) { c.onChange = f }
+}
+
 // WithLogger sets the logger used by the cache during refresh.
 // By default, no log events are emitted.
 func WithLogger(logger log.Logger) ServiceCacheOption {
@@ -95,77 +265,89 @@ func WithLogger(logger log.Logger) ServiceCacheOption {
 func (c *ServiceCache) Refresh(ctx context.Context) error {
 	begin := time.Now()
 
+	fetchCtx := ctx
+	if c.deadline > 0 {
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithTimeout(ctx, c.deadline)
+		defer cancel()
+	}
+
 	var (
-		uri     = fmt.Sprintf("https://api.fastly.com/service?page=1&per_page=%d", maxServicePageSize)
-		total   = 0
-		nextgen = map[string]Service{}
+		services []Service
+		modified = true
+		err      error
 	)
+	switch {
+	case c.skipMetadata && !c.serviceIDs.empty():
+		services = c.explicitServices()
+	case c.directLookup && !c.serviceIDs.empty():
+		services, err = c.lookupServices(fetchCtx)
+	default:
+		services, modified, err = c.listServices(fetchCtx)
+	}
 
-	for {
-		req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
-		if err != nil {
-			return fmt.Errorf("error constructing API services request: %w", err)
+	var partial bool
+	if err != nil {
+		exceeded := errors.Is(fetchCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil
+		if !exceeded || c.policy != DeadlinePartial {
+			return err
 		}
+		level.Warn(c.logger).Log("during", "refresh", "err", err, "msg", "refresh deadline exceeded, keeping partial results", "fetched_service_count", len(services))
+		partial = true
+	}
 
-		req.Header.Set("Fastly-Key", c.token)
-		req.Header.Set("Accept", "application/json")
-		resp, err := c.client.Do(req)
-		if err != nil {
-			return fmt.Errorf("error executing API services request: %w", err)
+	c.mtx.RLock()
+	shard := c.shard
+	c.mtx.RUnlock()
+
+	nextgen := map[string]Service{}
+	for _, s := range services {
+		debug := level.Debug(log.With(c.logger,
+			"service_id", s.ID,
+			"service_name", s.Name,
+			"service_version", s.Version,
+		))
+
+		if reason := c.rejectReason(s, c.nameFilter, shard); reason != "" {
+			debug.Log("result", "rejected", "reason", reason)
+			continue
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			return NewError(resp)
-		}
+		debug.Log("result", "accepted")
+		nextgen[s.ID] = s
+	}
 
-		var response []Service
-		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-			return fmt.Errorf("error decoding API services response: %w", err)
+	if partial {
+		fetched := make(stringSet, len(services))
+		for _, s := range services {
+			fetched[s.ID] = struct{}{}
 		}
-		total += len(response)
-
-		for _, s := range response {
-			debug := level.Debug(log.With(c.logger,
-				"service_id", s.ID,
-				"service_name", s.Name,
-				"service_version", s.Version,
-			))
-
-			if reject := !c.serviceIDs.empty() && !c.serviceIDs.has(s.ID); reject {
-				debug.Log("result", "rejected", "reason", "service ID not explicitly allowed")
-				continue
-			}
-
-			if reject := !c.nameFilter.Permit(s.Name); reject {
-				debug.Log("result", "rejected", "reason", "service name rejected by name filter")
-				continue
+		c.mtx.RLock()
+		for id, prev := range c.services {
+			if !fetched.has(id) {
+				nextgen[id] = prev
 			}
-
-			if reject := !c.shard.match(s.ID); reject {
-				debug.Log("result", "rejected", "reason", "service ID in different shard")
-				continue
-			}
-
-			debug.Log("result", "accepted")
-			nextgen[s.ID] = s
 		}
-
-		next, err := GetNextLink(resp)
-		if err != nil {
-			break
-		}
-
-		uri = next.String()
+		c.mtx.RUnlock()
 	}
 
 	level.Debug(c.logger).Log(
 		"refresh_took", time.Since(begin),
-		"total_service_count", total,
+		"total_service_count", len(services),
 		"accepted_service_count", len(nextgen),
+		"modified", modified,
 	)
 
 	c.mtx.Lock()
+	if c.shard != shard {
+		// SetShard was called during the refresh, so drop any services it
+		// moved out of the shard, rather than adding them back.
+		for id := range nextgen {
+			if !c.shard.match(id) {
+				delete(nextgen, id)
+			}
+		}
+	}
 	for id, next := range nextgen {
 		_, ok := c.services[id]
 		if created := !ok; created {
@@ -182,14 +364,358 @@ func (c *ServiceCache) Refresh(ctx context.Context) error {
 		}
 		if updated := ok && prev.Version != next.Version; updated {
 			level.Info(c.logger).Log("service", "updated", "service_id", id, "from", prev.Version, "to", next.Version)
+			c.countVersionChangeWithLock(id)
 		}
 	}
+	added, removed := diffServiceIDs(c.services, nextgen)
+	for _, id := range removed {
+		delete(c.changes, id)
+	}
 	c.services = nextgen
+	c.modified = modified
+	if !partial {
+		c.discovered = len(services)
+		c.fetched = services
+	}
+	c.mtx.Unlock()
+
+	c.notifyChange(added, removed)
+	return nil
+}
+
+// diffServiceIDs returns the IDs of the services in next but not prev, and in
+// prev but not next, each sorted.
+func diffServiceIDs(prev, next map[string]Service) (added, removed []string) {
+	for id := range next {
+		if _, ok := prev[id]; !ok {
+			added = append(added, id)
+		}
+	}
+	for id := range prev {
+		if _, ok := next[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// notifyChange calls the OnChange function, if any, if any service IDs were
+// added or removed.
+func (c *ServiceCache) notifyChange(added, removed []string) {
+	if c.onChange != nil && (len(added) > 0 || len(removed) > 0) {
+		c.onChange(added, removed)
+	}
+}
+
+// countVersionChangeWithLock records a change of the active version of the
+// service, for the version changes counter.
+func (c *ServiceCache) countVersionChangeWithLock(id string) {
+	if c.changes == nil {
+		c.changes = map[string]uint64{}
+	}
+	c.changes[id]++
+}
+
+// SetShard changes the shard of services managed by the cache, as WithShard,
+// at runtime. Cached services that no longer belong to the shard are removed
+// immediately, including by a refresh that's already in flight. Services that
+// newly belong to the shard aren't added until the next refresh, so callers
+// should refresh after resharding. So, when several exporters are resharded, a
+// service moving between them goes briefly unmonitored, rather than being
+// monitored twice.
+func (c *ServiceCache) SetShard(n, m uint64) {
+	c.mtx.Lock()
+	var removed []string
+	c.shard = shardSlice{n, m}
+	for id, prev := range c.services {
+		if !c.shard.match(id) {
+			level.Info(c.logger).Log("service", "removed", "service_id", id, "name", prev.Name, "version", prev.Version, "reason", "service ID in different shard")
+			delete(c.services, id)
+			delete(c.changes, id)
+			removed = append(removed, id)
+		}
+	}
+	c.mtx.Unlock()
+
+	sort.Strings(removed)
+	c.notifyChange(nil, removed)
+}
+
+// listServices fetches every service available to the token from the paginated
+// api.fastly.com/service endpoint. Each page is requested conditionally, with
+// the validators of the last successful response for the same page, and a 304
+// Not Modified response reuses that response. It reports whether any page was
+// modified. On error, the services fetched from earlier pages are returned
+// along with the error.
+func (c *ServiceCache) listServices(ctx context.Context) ([]Service, bool, error) {
+	c.mtx.RLock()
+	prev := c.pages
+	c.mtx.RUnlock()
+
+	var (
+		uri      = fmt.Sprintf("https://api.fastly.com/service?page=1&per_page=%d", maxServicePageSize)
+		services []Service
+		age      time.Duration
+		pages    = map[string]servicePage{}
+		modified = len(prev) == 0
+	)
+
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+		if err != nil {
+			return services, true, fmt.Errorf("error constructing API services request: %w", err)
+		}
+
+		cached, ok := prev[uri]
+		req.Header.Set("Fastly-Key", c.token)
+		req.Header.Set("Accept", "application/json")
+		if ok && cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if ok && cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return services, true, fmt.Errorf("error executing API services request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		var page servicePage
+		switch {
+		case resp.StatusCode == http.StatusNotModified && ok:
+			page = cached
+
+		case resp.StatusCode == http.StatusOK:
+			var response []Service
+			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				return services, true, fmt.Errorf("error decoding API services response: %w", err)
+			}
+			page.etag = resp.Header.Get("ETag")
+			page.lastModified = resp.Header.Get("Last-Modified")
+			for _, s := range response {
+				page.services = append(page.services, s.trimVersions())
+			}
+			if next, err := GetNextLink(resp); err == nil {
+				page.next = next.String()
+			}
+			modified = true
+
+		default:
+			return services, true, NewError(resp)
+		}
+		services = append(services, page.services...)
+		pages[uri] = page
+
+		// A caching proxy between us and the API reports how long it's held
+		// the response via the Age header. Track the stalest page.
+		if seconds, err := strconv.ParseUint(resp.Header.Get("Age"), 10, 64); err == nil {
+			if pageAge := time.Duration(seconds) * time.Second; pageAge > age {
+				age = pageAge
+			}
+		}
+
+		if page.next == "" {
+			break
+		}
+
+		uri = page.next
+	}
+
+	if len(pages) != len(prev) {
+		modified = true // the listing lost pages
+	}
+
+	c.mtx.Lock()
+	c.responseAge = age
+	c.pages = pages
+	c.mtx.Unlock()
+
+	return services, modified, nil
+}
+
+// explicitServices returns each explicitly allowed service, with no metadata.
+func (c *ServiceCache) explicitServices() []Service {
+	services := make([]Service, 0, len(c.serviceIDs))
+	for _, id := range c.explicitIDs() {
+		services = append(services, Service{ID: id})
+	}
+	return services
+}
+
+// lookupServices fetches each explicitly allowed service individually from
+// api.fastly.com/service/{id}, without listing all services. On error, the
+// services fetched so far are returned along with the error.
+func (c *ServiceCache) lookupServices(ctx context.Context) ([]Service, error) {
+	ids := c.explicitIDs()
+	services := make([]Service, 0, len(ids))
+	for _, id := range ids {
+		s, err := c.lookupService(ctx, id)
+		if err != nil {
+			return services, err
+		}
+		services = append(services, s)
+	}
+
+	return services, nil
+}
+
+// explicitIDs returns the explicitly allowed service IDs which aren't blocked,
+// in sorted order.
+func (c *ServiceCache) explicitIDs() []string {
+	ids := make([]string, 0, len(c.serviceIDs))
+	for id := range c.serviceIDs {
+		if !c.blockedIDs.has(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (c *ServiceCache) lookupService(ctx context.Context, id string) (Service, error) {
+	uri := fmt.Sprintf("https://api.fastly.com/service/%s", url.PathEscape(id))
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return Service{}, fmt.Errorf("error constructing API service request: %w", err)
+	}
+
+	req.Header.Set("Fastly-Key", c.token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return Service{}, fmt.Errorf("error executing API service request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Service{}, NewError(resp)
+	}
+
+	var s Service
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return Service{}, fmt.Errorf("error decoding API service response: %w", err)
+	}
+
+	// The single-service endpoint reports the active version only via the
+	// versions list, not as a top-level field.
+	if s.Version == 0 {
+		for _, v := range s.Versions {
+			if v.Active {
+				s.Version = v.Number
+			}
+		}
+	}
+
+	return s.trimVersions(), nil
+}
+
+// ErrServiceRejected is wrapped by the error returned by RefreshService when
+// the service is rejected by any of the options restricting the cache.
+var ErrServiceRejected = errors.New("rejected")
+
+// RefreshService fetches the metadata of a single service from the Fastly API,
+// and adds it to the cache, or updates it if it's already cached, without
+// listing every service. It returns an error if the API doesn't return the
+// service, e.g. because it doesn't exist or the token can't access it, which is
+// an *Error if the API responded, or if the service is rejected by any of the
+// options restricting the cache, which wraps ErrServiceRejected. The next full
+// refresh applies as usual.
+func (c *ServiceCache) RefreshService(ctx context.Context, id string) error {
+	s, err := c.lookupService(ctx, id)
+	if err != nil {
+		return err
+	}
+	if s.ID == "" {
+		s.ID = id
+	}
+
+	c.mtx.Lock()
+	if reason := c.rejectReason(s, c.nameFilter, c.shard); reason != "" {
+		c.mtx.Unlock()
+		return fmt.Errorf("service %s %w: %s", id, ErrServiceRejected, reason)
+	}
+
+	prev, ok := c.services[id]
+	switch {
+	case !ok:
+		level.Info(c.logger).Log("service", "found", "service_id", id, "name", s.Name, "version", s.Version)
+	case prev.Name != s.Name:
+		level.Info(c.logger).Log("service", "renamed", "service_id", id, "from", prev.Name, "to", s.Name)
+	case prev.Version != s.Version:
+		level.Info(c.logger).Log("service", "updated", "service_id", id, "from", prev.Version, "to", s.Version)
+	}
+	if ok && prev.Version != s.Version {
+		c.countVersionChangeWithLock(id)
+	}
+
+	if c.services == nil {
+		c.services = map[string]Service{}
+	}
+	c.services[id] = s
 	c.mtx.Unlock()
 
+	if !ok {
+		c.notifyChange([]string{id}, nil)
+	}
 	return nil
 }
 
+// rejectReason returns why the service should be left out of the cache, with
+// the given name filter and shard, or an empty string if it should be kept.
+func (c *ServiceCache) rejectReason(s Service, names filter.Filter, shard shardSlice) string {
+	switch {
+	case !c.serviceIDs.empty() && !c.serviceIDs.has(s.ID):
+		return "service ID not explicitly allowed"
+	case !names.Permit(s.Name):
+		return "service name rejected by name filter"
+	case c.minVersion > 0 && s.Version < c.minVersion:
+		return "active version below minimum"
+	case c.maxVersion > 0 && s.Version > c.maxVersion:
+		return "active version above maximum"
+	case c.deployedOnly && !s.activeVersionDeployed():
+		return "active version not deployed"
+	case !shard.match(s.ID):
+		return "service ID in different shard"
+	case c.blockedIDs.has(s.ID):
+		return "service ID explicitly blocked"
+	case !c.customerIDs.empty() && !c.customerIDs.has(s.CustomerID):
+		return "customer ID not allowed"
+	default:
+		return ""
+	}
+}
+
+// TryNameFilter returns the services from the last complete refresh which
+// would be cached if the given name filter replaced the configured one, sorted
+// by ID. Every other restriction still applies. The cache itself is unchanged,
+// so this is useful to preview a filter change against the live services.
+func (c *ServiceCache) TryNameFilter(f filter.Filter) []Service {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	selected := []Service{}
+	for _, s := range c.fetched {
+		if c.rejectReason(s, f, c.shard) == "" {
+			selected = append(selected, s)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].ID < selected[j].ID })
+	return selected
+}
+
+// LastRefreshModified reports whether the last refresh fetched any changed
+// data. It's false if every page of the service listing was Not Modified, i.e.
+// the refresh reused the responses of the previous one. It's always true for
+// refreshes which don't list services.
+func (c *ServiceCache) LastRefreshModified() bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.modified
+}
+
 // ServiceIDs currently being monitored by the cache.
 // The set can change over time.
 func (c *ServiceCache) ServiceIDs() (ids []string) {
@@ -216,6 +742,142 @@ func (c *ServiceCache) Metadata(id string) (name string, version int, found bool
 	return name, version, found
 }
 
+// ServiceType returns the type of the given service ID, i.e. "vcl" or "wasm".
+// If the cache doesn't contain that service ID, found will be false.
+func (c *ServiceCache) ServiceType(id string) (serviceType string, found bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	s, ok := c.services[id]
+	return s.Type, ok
+}
+
+// CustomerID returns the customer ID, i.e. the Fastly account, of the given
+// service ID. If the cache doesn't contain that service ID, found will be false.
+func (c *ServiceCache) CustomerID(id string) (customerID string, found bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	s, ok := c.services[id]
+	return s.CustomerID, ok
+}
+
+// Versions returns the versions retained for the given service ID, which are
+// only the active and latest versions, in the order returned by the Fastly
+// API. If the cache doesn't contain that service ID, found will be false.
+func (c *ServiceCache) Versions(id string) (versions []Version, found bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	s, ok := c.services[id]
+	if !ok {
+		return nil, false
+	}
+
+	versions = make([]Version, len(s.Versions))
+	copy(versions, s.Versions)
+	return versions, true
+}
+
+// VersionComment returns the comment of the active version of the given
+// service ID. If the cache doesn't contain that service ID, or the active
+// version isn't known, found will be false.
+func (c *ServiceCache) VersionComment(id string) (comment string, found bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	s, ok := c.services[id]
+	if !ok {
+		return "", false
+	}
+
+	for _, v := range s.Versions {
+		if v.Number == s.Version {
+			return v.Comment, true
+		}
+	}
+
+	return "", false
+}
+
+// Gatherer returns a Prometheus gatherer which will yield the number of
+// services discovered by the most recent refresh, and the number of those
+// services which are monitored after filtering and sharding. It also yields the
+// active and latest version of each monitored service; a latest version greater
+// than the active version means a new version hasn't been deployed yet. If
+// enabled, it also yields the creation time of each monitored service. Finally,
+// it yields the Age of the most recent service listing, which is nonzero when a
+// caching proxy served it.
+func (c *ServiceCache) Gatherer(namespace, subsystem string) (prometheus.Gatherer, error) {
+	collector := &serviceCollector{
+		discovered:    prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "services_discovered"), "Number of services returned by the Fastly API on the last refresh.", nil, nil),
+		monitored:     prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "services_monitored"), "Number of services monitored after filtering and sharding.", nil, nil),
+		activeVersion: prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "service_active_version"), "Active version of each service.", []string{"service_id", "service_name"}, nil),
+		latestVersion: prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "service_latest_version"), "Latest, i.e. highest-numbered, version of each service, whether active or not.", []string{"service_id", "service_name"}, nil),
+		createdAt:     prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "service_created_timestamp"), "Unix timestamp of the creation of each service.", []string{"service_id", "service_name"}, nil),
+		changes:       prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "service_version_changes_total"), "Number of changes of the active version of each service observed across refreshes, i.e. deploys and rollbacks.", []string{"service_id", "service_name"}, nil),
+		responseAge:   prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "api_response_age_seconds"), "Age header of the most recent service listing from the Fastly API, i.e. how long a caching proxy held it, or 0 if it was fresh. The largest across pages.", nil, nil),
+		cache:         c,
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		return nil, fmt.Errorf("registering service collector: %w", err)
+	}
+
+	return registry, nil
+}
+
+type serviceCollector struct {
+	discovered    *prometheus.Desc
+	monitored     *prometheus.Desc
+	activeVersion *prometheus.Desc
+	latestVersion *prometheus.Desc
+	createdAt     *prometheus.Desc
+	changes       *prometheus.Desc
+	responseAge   *prometheus.Desc
+	cache         *ServiceCache
+}
+
+func (c *serviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.discovered
+	ch <- c.monitored
+	ch <- c.activeVersion
+	ch <- c.latestVersion
+	ch <- c.createdAt
+	ch <- c.changes
+	ch <- c.responseAge
+}
+
+func (c *serviceCollector) Collect(ch chan<- prometheus.Metric) {
+	c.cache.mtx.RLock()
+	var (
+		discovered = float64(c.cache.discovered)
+		monitored  = float64(len(c.cache.services))
+		services   = make([]Service, 0, len(c.cache.services))
+		changes    = make(map[string]uint64, len(c.cache.services))
+		createdAt  = c.cache.createdAt
+		age        = c.cache.responseAge.Seconds()
+	)
+	for _, s := range c.cache.services {
+		services = append(services, s)
+		changes[s.ID] = c.cache.changes[s.ID]
+	}
+	c.cache.mtx.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(c.discovered, prometheus.GaugeValue, discovered)
+	ch <- prometheus.MustNewConstMetric(c.monitored, prometheus.GaugeValue, monitored)
+	ch <- prometheus.MustNewConstMetric(c.responseAge, prometheus.GaugeValue, age)
+	for _, s := range services {
+		ch <- prometheus.MustNewConstMetric(c.activeVersion, prometheus.GaugeValue, float64(s.Version), s.ID, s.Name)
+		ch <- prometheus.MustNewConstMetric(c.latestVersion, prometheus.GaugeValue, float64(s.LatestVersion()), s.ID, s.Name)
+		ch <- prometheus.MustNewConstMetric(c.changes, prometheus.CounterValue, float64(changes[s.ID]), s.ID, s.Name)
+		if createdAt && !s.CreatedAt.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.createdAt, prometheus.GaugeValue, float64(s.CreatedAt.Unix()), s.ID, s.Name)
+		}
+	}
+}
+
 //
 //
 //
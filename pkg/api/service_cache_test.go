@@ -2,11 +2,19 @@ package api_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/go-kit/log"
 	"github.com/google/go-cmp/cmp"
 	"github.com/fastly/fastly-exporter/pkg/api"
 	"github.com/fastly/fastly-exporter/pkg/filter"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestServiceCache(t *testing.T) {
@@ -117,6 +125,26 @@ func TestServiceCache(t *testing.T) {
 			options: []api.ServiceCacheOption{api.WithShard(2, 3), api.WithExplicitServiceIDs(s1.ID)},
 			want:    []api.Service{},
 		},
+		{
+			name:    "blocklist one",
+			options: []api.ServiceCacheOption{api.WithBlockedServiceIDs(s1.ID)},
+			want:    []api.Service{s2},
+		},
+		{
+			name:    "blocklist none",
+			options: []api.ServiceCacheOption{api.WithBlockedServiceIDs("nonexistant service ID")},
+			want:    []api.Service{s1, s2},
+		},
+		{
+			name:    "allowlist both blocklist one",
+			options: []api.ServiceCacheOption{api.WithExplicitServiceIDs(s1.ID, s2.ID), api.WithBlockedServiceIDs(s2.ID)},
+			want:    []api.Service{s1},
+		},
+		{
+			name:    "name include match blocklist same",
+			options: []api.ServiceCacheOption{api.WithNameFilter(filterAllowlist(`mmy`)), api.WithBlockedServiceIDs(s2.ID)},
+			want:    []api.Service{},
+		},
 	} {
 		t.Run(testcase.name, func(t *testing.T) {
 			var (
@@ -144,6 +172,162 @@ func TestServiceCache(t *testing.T) {
 	}
 }
 
+func TestServiceCacheCustomerIDs(t *testing.T) {
+	t.Parallel()
+
+	var (
+		s1 = api.Service{ID: "AbcDef123ghiJKlmnOPsq", Name: "My first service", Version: 5}
+		s2 = api.Service{ID: "XXXXXXXXXXXXXXXXXXXXXX", Name: "Dummy service", Version: 1}
+	)
+
+	for _, testcase := range []struct {
+		name    string
+		options []api.ServiceCacheOption
+		want    []api.Service
+	}{
+		{
+			name:    "customer ID one",
+			options: []api.ServiceCacheOption{api.WithCustomerIDs("1a2a3a4azzzzzzzzzzzzzz")},
+			want:    []api.Service{s1},
+		},
+		{
+			name:    "customer ID both",
+			options: []api.ServiceCacheOption{api.WithCustomerIDs("1a2a3a4azzzzzzzzzzzzzz", "5b6b7b8bzzzzzzzzzzzzzz")},
+			want:    []api.Service{s1, s2},
+		},
+		{
+			name:    "customer ID none",
+			options: []api.ServiceCacheOption{api.WithCustomerIDs("nonexistant customer ID")},
+			want:    []api.Service{},
+		},
+		{
+			name:    "shard and customer ID passing",
+			options: []api.ServiceCacheOption{api.WithShard(1, 3), api.WithCustomerIDs("1a2a3a4azzzzzzzzzzzzzz")},
+			want:    []api.Service{s1},
+		},
+		{
+			name:    "shard and customer ID failing",
+			options: []api.ServiceCacheOption{api.WithShard(2, 3), api.WithCustomerIDs("1a2a3a4azzzzzzzzzzzzzz")},
+			want:    []api.Service{},
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			var (
+				ctx    = context.Background()
+				client = fixedResponseClient{code: 200, response: serviceResponseCustomers}
+				cache  = api.NewServiceCache(client, "irrelevant_token", testcase.options...)
+			)
+			if err := cache.Refresh(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				serviceIDs = cache.ServiceIDs()
+				services   = make([]api.Service, len(serviceIDs))
+			)
+			for i, id := range serviceIDs {
+				name, version, _ := cache.Metadata(id)
+				services[i] = api.Service{ID: id, Name: name, Version: version}
+			}
+
+			if want, have := testcase.want, services; !cmp.Equal(want, have) {
+				t.Fatal(cmp.Diff(want, have))
+			}
+		})
+	}
+}
+
+func TestServiceCacheCustomerID(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx    = context.Background()
+		client = fixedResponseClient{code: 200, response: serviceResponseCustomers}
+		cache  = api.NewServiceCache(client, "irrelevant_token")
+	)
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[string]string{
+		"AbcDef123ghiJKlmnOPsq":  "1a2a3a4azzzzzzzzzzzzzz",
+		"XXXXXXXXXXXXXXXXXXXXXX": "5b6b7b8bzzzzzzzzzzzzzz",
+	} {
+		if have, found := cache.CustomerID(id); !found || want != have {
+			t.Errorf("%s: want %q, have %q (found %v)", id, want, have, found)
+		}
+	}
+	if _, found := cache.CustomerID("nonexistant service ID"); found {
+		t.Errorf("nonexistant service ID: found")
+	}
+}
+
+func TestServiceCacheActiveVersionRange(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		name     string
+		min, max int
+		want     []string
+	}{
+		{"unbounded", 0, 0, []string{"AbcDef123ghiJKlmnOPsq", "XXXXXXXXXXXXXXXXXXXXXX"}},
+		{"min at active", 5, 0, []string{"AbcDef123ghiJKlmnOPsq"}},
+		{"min above active", 6, 0, []string{}},
+		{"max at active", 0, 5, []string{"AbcDef123ghiJKlmnOPsq", "XXXXXXXXXXXXXXXXXXXXXX"}},
+		{"max below active", 0, 4, []string{"XXXXXXXXXXXXXXXXXXXXXX"}},
+		{"min and max", 2, 5, []string{"AbcDef123ghiJKlmnOPsq"}},
+	} {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				ctx    = context.Background()
+				client = fixedResponseClient{code: 200, response: serviceResponseLarge}
+				cache  = api.NewServiceCache(client, "irrelevant_token", api.WithActiveVersionRange(testcase.min, testcase.max))
+			)
+			if err := cache.Refresh(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if want, have := testcase.want, cache.ServiceIDs(); !cmp.Equal(want, have) {
+				t.Error(cmp.Diff(want, have))
+			}
+		})
+	}
+}
+
+func TestServiceCacheRequireDeployed(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		name    string
+		require bool
+		want    []string
+	}{
+		{"not required", false, []string{"AAA", "BBB"}},
+		{"required", true, []string{"AAA"}},
+	} {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				ctx    = context.Background()
+				client = fixedResponseClient{code: 200, response: serviceResponseDeployed}
+				cache  = api.NewServiceCache(client, "irrelevant_token", api.WithRequireDeployed(testcase.require))
+			)
+			if err := cache.Refresh(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if want, have := testcase.want, cache.ServiceIDs(); !cmp.Equal(want, have) {
+				t.Error(cmp.Diff(want, have))
+			}
+		})
+	}
+}
+
 func TestServiceCachePagination(t *testing.T) {
 	t.Parallel()
 
@@ -182,6 +366,501 @@ func TestServiceCachePagination(t *testing.T) {
 	}
 }
 
+func TestServiceCacheConditionalRefresh(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx    = context.Background()
+		client = &etagResponseClient{responses: []string{
+			`[{"id":"AAA","name":"Foo","version":1},{"id":"BBB","name":"Bar","version":1}]`,
+			`[{"id":"CCC","name":"Baz","version":1}]`,
+		}}
+		cache = api.NewServiceCache(client, "irrelevant_token")
+	)
+
+	for i, testcase := range []struct {
+		name        string
+		change      func()
+		modified    bool
+		notModified int32
+		ids         []string
+	}{
+		{"initial", func() {}, true, 0, []string{"AAA", "BBB", "CCC"}},
+		{"unchanged", func() {}, false, 2, []string{"AAA", "BBB", "CCC"}},
+		{"last page changed", func() { client.responses[1] = `[{"id":"DDD","name":"Qux","version":1}]` }, true, 3, []string{"AAA", "BBB", "DDD"}},
+		{"unchanged again", func() {}, false, 5, []string{"AAA", "BBB", "DDD"}},
+	} {
+		testcase.change()
+		if err := cache.Refresh(ctx); err != nil {
+			t.Fatalf("%d %s: %v", i, testcase.name, err)
+		}
+		if want, have := testcase.modified, cache.LastRefreshModified(); want != have {
+			t.Errorf("%d %s: modified: want %v, have %v", i, testcase.name, want, have)
+		}
+		if want, have := testcase.notModified, atomic.LoadInt32(&client.notModified); want != have {
+			t.Errorf("%d %s: not modified responses: want %d, have %d", i, testcase.name, want, have)
+		}
+		if want, have := testcase.ids, cache.ServiceIDs(); !cmp.Equal(want, have) {
+			t.Errorf("%d %s: %s", i, testcase.name, cmp.Diff(want, have))
+		}
+	}
+}
+
+func TestServiceCacheVersionComment(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx      = context.Background()
+		response = `[{"id": "AAA", "name": "Service", "version": 2, "versions": [
+			{"number": 1, "active": false, "comment": "first"},
+			{"number": 2, "active": true, "comment": "release-1.2"},
+			{"number": 3, "active": false, "comment": ""}
+		]}]`
+		client = fixedResponseClient{code: 200, response: response}
+		cache  = api.NewServiceCache(client, "irrelevant_token")
+	)
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	comment, found := cache.VersionComment("AAA")
+	if want, have := true, found; want != have {
+		t.Fatalf("found: want %v, have %v", want, have)
+	}
+	if want, have := "release-1.2", comment; want != have {
+		t.Errorf("comment: want %q, have %q", want, have)
+	}
+
+	if _, found := cache.VersionComment("BBB"); found {
+		t.Errorf("unknown service: want not found")
+	}
+}
+
+func TestServiceCacheTrimVersions(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx    = context.Background()
+		client = fixedResponseClient{code: 200, response: serviceResponseLarge}
+		cache  = api.NewServiceCache(client, "irrelevant_token")
+	)
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	name, version, found := cache.Metadata("AbcDef123ghiJKlmnOPsq")
+	if want, have := true, found; want != have {
+		t.Fatalf("found: want %v, have %v", want, have)
+	}
+	if want, have := "My first service", name; want != have {
+		t.Errorf("name: want %q, have %q", want, have)
+	}
+	if want, have := 5, version; want != have {
+		t.Errorf("version: want %d, have %d", want, have)
+	}
+
+	versions, _ := cache.Versions("AbcDef123ghiJKlmnOPsq")
+	numbers := make([]int, len(versions))
+	for i, v := range versions {
+		numbers[i] = v.Number
+	}
+	if want, have := []int{5, 6}, numbers; !cmp.Equal(want, have) {
+		t.Errorf("retained versions: %s", cmp.Diff(want, have))
+	}
+}
+
+func TestServiceCacheDirectLookup(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx       = context.Background()
+		requested = []string{}
+		client    = pathResponseClient{
+			responses: map[string]string{
+				"/service/AAA": `{"id": "AAA", "name": "Service One", "versions": [{"number": 1, "active": false}, {"number": 3, "active": true}]}`,
+				"/service/BBB": `{"id": "BBB", "name": "Service Two", "versions": [{"number": 5, "active": true}]}`,
+			},
+			requested: &requested,
+		}
+		cache = api.NewServiceCache(client, "irrelevant_token", api.WithExplicitServiceIDs("BBB", "AAA"), api.WithDirectLookup(true))
+	)
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := []string{"AAA", "BBB"}, cache.ServiceIDs(); !cmp.Equal(want, have) {
+		t.Fatal(cmp.Diff(want, have))
+	}
+
+	if want, have := []string{"/service/AAA", "/service/BBB"}, requested; !cmp.Equal(want, have) {
+		t.Errorf("requested paths: %s", cmp.Diff(want, have))
+	}
+
+	name, version, found := cache.Metadata("AAA")
+	if want, have := true, found; want != have {
+		t.Fatalf("found: want %v, have %v", want, have)
+	}
+	if want, have := "Service One", name; want != have {
+		t.Errorf("name: want %q, have %q", want, have)
+	}
+	if want, have := 3, version; want != have {
+		t.Errorf("version: want %d, have %d", want, have)
+	}
+}
+
+func TestServiceCacheRefreshService(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx       = context.Background()
+		requested = []string{}
+		client    = pathResponseClient{
+			responses: map[string]string{
+				"/service":     `[{"id": "AAA", "name": "Service One", "version": 3}]`,
+				"/service/BBB": `{"id": "BBB", "name": "Service Two", "versions": [{"number": 5, "active": true}]}`,
+				"/service/CCC": `{"id": "CCC", "name": "Blocked Service", "versions": [{"number": 1, "active": true}]}`,
+			},
+			requested: &requested,
+		}
+		cache = api.NewServiceCache(client, "irrelevant_token", api.WithNameFilter(filterBlocklist(`^Blocked`)))
+	)
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("add", func(t *testing.T) {
+		requested = requested[:0]
+		if err := cache.RefreshService(ctx, "BBB"); err != nil {
+			t.Fatal(err)
+		}
+		if want, have := []string{"AAA", "BBB"}, cache.ServiceIDs(); !cmp.Equal(want, have) {
+			t.Fatal(cmp.Diff(want, have))
+		}
+		if want, have := []string{"/service/BBB"}, requested; !cmp.Equal(want, have) {
+			t.Errorf("requested paths: %s", cmp.Diff(want, have))
+		}
+		if name, version, _ := cache.Metadata("BBB"); name != "Service Two" || version != 5 {
+			t.Errorf("metadata: want Service Two version 5, have %s version %d", name, version)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if err := cache.RefreshService(ctx, "ZZZ"); err == nil {
+			t.Error("want error, have none")
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		if err := cache.RefreshService(ctx, "CCC"); err == nil {
+			t.Error("want error, have none")
+		}
+		if want, have := []string{"AAA", "BBB"}, cache.ServiceIDs(); !cmp.Equal(want, have) {
+			t.Error(cmp.Diff(want, have))
+		}
+	})
+}
+
+func TestServiceCacheSkipMetadata(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx       = context.Background()
+		requested = []string{}
+		client    = pathResponseClient{responses: map[string]string{}, requested: &requested}
+		cache     = api.NewServiceCache(client, "irrelevant_token", api.WithExplicitServiceIDs("BBB", "AAA", "CCC"), api.WithBlockedServiceIDs("CCC"), api.WithSkipMetadata(true))
+	)
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := []string{"AAA", "BBB"}, cache.ServiceIDs(); !cmp.Equal(want, have) {
+		t.Fatal(cmp.Diff(want, have))
+	}
+
+	if want, have := []string{}, requested; !cmp.Equal(want, have) {
+		t.Errorf("requested paths: %s", cmp.Diff(want, have))
+	}
+
+	name, version, found := cache.Metadata("AAA")
+	if want, have := true, found; want != have {
+		t.Fatalf("found: want %v, have %v", want, have)
+	}
+	if want, have := "", name; want != have {
+		t.Errorf("name: want %q, have %q", want, have)
+	}
+	if want, have := 0, version; want != have {
+		t.Errorf("version: want %d, have %d", want, have)
+	}
+}
+
+func TestServiceCacheRefreshDeadline(t *testing.T) {
+	t.Parallel()
+
+	responses := make([]string, 20)
+	for i := range responses {
+		responses[i] = fmt.Sprintf(`[{"id":"S%02d","name":"Service %d","version":1}]`, i, i)
+	}
+
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx      = context.Background()
+			requests = int32(0)
+			client   = slowResponseClient{client: paginatedResponseClient{responses}, delay: 20 * time.Millisecond, requests: &requests}
+			cache    = api.NewServiceCache(client, "irrelevant token", api.WithRefreshDeadline(100*time.Millisecond, api.DeadlineError))
+			begin    = time.Now()
+		)
+
+		err := cache.Refresh(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("want deadline exceeded, have %v", err)
+		}
+		if took := time.Since(begin); took > time.Second {
+			t.Errorf("refresh took %s, which is well past the deadline", took)
+		}
+		if n := atomic.LoadInt32(&requests); n >= int32(len(responses)) {
+			t.Errorf("want fewer than %d requests, have %d", len(responses), n)
+		}
+		if ids := cache.ServiceIDs(); len(ids) != 0 {
+			t.Errorf("want no services, have %v", ids)
+		}
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx      = context.Background()
+			requests = int32(0)
+			client   = slowResponseClient{client: paginatedResponseClient{responses}, delay: 20 * time.Millisecond, requests: &requests}
+			cache    = api.NewServiceCache(client, "irrelevant token", api.WithRefreshDeadline(100*time.Millisecond, api.DeadlinePartial))
+		)
+
+		if err := cache.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+		first := cache.ServiceIDs()
+		if len(first) == 0 || len(first) >= len(responses) {
+			t.Fatalf("want some but not all services, have %v", first)
+		}
+
+		// A second partial refresh keeps the services it didn't get to.
+		if err := cache.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+		second := setOf(cache.ServiceIDs())
+		for _, id := range first {
+			if !second[id] {
+				t.Errorf("service %s was dropped by a partial refresh", id)
+			}
+		}
+	})
+}
+
+func setOf(ss []string) map[string]bool {
+	m := make(map[string]bool, len(ss))
+	for _, s := range ss {
+		m[s] = true
+	}
+	return m
+}
+
+func TestServiceCacheGatherer(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx    = context.Background()
+		client = fixedResponseClient{code: 200, response: serviceResponseLarge}
+		cache  = api.NewServiceCache(client, "irrelevant_token", api.WithNameFilter(filterAllowlist("first")))
+	)
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	gatherer, err := cache.Gatherer("fastly", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `
+# HELP fastly_services_discovered Number of services returned by the Fastly API on the last refresh.
+# TYPE fastly_services_discovered gauge
+fastly_services_discovered 2
+# HELP fastly_services_monitored Number of services monitored after filtering and sharding.
+# TYPE fastly_services_monitored gauge
+fastly_services_monitored 1
+# HELP fastly_api_response_age_seconds Age header of the most recent service listing from the Fastly API, i.e. how long a caching proxy held it, or 0 if it was fresh. The largest across pages.
+# TYPE fastly_api_response_age_seconds gauge
+fastly_api_response_age_seconds 0
+# HELP fastly_service_active_version Active version of each service.
+# TYPE fastly_service_active_version gauge
+fastly_service_active_version{service_id="AbcDef123ghiJKlmnOPsq",service_name="My first service"} 5
+# HELP fastly_service_latest_version Latest, i.e. highest-numbered, version of each service, whether active or not.
+# TYPE fastly_service_latest_version gauge
+fastly_service_latest_version{service_id="AbcDef123ghiJKlmnOPsq",service_name="My first service"} 6
+# HELP fastly_service_version_changes_total Number of changes of the active version of each service observed across refreshes, i.e. deploys and rollbacks.
+# TYPE fastly_service_version_changes_total counter
+fastly_service_version_changes_total{service_id="AbcDef123ghiJKlmnOPsq",service_name="My first service"} 0
+`
+	if err := testutil.GatherAndCompare(gatherer, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceCacheVersionChanges(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx    = context.Background()
+		client = &sequenceResponseClient{responses: []string{
+			`[{"id":"AAA","name":"Foo","version":1},{"id":"BBB","name":"Bar","version":1}]`,
+			`[{"id":"AAA","name":"Foo","version":2},{"id":"BBB","name":"Bar","version":2}]`,
+			`[{"id":"AAA","name":"Foo","version":2}]`,
+			`[{"id":"AAA","name":"Foo","version":2},{"id":"BBB","name":"Bar","version":2}]`,
+		}}
+		cache = api.NewServiceCache(client, "irrelevant_token")
+	)
+	for i := 0; i < 4; i++ {
+		if err := cache.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gatherer, err := cache.Gatherer("fastly", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// BBB's change was forgotten when it left the cache, so it starts over.
+	want := `
+# HELP fastly_service_version_changes_total Number of changes of the active version of each service observed across refreshes, i.e. deploys and rollbacks.
+# TYPE fastly_service_version_changes_total counter
+fastly_service_version_changes_total{service_id="AAA",service_name="Foo"} 1
+fastly_service_version_changes_total{service_id="BBB",service_name="Bar"} 0
+`
+	if err := testutil.GatherAndCompare(gatherer, strings.NewReader(want), "fastly_service_version_changes_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceCacheOnChange(t *testing.T) {
+	t.Parallel()
+
+	type change struct{ added, removed []string }
+	var (
+		ctx    = context.Background()
+		client = &sequenceResponseClient{responses: []string{
+			`[{"id":"BBB","name":"Bar"},{"id":"AAA","name":"Foo"},{"id":"XXX","name":"Blocked"}]`,
+			`[{"id":"AAA","name":"Foo"},{"id":"BBB","name":"Bar"},{"id":"XXX","name":"Blocked"}]`,
+			`[{"id":"BBB","name":"Bar"},{"id":"CCC","name":"Baz"},{"id":"YYY","name":"Blocked"}]`,
+		}}
+		changes  []change
+		onChange = func(added, removed []string) { changes = append(changes, change{added, removed}) }
+		cache    = api.NewServiceCache(client, "irrelevant_token", api.WithNameFilter(filterBlocklist("Blocked")), api.WithOnChange(onChange))
+	)
+	for i := 0; i < 3; i++ {
+		if err := cache.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []change{
+		{added: []string{"AAA", "BBB"}},
+		{added: []string{"CCC"}, removed: []string{"AAA"}},
+	}
+	if !cmp.Equal(want, changes, cmp.AllowUnexported(change{})) {
+		t.Error(cmp.Diff(want, changes, cmp.AllowUnexported(change{})))
+	}
+}
+
+func TestServiceCacheSetShardDuringRefresh(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx    = context.Background()
+		s2     = api.Service{ID: "XXXXXXXXXXXXXXXXXXXXXX", Name: "Dummy service", Version: 1}
+		client = fixedResponseClient{code: 200, response: serviceResponseLarge}
+		cache  *api.ServiceCache
+		once   sync.Once
+	)
+
+	// The refresh logs each service it accepts, after it's filtered them by
+	// the shard but before it's committed them, which is when the shard
+	// changing would otherwise go unnoticed.
+	logger := log.LoggerFunc(func(keyvals ...interface{}) error {
+		for i := 0; i < len(keyvals)-1; i += 2 {
+			if keyvals[i] == "result" && keyvals[i+1] == "accepted" {
+				once.Do(func() { cache.SetShard(2, 3) })
+			}
+		}
+		return nil
+	})
+	cache = api.NewServiceCache(client, "irrelevant_token", api.WithLogger(logger))
+
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{s2.ID}, cache.ServiceIDs(); !cmp.Equal(want, have) {
+		t.Error(cmp.Diff(want, have))
+	}
+}
+
+func TestServiceCacheResponseAge(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx    = context.Background()
+		client = agedResponseClient{fixedResponseClient{code: 200, response: serviceResponseLarge}, "42"}
+		cache  = api.NewServiceCache(client, "irrelevant_token")
+	)
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	gatherer, err := cache.Gatherer("fastly", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `
+# HELP fastly_api_response_age_seconds Age header of the most recent service listing from the Fastly API, i.e. how long a caching proxy held it, or 0 if it was fresh. The largest across pages.
+# TYPE fastly_api_response_age_seconds gauge
+fastly_api_response_age_seconds 42
+`
+	if err := testutil.GatherAndCompare(gatherer, strings.NewReader(want), "fastly_api_response_age_seconds"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceCacheCreatedTimestamps(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx    = context.Background()
+		client = fixedResponseClient{code: 200, response: serviceResponseLarge}
+		cache  = api.NewServiceCache(client, "irrelevant_token", api.WithCreatedTimestamps(true))
+	)
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	gatherer, err := cache.Gatherer("fastly", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `
+# HELP fastly_service_created_timestamp Unix timestamp of the creation of each service.
+# TYPE fastly_service_created_timestamp gauge
+fastly_service_created_timestamp{service_id="AbcDef123ghiJKlmnOPsq",service_name="My first service"} 1.532585631e+09
+fastly_service_created_timestamp{service_id="XXXXXXXXXXXXXXXXXXXXXX",service_name="Dummy service"} 1.53746174e+09
+`
+	if err := testutil.GatherAndCompare(gatherer, strings.NewReader(want), "fastly_service_created_timestamp"); err != nil {
+		t.Error(err)
+	}
+}
+
 func filterAllowlist(a string) (f filter.Filter) {
 	f.Allow(a)
 	return f
@@ -313,3 +992,49 @@ const serviceResponseLarge = `[
 		"id": "XXXXXXXXXXXXXXXXXXXXXX"
 	}
 ]`
+
+// serviceResponseCustomers has the services of serviceResponseLarge, each
+// belonging to a different customer.
+const serviceResponseCustomers = `[
+	{
+		"id": "AbcDef123ghiJKlmnOPsq",
+		"name": "My first service",
+		"customer_id": "1a2a3a4azzzzzzzzzzzzzz",
+		"version": 5,
+		"versions": [
+			{ "number": 5, "active": true }
+		]
+	},
+	{
+		"id": "XXXXXXXXXXXXXXXXXXXXXX",
+		"name": "Dummy service",
+		"customer_id": "5b6b7b8bzzzzzzzzzzzzzz",
+		"version": 1,
+		"versions": [
+			{ "number": 1, "active": true }
+		]
+	}
+]`
+
+// serviceResponseDeployed has one service whose active version is deployed,
+// and one whose active version isn't, though a later, inactive version is.
+const serviceResponseDeployed = `[
+	{
+		"id": "AAA",
+		"name": "Deployed service",
+		"version": 2,
+		"versions": [
+			{ "number": 1, "active": false, "deployed": true },
+			{ "number": 2, "active": true, "deployed": true }
+		]
+	},
+	{
+		"id": "BBB",
+		"name": "Undeployed service",
+		"version": 1,
+		"versions": [
+			{ "number": 1, "active": true, "deployed": false },
+			{ "number": 2, "active": false, "deployed": true }
+		]
+	}
+]`
@@ -158,6 +158,8 @@ type Datacenter struct {
 	RecvSubTime                        uint64            `json:"recv_sub_time"`
 	ReqBodyBytes                       uint64            `json:"req_body_bytes"`
 	ReqHeaderBytes                     uint64            `json:"req_header_bytes"`
+	RequestCollapseUnusableCount       uint64            `json:"request_collapse_unusable_count"`
+	RequestCollapseUsableCount         uint64            `json:"request_collapse_usable_count"`
 	Requests                           uint64            `json:"requests"`
 	RespBodyBytes                      uint64            `json:"resp_body_bytes"`
 	RespHeaderBytes                    uint64            `json:"resp_header_bytes"`
@@ -214,6 +216,23 @@ type Metrics struct {
 	RealtimeAPIRequestsTotal             *prometheus.CounterVec
 	ServiceInfo                          *prometheus.GaugeVec
 	LastSuccessfulResponse               *prometheus.GaugeVec
+	DatacentersFilteredTotal             *prometheus.CounterVec
+	DecodeErrorsTotal                    *prometheus.CounterVec
+	ClockSkewSeconds                     *prometheus.GaugeVec
+	EmptyResponsesTotal                  *prometheus.CounterVec
+	OldestPendingBucketAgeSeconds        *prometheus.GaugeVec
+	RequestsPerSecond                    *prometheus.GaugeVec
+	DatacenterShare                      *prometheus.GaugeVec
+	ErrorRatio                           *prometheus.GaugeVec
+	PollIntervalSeconds                  *prometheus.GaugeVec
+	FirstBucketLatencySeconds            *prometheus.GaugeVec
+	ByteSizeBytes                        *prometheus.HistogramVec
+	HTTPVersionRequestsTotal             *prometheus.CounterVec
+	Forbidden                            *prometheus.GaugeVec
+	DatacenterOverflowTotal              *prometheus.CounterVec
+	LastBucketTimestamp                  *prometheus.GaugeVec
+	ServiceNameInfo                      *prometheus.GaugeVec
+	RequestsRateSmoothed                 *prometheus.GaugeVec
 	AttackBlockedReqBodyBytesTotal       *prometheus.CounterVec
 	AttackBlockedReqHeaderBytesTotal     *prometheus.CounterVec
 	AttackLoggedReqBodyBytesTotal        *prometheus.CounterVec
@@ -230,6 +249,7 @@ type Metrics struct {
 	BilledTotal                          *prometheus.CounterVec
 	BlacklistedTotal                     *prometheus.CounterVec
 	BodySizeTotal                        *prometheus.CounterVec
+	BytesTotal                           *prometheus.CounterVec
 	ComputeBackendReqBodyBytesTotal      *prometheus.CounterVec
 	ComputeBackendReqErrorsTotal         *prometheus.CounterVec
 	ComputeBackendReqHeaderBytesTotal    *prometheus.CounterVec
@@ -333,6 +353,8 @@ type Metrics struct {
 	RecvSubTimeTotal                     *prometheus.CounterVec
 	ReqBodyBytesTotal                    *prometheus.CounterVec
 	ReqHeaderBytesTotal                  *prometheus.CounterVec
+	RequestCollapseUnusableTotal         *prometheus.CounterVec
+	RequestCollapseUsableTotal           *prometheus.CounterVec
 	RequestsTotal                        *prometheus.CounterVec
 	RespBodyBytesTotal                   *prometheus.CounterVec
 	RespHeaderBytesTotal                 *prometheus.CounterVec
@@ -366,6 +388,23 @@ func NewMetrics(namespace, subsystem string, nameFilter filter.Filter, r prometh
 		RealtimeAPIRequestsTotal:             prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "realtime_api_requests_total", Help: "Total requests made to the real-time stats API."}, []string{"service_id", "service_name", "result"}),
 		ServiceInfo:                          prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "service_info", Help: "Static gauge with service ID, name, and version information."}, []string{"service_id", "service_name", "service_version"}),
 		LastSuccessfulResponse:               prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "last_successful_response", Help: "Unix timestamp of the last successful response received from the real-time stats API."}, []string{"service_id", "service_name"}),
+		DatacentersFilteredTotal:             prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "datacenters_filtered_total", Help: "Total datacenters dropped from real-time responses by the datacenter filter, counted once per bucket."}, []string{"service_id", "service_name"}),
+		DecodeErrorsTotal:                    prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "decode_errors_total", Help: "Total real-time stats API responses that couldn't be decoded, by kind of error."}, []string{"service_id", "service_name", "kind"}),
+		ClockSkewSeconds:                     prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "clock_skew_seconds", Help: "Difference between the local clock and the real-time stats API's clock, per the Date header of the last response. Positive values mean the local clock is ahead."}, []string{"service_id", "service_name"}),
+		EmptyResponsesTotal:                  prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "empty_responses_total", Help: "Total successful real-time stats API responses with an empty body. These aren't counted as errors. Responses with no buckets of data, e.g. No data available, aren't counted."}, []string{"service_id", "service_name"}),
+		OldestPendingBucketAgeSeconds:        prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "oldest_pending_bucket_age_seconds", Help: "Age of the oldest bucket of real-time data not yet processed, either because it's deferred or because it hasn't been fetched. Grows when the subscriber falls behind."}, []string{"service_id", "service_name"}),
+		RequestsPerSecond:                    prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "requests_per_second", Help: "Requests per second, computed from the requests in a bucket and the time since the previous bucket. Only updated if request rates are enabled."}, []string{"service_id", "service_name", "datacenter"}),
+		DatacenterShare:                      prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "datacenter_share", Help: "Share of the service's requests served by each datacenter in the most recent bucket, from 0 to 1. Only updated if datacenter shares are enabled."}, []string{"service_id", "service_name", "datacenter"}),
+		ErrorRatio:                           prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "error_ratio", Help: "Ratio of 5xx responses to requests in each datacenter in the most recent bucket. Only present for datacenters with requests in that bucket."}, []string{"service_id", "service_name", "datacenter"}),
+		PollIntervalSeconds:                  prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "poll_interval_seconds", Help: "Effective minimum interval between real-time stats API requests. Zero means requests are made back to back."}, []string{"service_id", "service_name"}),
+		FirstBucketLatencySeconds:            prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "first_bucket_latency_seconds", Help: "Time from the start of the subscriber to the first bucket of real-time data received for the service."}, []string{"service_id", "service_name"}),
+		ByteSizeBytes:                        prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: namespace, Subsystem: subsystem, Name: "byte_size_bytes", Help: "Histogram of the per-second byte totals of selected real-time fields in each datacenter. Only observed for fields configured as byte size histograms.", Buckets: []float64{1024, 10240, 102400, 1.024e+06, 1.024e+07, 1.024e+08, 1.024e+09}}, []string{"service_id", "service_name", "datacenter", "field"}),
+		HTTPVersionRequestsTotal:             prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "http_version_requests_total", Help: "Total requests by HTTP version, with versions outside the allowlist folded into other. Only counted if HTTP versions are tracked."}, []string{"service_id", "service_name", "datacenter", "version"}),
+		Forbidden:                            prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "forbidden", Help: "1 if the subscriber for the service stopped after repeated 403 Forbidden responses from the real-time stats API. Cleared once the service responds successfully again."}, []string{"service_id", "service_name"}),
+		DatacenterOverflowTotal:              prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "datacenter_overflow_total", Help: "Total datacenters folded into the catch-all datacenter label because the service reached the datacenter limit, counted once per bucket."}, []string{"service_id", "service_name"}),
+		LastBucketTimestamp:                  prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "last_bucket_timestamp", Help: "Unix timestamp of the last bucket of real-time data processed. A flat value reveals a stall, and a regressing one a reset."}, []string{"service_id", "service_name"}),
+		ServiceNameInfo:                      prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "service_name_info", Help: "Static gauge mapping the sanitized service name used in labels to the raw service name, when service name sanitization is enabled."}, []string{"service_id", "service_name", "raw_service_name"}),
+		RequestsRateSmoothed:                 prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: "requests_rate_smoothed", Help: "Requests per second across all datacenters, smoothed over successive buckets with an exponentially weighted moving average. Only updated if smoothed request rates are enabled."}, []string{"service_id", "service_name"}),
 		AttackBlockedReqBodyBytesTotal:       prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "attack_blocked_req_body_bytes_total", Help: "Total body bytes received from requests that triggered a WAF rule that was blocked."}, []string{"service_id", "service_name", "datacenter"}),
 		AttackBlockedReqHeaderBytesTotal:     prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "attack_blocked_req_header_bytes_total", Help: "Total header bytes received from requests that triggered a WAF rule that was blocked."}, []string{"service_id", "service_name", "datacenter"}),
 		AttackLoggedReqBodyBytesTotal:        prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "attack_logged_req_body_bytes_total", Help: "Total body bytes received from requests that triggered a WAF rule that was logged."}, []string{"service_id", "service_name", "datacenter"}),
@@ -382,6 +421,7 @@ func NewMetrics(namespace, subsystem string, nameFilter filter.Filter, r prometh
 		BilledTotal:                          prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "billed_total", Help: "TODO"}, []string{"service_id", "service_name", "datacenter"}),
 		BlacklistedTotal:                     prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "blacklist_total", Help: "TODO"}, []string{"service_id", "service_name", "datacenter"}),
 		BodySizeTotal:                        prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "body_size_total", Help: "Total body bytes delivered (alias for resp_body_bytes)."}, []string{"service_id", "service_name", "datacenter"}),
+		BytesTotal:                           prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "bytes_total", Help: "Total bytes delivered from Fastly to the end user, headers and bodies combined. This is the canonical egress metric."}, []string{"service_id", "service_name", "datacenter"}),
 		ComputeBackendReqBodyBytesTotal:      prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "compute_bereq_body_bytes_total", Help: "Total body bytes sent to backends (origins) by Compute@Edge."}, []string{"service_id", "service_name", "datacenter"}),
 		ComputeBackendReqErrorsTotal:         prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "compute_bereq_errors_total", Help: "Number of backend request errors, including timeouts."}, []string{"service_id", "service_name", "datacenter"}),
 		ComputeBackendReqHeaderBytesTotal:    prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "compute_bereq_header_bytes_total", Help: "Total header bytes sent to backends (origins) by Compute@Edge."}, []string{"service_id", "service_name", "datacenter"}),
@@ -485,6 +525,8 @@ func NewMetrics(namespace, subsystem string, nameFilter filter.Filter, r prometh
 		RecvSubTimeTotal:                     prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "recv_sub_time_total", Help: "Time spent inside the 'recv' Varnish subroutine (in seconds)."}, []string{"service_id", "service_name", "datacenter"}),
 		ReqBodyBytesTotal:                    prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "req_body_bytes_total", Help: "Total body bytes received."}, []string{"service_id", "service_name", "datacenter"}),
 		ReqHeaderBytesTotal:                  prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "req_header_bytes_total", Help: "Total header bytes received."}, []string{"service_id", "service_name", "datacenter"}),
+		RequestCollapseUnusableTotal:         prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "request_collapse_unusable_total", Help: "Number of requests that were collapsed and satisfied by an unusable cache object."}, []string{"service_id", "service_name", "datacenter"}),
+		RequestCollapseUsableTotal:           prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "request_collapse_usable_total", Help: "Number of requests that were collapsed and satisfied by a usable cache object."}, []string{"service_id", "service_name", "datacenter"}),
 		RequestsTotal:                        prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "requests_total", Help: "Number of requests processed."}, []string{"service_id", "service_name", "datacenter"}),
 		RespBodyBytesTotal:                   prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "resp_body_bytes_total", Help: "Total body bytes delivered."}, []string{"service_id", "service_name", "datacenter"}),
 		RespHeaderBytesTotal:                 prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: "resp_header_bytes_total", Help: "Total header bytes delivered."}, []string{"service_id", "service_name", "datacenter"}),
@@ -527,6 +569,178 @@ func NewMetrics(namespace, subsystem string, nameFilter filter.Filter, r prometh
 	return &m
 }
 
+// MetricLabels maps the name of each metric, without its namespace and
+// subsystem, to the labels of every one of its series, including the le label
+// of histograms. None of the metrics have constant labels.
+var MetricLabels = map[string][]string{
+	"realtime_api_requests_total":               {"service_id", "service_name", "result"},
+	"service_info":                              {"service_id", "service_name", "service_version"},
+	"last_successful_response":                  {"service_id", "service_name"},
+	"datacenters_filtered_total":                {"service_id", "service_name"},
+	"decode_errors_total":                       {"service_id", "service_name", "kind"},
+	"clock_skew_seconds":                        {"service_id", "service_name"},
+	"empty_responses_total":                     {"service_id", "service_name"},
+	"oldest_pending_bucket_age_seconds":         {"service_id", "service_name"},
+	"requests_per_second":                       {"service_id", "service_name", "datacenter"},
+	"datacenter_share":                          {"service_id", "service_name", "datacenter"},
+	"error_ratio":                               {"service_id", "service_name", "datacenter"},
+	"poll_interval_seconds":                     {"service_id", "service_name"},
+	"first_bucket_latency_seconds":              {"service_id", "service_name"},
+	"byte_size_bytes":                           {"service_id", "service_name", "datacenter", "field", "le"},
+	"http_version_requests_total":               {"service_id", "service_name", "datacenter", "version"},
+	"forbidden":                                 {"service_id", "service_name"},
+	"datacenter_overflow_total":                 {"service_id", "service_name"},
+	"last_bucket_timestamp":                     {"service_id", "service_name"},
+	"service_name_info":                         {"service_id", "service_name", "raw_service_name"},
+	"requests_rate_smoothed":                    {"service_id", "service_name"},
+	"attack_blocked_req_body_bytes_total":       {"service_id", "service_name", "datacenter"},
+	"attack_blocked_req_header_bytes_total":     {"service_id", "service_name", "datacenter"},
+	"attack_logged_req_body_bytes_total":        {"service_id", "service_name", "datacenter"},
+	"attack_logged_req_header_bytes_total":      {"service_id", "service_name", "datacenter"},
+	"attack_passed_req_body_bytes_total":        {"service_id", "service_name", "datacenter"},
+	"attack_passed_req_header_bytes_total":      {"service_id", "service_name", "datacenter"},
+	"attack_req_body_bytes_total":               {"service_id", "service_name", "datacenter"},
+	"attack_req_header_bytes_total":             {"service_id", "service_name", "datacenter"},
+	"attack_resp_synth_bytes_total":             {"service_id", "service_name", "datacenter"},
+	"bereq_body_bytes_total":                    {"service_id", "service_name", "datacenter"},
+	"bereq_header_bytes_total":                  {"service_id", "service_name", "datacenter"},
+	"billed_body_bytes_total":                   {"service_id", "service_name", "datacenter"},
+	"billed_header_bytes_total":                 {"service_id", "service_name", "datacenter"},
+	"billed_total":                              {"service_id", "service_name", "datacenter"},
+	"blacklist_total":                           {"service_id", "service_name", "datacenter"},
+	"body_size_total":                           {"service_id", "service_name", "datacenter"},
+	"bytes_total":                               {"service_id", "service_name", "datacenter"},
+	"compute_bereq_body_bytes_total":            {"service_id", "service_name", "datacenter"},
+	"compute_bereq_errors_total":                {"service_id", "service_name", "datacenter"},
+	"compute_bereq_header_bytes_total":          {"service_id", "service_name", "datacenter"},
+	"compute_bereq_total":                       {"service_id", "service_name", "datacenter"},
+	"compute_beresp_body_bytes_total":           {"service_id", "service_name", "datacenter"},
+	"compute_beresp_header_bytes_total":         {"service_id", "service_name", "datacenter"},
+	"compute_execution_time_total":              {"service_id", "service_name", "datacenter"},
+	"compute_globals_limit_exceeded_total":      {"service_id", "service_name", "datacenter"},
+	"compute_guest_errors_total":                {"service_id", "service_name", "datacenter"},
+	"compute_heap_limit_exceeded_total":         {"service_id", "service_name", "datacenter"},
+	"compute_ram_used_bytes_total":              {"service_id", "service_name", "datacenter"},
+	"compute_req_body_bytes_total":              {"service_id", "service_name", "datacenter"},
+	"compute_req_header_bytes_total":            {"service_id", "service_name", "datacenter"},
+	"compute_requests_total":                    {"service_id", "service_name", "datacenter"},
+	"compute_request_time_total":                {"service_id", "service_name", "datacenter"},
+	"compute_resource_limit_exceeded_total":     {"service_id", "service_name", "datacenter"},
+	"compute_resp_body_bytes_total":             {"service_id", "service_name", "datacenter"},
+	"compute_resp_header_bytes_total":           {"service_id", "service_name", "datacenter"},
+	"compute_resp_status_total":                 {"service_id", "service_name", "datacenter", "status_group"},
+	"compute_runtime_errors_total":              {"service_id", "service_name", "datacenter"},
+	"compute_stack_limit_exceeded_total":        {"service_id", "service_name", "datacenter"},
+	"deliver_sub_count_total":                   {"service_id", "service_name", "datacenter"},
+	"deliver_sub_time_total":                    {"service_id", "service_name", "datacenter"},
+	"edge_resp_body_bytes_total":                {"service_id", "service_name", "datacenter"},
+	"edge_resp_header_bytes_total":              {"service_id", "service_name", "datacenter"},
+	"edge_total":                                {"service_id", "service_name", "datacenter"},
+	"errors_total":                              {"service_id", "service_name", "datacenter"},
+	"error_sub_count_total":                     {"service_id", "service_name", "datacenter"},
+	"error_sub_time_total":                      {"service_id", "service_name", "datacenter"},
+	"fetch_sub_count_total":                     {"service_id", "service_name", "datacenter"},
+	"fetch_sub_time_total":                      {"service_id", "service_name", "datacenter"},
+	"hash_sub_count_total":                      {"service_id", "service_name", "datacenter"},
+	"hash_sub_time_total":                       {"service_id", "service_name", "datacenter"},
+	"header_size_total":                         {"service_id", "service_name", "datacenter"},
+	"hit_resp_body_bytes_total":                 {"service_id", "service_name", "datacenter"},
+	"hits_time_total":                           {"service_id", "service_name", "datacenter"},
+	"hits_total":                                {"service_id", "service_name", "datacenter"},
+	"hit_sub_count_total":                       {"service_id", "service_name", "datacenter"},
+	"hit_sub_time_total":                        {"service_id", "service_name", "datacenter"},
+	"http2_total":                               {"service_id", "service_name", "datacenter"},
+	"imgopto_resp_body_bytes_total":             {"service_id", "service_name", "datacenter"},
+	"imgopto_resp_header_bytes_total":           {"service_id", "service_name", "datacenter"},
+	"imgopto_shield_resp_body_bytes_total":      {"service_id", "service_name", "datacenter"},
+	"imgopto_shield_resp_header_bytes_total":    {"service_id", "service_name", "datacenter"},
+	"imgopto_shield_total":                      {"service_id", "service_name", "datacenter"},
+	"imgopto_total":                             {"service_id", "service_name", "datacenter"},
+	"imgopto_transform_resp_body_bytes_total":   {"service_id", "service_name", "datacenter"},
+	"imgopto_transform_resp_header_bytes_total": {"service_id", "service_name", "datacenter"},
+	"imgopto_transforms_total":                  {"service_id", "service_name", "datacenter"},
+	"imgvideo_frames_total":                     {"service_id", "service_name", "datacenter"},
+	"imgvideo_resp_body_bytes_total":            {"service_id", "service_name", "datacenter"},
+	"imgvideo_resp_header_bytes_total":          {"service_id", "service_name", "datacenter"},
+	"imgvideo_shield_frames_total":              {"service_id", "service_name", "datacenter"},
+	"imgvideo_shield_resp_body_bytes_total":     {"service_id", "service_name", "datacenter"},
+	"imgvideo_shield_resp_header_bytes_total":   {"service_id", "service_name", "datacenter"},
+	"imgvideo_shield_total":                     {"service_id", "service_name", "datacenter"},
+	"imgvideo_total":                            {"service_id", "service_name", "datacenter"},
+	"ipv6_total":                                {"service_id", "service_name", "datacenter"},
+	"log_bytes_total":                           {"service_id", "service_name", "datacenter"},
+	"logging_total":                             {"service_id", "service_name", "datacenter"},
+	"miss_duration_seconds":                     {"service_id", "service_name", "datacenter", "le"},
+	"miss_total":                                {"service_id", "service_name", "datacenter"},
+	"miss_resp_body_bytes_total":                {"service_id", "service_name", "datacenter"},
+	"miss_sub_count_total":                      {"service_id", "service_name", "datacenter"},
+	"miss_sub_time_total":                       {"service_id", "service_name", "datacenter"},
+	"miss_time_total":                           {"service_id", "service_name", "datacenter"},
+	"object_size_bytes":                         {"service_id", "service_name", "datacenter", "le"},
+	"origin_fetch_body_bytes_total":             {"service_id", "service_name", "datacenter"},
+	"origin_fetches_total":                      {"service_id", "service_name", "datacenter"},
+	"origin_fetch_header_bytes_total":           {"service_id", "service_name", "datacenter"},
+	"origin_fetch_resp_body_bytes_total":        {"service_id", "service_name", "datacenter"},
+	"origin_fetch_resp_header_bytes_total":      {"service_id", "service_name", "datacenter"},
+	"origin_revalidations_total":                {"service_id", "service_name", "datacenter"},
+	"otfp_total":                                {"service_id", "service_name", "datacenter"},
+	"otfp_deliver_time_total":                   {"service_id", "service_name", "datacenter"},
+	"otfp_manifests_total":                      {"service_id", "service_name", "datacenter"},
+	"otfp_resp_body_bytes_total":                {"service_id", "service_name", "datacenter"},
+	"otfp_resp_header_bytes_total":              {"service_id", "service_name", "datacenter"},
+	"otfp_shield_total":                         {"service_id", "service_name", "datacenter"},
+	"otfp_shield_resp_body_bytes_total":         {"service_id", "service_name", "datacenter"},
+	"otfp_shield_resp_header_bytes_total":       {"service_id", "service_name", "datacenter"},
+	"otfp_shield_time_total":                    {"service_id", "service_name", "datacenter"},
+	"otfp_transforms_total":                     {"service_id", "service_name", "datacenter"},
+	"otfp_transform_resp_body_bytes_total":      {"service_id", "service_name", "datacenter"},
+	"otfp_transform_resp_header_bytes_total":    {"service_id", "service_name", "datacenter"},
+	"otfp_transform_time_total":                 {"service_id", "service_name", "datacenter"},
+	"pass_total":                                {"service_id", "service_name", "datacenter"},
+	"pass_resp_body_bytes_total":                {"service_id", "service_name", "datacenter"},
+	"pass_sub_count_total":                      {"service_id", "service_name", "datacenter"},
+	"pass_sub_time_total":                       {"service_id", "service_name", "datacenter"},
+	"pass_time_total":                           {"service_id", "service_name", "datacenter"},
+	"pci_total":                                 {"service_id", "service_name", "datacenter"},
+	"pipe":                                      {"service_id", "service_name", "datacenter"},
+	"pipe_sub_count_total":                      {"service_id", "service_name", "datacenter"},
+	"pipe_sub_time_total":                       {"service_id", "service_name", "datacenter"},
+	"predeliver_sub_count_total":                {"service_id", "service_name", "datacenter"},
+	"predeliver_sub_time_total":                 {"service_id", "service_name", "datacenter"},
+	"prehash_sub_count_total":                   {"service_id", "service_name", "datacenter"},
+	"prehash_sub_time_total":                    {"service_id", "service_name", "datacenter"},
+	"recv_sub_count_total":                      {"service_id", "service_name", "datacenter"},
+	"recv_sub_time_total":                       {"service_id", "service_name", "datacenter"},
+	"req_body_bytes_total":                      {"service_id", "service_name", "datacenter"},
+	"req_header_bytes_total":                    {"service_id", "service_name", "datacenter"},
+	"request_collapse_unusable_total":           {"service_id", "service_name", "datacenter"},
+	"request_collapse_usable_total":             {"service_id", "service_name", "datacenter"},
+	"requests_total":                            {"service_id", "service_name", "datacenter"},
+	"resp_body_bytes_total":                     {"service_id", "service_name", "datacenter"},
+	"resp_header_bytes_total":                   {"service_id", "service_name", "datacenter"},
+	"restarts_total":                            {"service_id", "service_name", "datacenter"},
+	"segblock_origin_fetches_total":             {"service_id", "service_name", "datacenter"},
+	"segblock_shield_fetches_total":             {"service_id", "service_name", "datacenter"},
+	"shield_fetch_body_bytes_total":             {"service_id", "service_name", "datacenter"},
+	"shield_fetches_total":                      {"service_id", "service_name", "datacenter"},
+	"shield_fetch_header_bytes_total":           {"service_id", "service_name", "datacenter"},
+	"shield_fetch_resp_body_bytes_total":        {"service_id", "service_name", "datacenter"},
+	"shield_fetch_resp_header_bytes_total":      {"service_id", "service_name", "datacenter"},
+	"shield_resp_body_bytes_total":              {"service_id", "service_name", "datacenter"},
+	"shield_resp_header_bytes_total":            {"service_id", "service_name", "datacenter"},
+	"shield_revalidations_total":                {"service_id", "service_name", "datacenter"},
+	"shield_total":                              {"service_id", "service_name", "datacenter"},
+	"status_code_total":                         {"service_id", "service_name", "datacenter", "status_code"},
+	"status_group_total":                        {"service_id", "service_name", "datacenter", "status_group"},
+	"synth_total":                               {"service_id", "service_name", "datacenter"},
+	"tls_total":                                 {"service_id", "service_name", "datacenter", "tls_version"},
+	"uncacheable_total":                         {"service_id", "service_name", "datacenter"},
+	"video_total":                               {"service_id", "service_name", "datacenter"},
+	"waf_blocked_total":                         {"service_id", "service_name", "datacenter"},
+	"waf_logged_total":                          {"service_id", "service_name", "datacenter"},
+	"waf_passed_total":                          {"service_id", "service_name", "datacenter"},
+}
+
 var descNameRegex = regexp.MustCompile("fqName: \"([^\"]+)\"")
 
 func getName(c prometheus.Collector) string {
@@ -540,186 +754,393 @@ func getName(c prometheus.Collector) string {
 	return ""
 }
 
+// ByName returns the metric with the given fully-qualified name, or nil if
+// there's no such metric.
+func (m *Metrics) ByName(name string) prometheus.Collector {
+	for i, v := 0, reflect.ValueOf(*m); i < v.NumField(); i++ {
+		if c, ok := v.Field(i).Interface().(prometheus.Collector); ok && getName(c) == name {
+			return c
+		}
+	}
+	return nil
+}
+
 // Process updates the metrics with data from the API response.
 func Process(response *APIResponse, serviceID, serviceName, serviceVersion string, m *Metrics) {
 	for _, d := range response.Data {
 		for datacenter, stats := range d.Datacenter {
-			m.AttackBlockedReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackBlockedReqBodyBytes))
-			m.AttackBlockedReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackBlockedReqHeaderBytes))
-			m.AttackLoggedReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackLoggedReqBodyBytes))
-			m.AttackLoggedReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackLoggedReqHeaderBytes))
-			m.AttackPassedReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackPassedReqBodyBytes))
-			m.AttackPassedReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackPassedReqHeaderBytes))
-			m.AttackReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackReqBodyBytes))
-			m.AttackReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackReqHeaderBytes))
-			m.AttackRespSynthBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackRespSynthBytes))
-			m.BackendReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.BackendReqBodyBytes))
-			m.BackendReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.BackendReqHeaderBytes))
-			m.BilledBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.BilledBodyBytes))
-			m.BilledHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.BilledHeaderBytes))
-			m.BilledTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Billed))
-			m.BlacklistedTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Blacklisted))
-			m.BodySizeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.BodySize))
-			m.ComputeBackendReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeBackendReqBodyBytesTotal))
-			m.ComputeBackendReqErrorsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeBackendReqErrorsTotal))
-			m.ComputeBackendReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeBackendReqHeaderBytesTotal))
-			m.ComputeBackendReqTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeBackendReqTotal))
-			m.ComputeBackendRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeBackendRespBodyBytesTotal))
-			m.ComputeBackendRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeBackendRespHeaderBytesTotal))
-			m.ComputeExecutionTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeExecutionTimeMilliseconds) / 10000.0)
-			m.ComputeGlobalsLimitExceededTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeGlobalsLimitExceededTotal))
-			m.ComputeGuestErrorsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeGuestErrorsTotal))
-			m.ComputeHeapLimitExceededTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeHeapLimitExceededTotal))
-			m.ComputeRAMUsedBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeRAMUsed))
-			m.ComputeReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeReqBodyBytesTotal))
-			m.ComputeReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeReqHeaderBytesTotal))
-			m.ComputeRequestsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeRequests))
-			m.ComputeRequestTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeRequestTimeMilliseconds) / 10000.0)
-			m.ComputeResourceLimitExceedTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeResourceLimitExceedTotal))
-			m.ComputeRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeRespBodyBytesTotal))
-			m.ComputeRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeRespHeaderBytesTotal))
-			m.ComputeRespStatusTotal.WithLabelValues(serviceID, serviceName, datacenter, "1xx").Add(float64(stats.ComputeRespStatus1xx))
-			m.ComputeRespStatusTotal.WithLabelValues(serviceID, serviceName, datacenter, "2xx").Add(float64(stats.ComputeRespStatus2xx))
-			m.ComputeRespStatusTotal.WithLabelValues(serviceID, serviceName, datacenter, "3xx").Add(float64(stats.ComputeRespStatus3xx))
-			m.ComputeRespStatusTotal.WithLabelValues(serviceID, serviceName, datacenter, "4xx").Add(float64(stats.ComputeRespStatus4xx))
-			m.ComputeRespStatusTotal.WithLabelValues(serviceID, serviceName, datacenter, "5xx").Add(float64(stats.ComputeRespStatus5xx))
-			m.ComputeRuntimeErrorsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeRuntimeErrorsTotal))
-			m.ComputeStackLimitExceededTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeStackLimitExceededTotal))
-			m.DeliverSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.DeliverSubCount))
-			m.DeliverSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.DeliverSubTime))
-			m.EdgeRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.EdgeRespBodyBytes))
-			m.EdgeRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.EdgeRespHeaderBytes))
-			m.EdgeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Edge))
-			m.ErrorsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Errors))
-			m.ErrorSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ErrorSubCount))
-			m.ErrorSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ErrorSubTime))
-			m.FetchSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.FetchSubCount))
-			m.FetchSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.FetchSubTime))
-			m.HashSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HashSubCount))
-			m.HashSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HashSubTime))
-			m.HeaderSizeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HeaderSize))
-			m.HitRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HitRespBodyBytes))
-			m.HitsTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HitsTime))
-			m.HitsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Hits))
-			m.HitSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HitSubCount))
-			m.HitSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HitSubTime))
-			m.HTTP2Total.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HTTP2))
-			m.ImgOptoRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoRespBodyBytes))
-			m.ImgOptoRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoRespHeaderBytes))
-			m.ImgOptoShieldRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoShieldRespBodyBytes))
-			m.ImgOptoShieldRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoShieldRespHeaderBytes))
-			m.ImgOptoShieldTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoShield))
-			m.ImgOptoTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOpto))
-			m.ImgOptoTransformRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoTransformRespBodyBytes))
-			m.ImgOptoTransformRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoTransformRespHeaderBytes))
-			m.ImgOptoTransformTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoTransform))
-			m.ImgVideoFramesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoFrames))
-			m.ImgVideoRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoRespBodyBytes))
-			m.ImgVideoRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoRespHeaderBytes))
-			m.ImgVideoShieldFramesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoShieldFrames))
-			m.ImgVideoShieldRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoShieldRespBodyBytes))
-			m.ImgVideoShieldRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoShieldRespHeaderBytes))
-			m.ImgVideoShieldTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoShield))
-			m.ImgVideoTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideo))
-			m.IPv6Total.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.IPv6))
-			m.LogBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.LogBytes))
-			m.LoggingTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Logging))
-			processHistogram(stats.MissHistogram, m.MissDurationSeconds.WithLabelValues(serviceID, serviceName, datacenter))
-			m.MissesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Misses))
-			m.MissRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.MissRespBodyBytes))
-			m.MissSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.MissSubCount))
-			m.MissSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.MissSubTime))
-			m.MissTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.MissTime))
-			processObjectSizes(stats.ObjectSize1k, stats.ObjectSize10k, stats.ObjectSize100k, stats.ObjectSize1m, stats.ObjectSize10m, stats.ObjectSize100m, stats.ObjectSize1g, m.ObjectSizeBytes.WithLabelValues(serviceID, serviceName, datacenter))
-			m.OriginFetchBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OriginFetchBodyBytes))
-			m.OriginFetchesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OriginFetches))
-			m.OriginFetchHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OriginFetchHeaderBytes))
-			m.OriginFetchRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OriginFetchRespBodyBytes))
-			m.OriginFetchRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OriginFetchRespHeaderBytes))
-			m.OriginRevalidationsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OriginRevalidations))
-			m.OTFPDeliverTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPDeliverTime))
-			m.OTFPManifestTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPManifest))
-			m.OTFPRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPRespBodyBytes))
-			m.OTFPRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPRespHeaderBytes))
-			m.OTFPShieldRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPShieldRespBodyBytes))
-			m.OTFPShieldRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPShieldRespHeaderBytes))
-			m.OTFPShieldTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPShieldTime))
-			m.OTFPShieldTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPShield))
-			m.OTFPTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFP))
-			m.OTFPTransformRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPTransformRespBodyBytes))
-			m.OTFPTransformRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPTransformRespHeaderBytes))
-			m.OTFPTransformTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPTransformTime))
-			m.OTFPTransformTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPTransform))
-			m.PassesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Passes))
-			m.PassRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PassRespBodyBytes))
-			m.PassSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PassSubCount))
-			m.PassSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PassSubTime))
-			m.PassTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PassTime))
-			m.PCITotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PCI))
-			m.Pipe.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Pipe))
-			m.PipeSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PipeSubCount))
-			m.PipeSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PipeSubTime))
-			m.PredeliverSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PredeliverSubCount))
-			m.PredeliverSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PredeliverSubTime))
-			m.PrehashSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PrehashSubCount))
-			m.PrehashSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PrehashSubTime))
-			m.RecvSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.RecvSubCount))
-			m.RecvSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.RecvSubTime))
-			m.ReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ReqBodyBytes))
-			m.ReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ReqHeaderBytes))
-			m.RequestsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Requests))
-			m.RespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.RespBodyBytes))
-			m.RespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.RespHeaderBytes))
-			m.RestartTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Restart))
-			m.SegBlockOriginFetchesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.SegBlockOriginFetches))
-			m.SegBlockShieldFetchesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.SegBlockShieldFetches))
-			m.ShieldFetchBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldFetchBodyBytes))
-			m.ShieldFetchesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldFetches))
-			m.ShieldFetchHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldFetchHeaderBytes))
-			m.ShieldFetchRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldFetchRespBodyBytes))
-			m.ShieldFetchRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldFetchRespHeaderBytes))
-			m.ShieldRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldRespBodyBytes))
-			m.ShieldRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldRespHeaderBytes))
-			m.ShieldRevalidationsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldRevalidations))
-			m.ShieldTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Shield))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "200").Add(float64(stats.Status200))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "204").Add(float64(stats.Status204))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "206").Add(float64(stats.Status206))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "301").Add(float64(stats.Status301))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "302").Add(float64(stats.Status302))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "304").Add(float64(stats.Status304))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "400").Add(float64(stats.Status400))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "401").Add(float64(stats.Status401))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "403").Add(float64(stats.Status403))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "404").Add(float64(stats.Status404))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "416").Add(float64(stats.Status416))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "429").Add(float64(stats.Status429))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "500").Add(float64(stats.Status500))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "501").Add(float64(stats.Status501))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "502").Add(float64(stats.Status502))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "503").Add(float64(stats.Status503))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "504").Add(float64(stats.Status504))
-			m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "505").Add(float64(stats.Status505))
-			m.StatusGroupTotal.WithLabelValues(serviceID, serviceName, datacenter, "1xx").Add(float64(stats.Status1xx))
-			m.StatusGroupTotal.WithLabelValues(serviceID, serviceName, datacenter, "2xx").Add(float64(stats.Status2xx))
-			m.StatusGroupTotal.WithLabelValues(serviceID, serviceName, datacenter, "3xx").Add(float64(stats.Status3xx))
-			m.StatusGroupTotal.WithLabelValues(serviceID, serviceName, datacenter, "4xx").Add(float64(stats.Status4xx))
-			m.StatusGroupTotal.WithLabelValues(serviceID, serviceName, datacenter, "5xx").Add(float64(stats.Status5xx))
-			m.SynthsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Synths))
-			m.TLSTotal.WithLabelValues(serviceID, serviceName, datacenter, "any").Add(float64(stats.TLS))
-			m.TLSTotal.WithLabelValues(serviceID, serviceName, datacenter, "v10").Add(float64(stats.TLSv10))
-			m.TLSTotal.WithLabelValues(serviceID, serviceName, datacenter, "v11").Add(float64(stats.TLSv11))
-			m.TLSTotal.WithLabelValues(serviceID, serviceName, datacenter, "v12").Add(float64(stats.TLSv12))
-			m.TLSTotal.WithLabelValues(serviceID, serviceName, datacenter, "v13").Add(float64(stats.TLSv13))
-			m.UncacheableTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Uncacheable))
-			m.VideoTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Video))
-			m.WAFBlockedTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.WAFBlocked))
-			m.WAFLoggedTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.WAFLogged))
-			m.WAFPassedTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.WAFPassed))
+			ProcessDatacenter(&stats, serviceID, serviceName, datacenter, m)
 		}
 	}
 }
 
+// ProcessDatacenter updates the metrics with data from a single datacenter
+// in a single bucket of the API response.
+func ProcessDatacenter(stats *Datacenter, serviceID, serviceName, datacenter string, m *Metrics) {
+	m.AttackBlockedReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackBlockedReqBodyBytes))
+	m.AttackBlockedReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackBlockedReqHeaderBytes))
+	m.AttackLoggedReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackLoggedReqBodyBytes))
+	m.AttackLoggedReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackLoggedReqHeaderBytes))
+	m.AttackPassedReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackPassedReqBodyBytes))
+	m.AttackPassedReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackPassedReqHeaderBytes))
+	m.AttackReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackReqBodyBytes))
+	m.AttackReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackReqHeaderBytes))
+	m.AttackRespSynthBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.AttackRespSynthBytes))
+	m.BackendReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.BackendReqBodyBytes))
+	m.BackendReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.BackendReqHeaderBytes))
+	m.BilledBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.BilledBodyBytes))
+	m.BilledHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.BilledHeaderBytes))
+	m.BilledTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Billed))
+	m.BlacklistedTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Blacklisted))
+	m.BodySizeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.BodySize))
+	m.BytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.EdgeRespHeaderBytes))
+	m.BytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.EdgeRespBodyBytes))
+	m.ComputeBackendReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeBackendReqBodyBytesTotal))
+	m.ComputeBackendReqErrorsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeBackendReqErrorsTotal))
+	m.ComputeBackendReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeBackendReqHeaderBytesTotal))
+	m.ComputeBackendReqTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeBackendReqTotal))
+	m.ComputeBackendRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeBackendRespBodyBytesTotal))
+	m.ComputeBackendRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeBackendRespHeaderBytesTotal))
+	m.ComputeExecutionTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeExecutionTimeMilliseconds) / 10000.0)
+	m.ComputeGlobalsLimitExceededTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeGlobalsLimitExceededTotal))
+	m.ComputeGuestErrorsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeGuestErrorsTotal))
+	m.ComputeHeapLimitExceededTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeHeapLimitExceededTotal))
+	m.ComputeRAMUsedBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeRAMUsed))
+	m.ComputeReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeReqBodyBytesTotal))
+	m.ComputeReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeReqHeaderBytesTotal))
+	m.ComputeRequestsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeRequests))
+	m.ComputeRequestTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeRequestTimeMilliseconds) / 10000.0)
+	m.ComputeResourceLimitExceedTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeResourceLimitExceedTotal))
+	m.ComputeRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeRespBodyBytesTotal))
+	m.ComputeRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeRespHeaderBytesTotal))
+	m.ComputeRespStatusTotal.WithLabelValues(serviceID, serviceName, datacenter, "1xx").Add(float64(stats.ComputeRespStatus1xx))
+	m.ComputeRespStatusTotal.WithLabelValues(serviceID, serviceName, datacenter, "2xx").Add(float64(stats.ComputeRespStatus2xx))
+	m.ComputeRespStatusTotal.WithLabelValues(serviceID, serviceName, datacenter, "3xx").Add(float64(stats.ComputeRespStatus3xx))
+	m.ComputeRespStatusTotal.WithLabelValues(serviceID, serviceName, datacenter, "4xx").Add(float64(stats.ComputeRespStatus4xx))
+	m.ComputeRespStatusTotal.WithLabelValues(serviceID, serviceName, datacenter, "5xx").Add(float64(stats.ComputeRespStatus5xx))
+	m.ComputeRuntimeErrorsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeRuntimeErrorsTotal))
+	m.ComputeStackLimitExceededTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ComputeStackLimitExceededTotal))
+	m.DeliverSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.DeliverSubCount))
+	m.DeliverSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.DeliverSubTime))
+	m.EdgeRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.EdgeRespBodyBytes))
+	m.EdgeRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.EdgeRespHeaderBytes))
+	m.EdgeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Edge))
+	m.ErrorsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Errors))
+	m.ErrorSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ErrorSubCount))
+	m.ErrorSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ErrorSubTime))
+	m.FetchSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.FetchSubCount))
+	m.FetchSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.FetchSubTime))
+	m.HashSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HashSubCount))
+	m.HashSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HashSubTime))
+	m.HeaderSizeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HeaderSize))
+	m.HitRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HitRespBodyBytes))
+	m.HitsTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HitsTime))
+	m.HitsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Hits))
+	m.HitSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HitSubCount))
+	m.HitSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HitSubTime))
+	m.HTTP2Total.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.HTTP2))
+	m.ImgOptoRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoRespBodyBytes))
+	m.ImgOptoRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoRespHeaderBytes))
+	m.ImgOptoShieldRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoShieldRespBodyBytes))
+	m.ImgOptoShieldRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoShieldRespHeaderBytes))
+	m.ImgOptoShieldTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoShield))
+	m.ImgOptoTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOpto))
+	m.ImgOptoTransformRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoTransformRespBodyBytes))
+	m.ImgOptoTransformRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoTransformRespHeaderBytes))
+	m.ImgOptoTransformTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgOptoTransform))
+	m.ImgVideoFramesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoFrames))
+	m.ImgVideoRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoRespBodyBytes))
+	m.ImgVideoRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoRespHeaderBytes))
+	m.ImgVideoShieldFramesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoShieldFrames))
+	m.ImgVideoShieldRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoShieldRespBodyBytes))
+	m.ImgVideoShieldRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoShieldRespHeaderBytes))
+	m.ImgVideoShieldTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideoShield))
+	m.ImgVideoTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ImgVideo))
+	m.IPv6Total.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.IPv6))
+	m.LogBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.LogBytes))
+	m.LoggingTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Logging))
+	processHistogram(stats.MissHistogram, m.MissDurationSeconds.WithLabelValues(serviceID, serviceName, datacenter))
+	m.MissesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Misses))
+	m.MissRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.MissRespBodyBytes))
+	m.MissSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.MissSubCount))
+	m.MissSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.MissSubTime))
+	m.MissTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.MissTime))
+	processObjectSizes(stats.ObjectSize1k, stats.ObjectSize10k, stats.ObjectSize100k, stats.ObjectSize1m, stats.ObjectSize10m, stats.ObjectSize100m, stats.ObjectSize1g, m.ObjectSizeBytes.WithLabelValues(serviceID, serviceName, datacenter))
+	m.OriginFetchBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OriginFetchBodyBytes))
+	m.OriginFetchesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OriginFetches))
+	m.OriginFetchHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OriginFetchHeaderBytes))
+	m.OriginFetchRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OriginFetchRespBodyBytes))
+	m.OriginFetchRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OriginFetchRespHeaderBytes))
+	m.OriginRevalidationsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OriginRevalidations))
+	m.OTFPDeliverTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPDeliverTime))
+	m.OTFPManifestTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPManifest))
+	m.OTFPRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPRespBodyBytes))
+	m.OTFPRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPRespHeaderBytes))
+	m.OTFPShieldRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPShieldRespBodyBytes))
+	m.OTFPShieldRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPShieldRespHeaderBytes))
+	m.OTFPShieldTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPShieldTime))
+	m.OTFPShieldTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPShield))
+	m.OTFPTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFP))
+	m.OTFPTransformRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPTransformRespBodyBytes))
+	m.OTFPTransformRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPTransformRespHeaderBytes))
+	m.OTFPTransformTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPTransformTime))
+	m.OTFPTransformTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.OTFPTransform))
+	m.PassesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Passes))
+	m.PassRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PassRespBodyBytes))
+	m.PassSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PassSubCount))
+	m.PassSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PassSubTime))
+	m.PassTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PassTime))
+	m.PCITotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PCI))
+	m.Pipe.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Pipe))
+	m.PipeSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PipeSubCount))
+	m.PipeSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PipeSubTime))
+	m.PredeliverSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PredeliverSubCount))
+	m.PredeliverSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PredeliverSubTime))
+	m.PrehashSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PrehashSubCount))
+	m.PrehashSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.PrehashSubTime))
+	m.RecvSubCountTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.RecvSubCount))
+	m.RecvSubTimeTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.RecvSubTime))
+	m.ReqBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ReqBodyBytes))
+	m.ReqHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ReqHeaderBytes))
+	m.RequestCollapseUnusableTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.RequestCollapseUnusableCount))
+	m.RequestCollapseUsableTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.RequestCollapseUsableCount))
+	m.RequestsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Requests))
+	m.RespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.RespBodyBytes))
+	m.RespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.RespHeaderBytes))
+	m.RestartTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Restart))
+	m.SegBlockOriginFetchesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.SegBlockOriginFetches))
+	m.SegBlockShieldFetchesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.SegBlockShieldFetches))
+	m.ShieldFetchBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldFetchBodyBytes))
+	m.ShieldFetchesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldFetches))
+	m.ShieldFetchHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldFetchHeaderBytes))
+	m.ShieldFetchRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldFetchRespBodyBytes))
+	m.ShieldFetchRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldFetchRespHeaderBytes))
+	m.ShieldRespBodyBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldRespBodyBytes))
+	m.ShieldRespHeaderBytesTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldRespHeaderBytes))
+	m.ShieldRevalidationsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.ShieldRevalidations))
+	m.ShieldTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Shield))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "200").Add(float64(stats.Status200))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "204").Add(float64(stats.Status204))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "206").Add(float64(stats.Status206))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "301").Add(float64(stats.Status301))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "302").Add(float64(stats.Status302))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "304").Add(float64(stats.Status304))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "400").Add(float64(stats.Status400))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "401").Add(float64(stats.Status401))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "403").Add(float64(stats.Status403))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "404").Add(float64(stats.Status404))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "416").Add(float64(stats.Status416))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "429").Add(float64(stats.Status429))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "500").Add(float64(stats.Status500))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "501").Add(float64(stats.Status501))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "502").Add(float64(stats.Status502))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "503").Add(float64(stats.Status503))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "504").Add(float64(stats.Status504))
+	m.StatusCodeTotal.WithLabelValues(serviceID, serviceName, datacenter, "505").Add(float64(stats.Status505))
+	m.StatusGroupTotal.WithLabelValues(serviceID, serviceName, datacenter, "1xx").Add(float64(stats.Status1xx))
+	m.StatusGroupTotal.WithLabelValues(serviceID, serviceName, datacenter, "2xx").Add(float64(stats.Status2xx))
+	m.StatusGroupTotal.WithLabelValues(serviceID, serviceName, datacenter, "3xx").Add(float64(stats.Status3xx))
+	m.StatusGroupTotal.WithLabelValues(serviceID, serviceName, datacenter, "4xx").Add(float64(stats.Status4xx))
+	m.StatusGroupTotal.WithLabelValues(serviceID, serviceName, datacenter, "5xx").Add(float64(stats.Status5xx))
+	m.SynthsTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Synths))
+	m.TLSTotal.WithLabelValues(serviceID, serviceName, datacenter, "any").Add(float64(stats.TLS))
+	m.TLSTotal.WithLabelValues(serviceID, serviceName, datacenter, "v10").Add(float64(stats.TLSv10))
+	m.TLSTotal.WithLabelValues(serviceID, serviceName, datacenter, "v11").Add(float64(stats.TLSv11))
+	m.TLSTotal.WithLabelValues(serviceID, serviceName, datacenter, "v12").Add(float64(stats.TLSv12))
+	m.TLSTotal.WithLabelValues(serviceID, serviceName, datacenter, "v13").Add(float64(stats.TLSv13))
+	m.UncacheableTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Uncacheable))
+	m.VideoTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.Video))
+	m.WAFBlockedTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.WAFBlocked))
+	m.WAFLoggedTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.WAFLogged))
+	m.WAFPassedTotal.WithLabelValues(serviceID, serviceName, datacenter).Add(float64(stats.WAFPassed))
+}
+
+// Empty returns true if every field of the datacenter is zero, which means
+// the datacenter served no traffic in the corresponding bucket.
+func (d *Datacenter) Empty() bool {
+	return d.AttackBlockedReqBodyBytes == 0 &&
+		d.AttackBlockedReqHeaderBytes == 0 &&
+		d.AttackLoggedReqBodyBytes == 0 &&
+		d.AttackLoggedReqHeaderBytes == 0 &&
+		d.AttackPassedReqBodyBytes == 0 &&
+		d.AttackPassedReqHeaderBytes == 0 &&
+		d.AttackReqBodyBytes == 0 &&
+		d.AttackReqHeaderBytes == 0 &&
+		d.AttackRespSynthBytes == 0 &&
+		d.BackendReqBodyBytes == 0 &&
+		d.BackendReqHeaderBytes == 0 &&
+		d.Billed == 0 &&
+		d.BilledBodyBytes == 0 &&
+		d.BilledHeaderBytes == 0 &&
+		d.Blacklisted == 0 &&
+		d.BodySize == 0 &&
+		d.ComputeBackendReqBodyBytesTotal == 0 &&
+		d.ComputeBackendReqErrorsTotal == 0 &&
+		d.ComputeBackendReqHeaderBytesTotal == 0 &&
+		d.ComputeBackendReqTotal == 0 &&
+		d.ComputeBackendRespBodyBytesTotal == 0 &&
+		d.ComputeBackendRespHeaderBytesTotal == 0 &&
+		d.ComputeExecutionTimeMilliseconds == 0 &&
+		d.ComputeGlobalsLimitExceededTotal == 0 &&
+		d.ComputeGuestErrorsTotal == 0 &&
+		d.ComputeHeapLimitExceededTotal == 0 &&
+		d.ComputeRAMUsed == 0 &&
+		d.ComputeReqBodyBytesTotal == 0 &&
+		d.ComputeReqHeaderBytesTotal == 0 &&
+		d.ComputeRequests == 0 &&
+		d.ComputeRequestTimeMilliseconds == 0 &&
+		d.ComputeResourceLimitExceedTotal == 0 &&
+		d.ComputeRespBodyBytesTotal == 0 &&
+		d.ComputeRespHeaderBytesTotal == 0 &&
+		d.ComputeRespStatus1xx == 0 &&
+		d.ComputeRespStatus2xx == 0 &&
+		d.ComputeRespStatus3xx == 0 &&
+		d.ComputeRespStatus4xx == 0 &&
+		d.ComputeRespStatus5xx == 0 &&
+		d.ComputeRuntimeErrorsTotal == 0 &&
+		d.ComputeStackLimitExceededTotal == 0 &&
+		d.DeliverSubCount == 0 &&
+		d.DeliverSubTime == 0 &&
+		d.Edge == 0 &&
+		d.EdgeRespBodyBytes == 0 &&
+		d.EdgeRespHeaderBytes == 0 &&
+		d.Errors == 0 &&
+		d.ErrorSubCount == 0 &&
+		d.ErrorSubTime == 0 &&
+		d.FetchSubCount == 0 &&
+		d.FetchSubTime == 0 &&
+		d.HashSubCount == 0 &&
+		d.HashSubTime == 0 &&
+		d.HeaderSize == 0 &&
+		d.HitRespBodyBytes == 0 &&
+		d.Hits == 0 &&
+		d.HitsTime == 0 &&
+		d.HitSubCount == 0 &&
+		d.HitSubTime == 0 &&
+		d.HTTP2 == 0 &&
+		d.ImgOpto == 0 &&
+		d.ImgOptoRespBodyBytes == 0 &&
+		d.ImgOptoRespHeaderBytes == 0 &&
+		d.ImgOptoShield == 0 &&
+		d.ImgOptoShieldRespBodyBytes == 0 &&
+		d.ImgOptoShieldRespHeaderBytes == 0 &&
+		d.ImgOptoTransform == 0 &&
+		d.ImgOptoTransformRespBodyBytes == 0 &&
+		d.ImgOptoTransformRespHeaderBytes == 0 &&
+		d.ImgVideo == 0 &&
+		d.ImgVideoFrames == 0 &&
+		d.ImgVideoRespBodyBytes == 0 &&
+		d.ImgVideoRespHeaderBytes == 0 &&
+		d.ImgVideoShield == 0 &&
+		d.ImgVideoShieldFrames == 0 &&
+		d.ImgVideoShieldRespBodyBytes == 0 &&
+		d.ImgVideoShieldRespHeaderBytes == 0 &&
+		d.IPv6 == 0 &&
+		d.LogBytes == 0 &&
+		d.Logging == 0 &&
+		d.Misses == 0 &&
+		len(d.MissHistogram) == 0 &&
+		d.MissRespBodyBytes == 0 &&
+		d.MissSubCount == 0 &&
+		d.MissSubTime == 0 &&
+		d.MissTime == 0 &&
+		d.ObjectSize100k == 0 &&
+		d.ObjectSize100m == 0 &&
+		d.ObjectSize10k == 0 &&
+		d.ObjectSize10m == 0 &&
+		d.ObjectSize1g == 0 &&
+		d.ObjectSize1k == 0 &&
+		d.ObjectSize1m == 0 &&
+		d.ObjectSizeOther == 0 &&
+		d.OriginFetchBodyBytes == 0 &&
+		d.OriginFetches == 0 &&
+		d.OriginFetchHeaderBytes == 0 &&
+		d.OriginFetchRespBodyBytes == 0 &&
+		d.OriginFetchRespHeaderBytes == 0 &&
+		d.OriginRevalidations == 0 &&
+		d.OTFP == 0 &&
+		d.OTFPDeliverTime == 0 &&
+		d.OTFPManifest == 0 &&
+		d.OTFPRespBodyBytes == 0 &&
+		d.OTFPRespHeaderBytes == 0 &&
+		d.OTFPShield == 0 &&
+		d.OTFPShieldRespBodyBytes == 0 &&
+		d.OTFPShieldRespHeaderBytes == 0 &&
+		d.OTFPShieldTime == 0 &&
+		d.OTFPTransform == 0 &&
+		d.OTFPTransformRespBodyBytes == 0 &&
+		d.OTFPTransformRespHeaderBytes == 0 &&
+		d.OTFPTransformTime == 0 &&
+		d.Passes == 0 &&
+		d.PassRespBodyBytes == 0 &&
+		d.PassSubCount == 0 &&
+		d.PassSubTime == 0 &&
+		d.PassTime == 0 &&
+		d.PCI == 0 &&
+		d.Pipe == 0 &&
+		d.PipeSubCount == 0 &&
+		d.PipeSubTime == 0 &&
+		d.PredeliverSubCount == 0 &&
+		d.PredeliverSubTime == 0 &&
+		d.PrehashSubCount == 0 &&
+		d.PrehashSubTime == 0 &&
+		d.RecvSubCount == 0 &&
+		d.RecvSubTime == 0 &&
+		d.ReqBodyBytes == 0 &&
+		d.ReqHeaderBytes == 0 &&
+		d.RequestCollapseUnusableCount == 0 &&
+		d.RequestCollapseUsableCount == 0 &&
+		d.Requests == 0 &&
+		d.RespBodyBytes == 0 &&
+		d.RespHeaderBytes == 0 &&
+		d.Restart == 0 &&
+		d.SegBlockOriginFetches == 0 &&
+		d.SegBlockShieldFetches == 0 &&
+		d.Shield == 0 &&
+		d.ShieldFetchBodyBytes == 0 &&
+		d.ShieldFetches == 0 &&
+		d.ShieldFetchHeaderBytes == 0 &&
+		d.ShieldFetchRespBodyBytes == 0 &&
+		d.ShieldFetchRespHeaderBytes == 0 &&
+		d.ShieldRespBodyBytes == 0 &&
+		d.ShieldRespHeaderBytes == 0 &&
+		d.ShieldRevalidations == 0 &&
+		d.Status1xx == 0 &&
+		d.Status200 == 0 &&
+		d.Status204 == 0 &&
+		d.Status206 == 0 &&
+		d.Status2xx == 0 &&
+		d.Status301 == 0 &&
+		d.Status302 == 0 &&
+		d.Status304 == 0 &&
+		d.Status3xx == 0 &&
+		d.Status400 == 0 &&
+		d.Status401 == 0 &&
+		d.Status403 == 0 &&
+		d.Status404 == 0 &&
+		d.Status416 == 0 &&
+		d.Status429 == 0 &&
+		d.Status4xx == 0 &&
+		d.Status500 == 0 &&
+		d.Status501 == 0 &&
+		d.Status502 == 0 &&
+		d.Status503 == 0 &&
+		d.Status504 == 0 &&
+		d.Status505 == 0 &&
+		d.Status5xx == 0 &&
+		d.Synths == 0 &&
+		d.TLS == 0 &&
+		d.TLSv10 == 0 &&
+		d.TLSv11 == 0 &&
+		d.TLSv12 == 0 &&
+		d.TLSv13 == 0 &&
+		d.Uncacheable == 0 &&
+		d.Video == 0 &&
+		d.WAFBlocked == 0 &&
+		d.WAFLogged == 0 &&
+		d.WAFPassed == 0
+}
+
 func processHistogram(src map[string]uint64, obs prometheus.Observer) {
 	for str, count := range src {
 		ms, err := strconv.Atoi(str)
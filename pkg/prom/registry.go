@@ -1,20 +1,27 @@
 package prom
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
 	"net/url"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/fastly/fastly-exporter/pkg/filter"
 	"github.com/fastly/fastly-exporter/pkg/gen"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 )
 
 // Registry collects Prometheus metrics on a per-service basis.
@@ -32,27 +39,291 @@ type Registry struct {
 	subsystem        string
 	metricNameFilter filter.Filter
 	byServiceID      map[string]*metricsRegistry
+	restored         counterState
 	defaultGatherers []prometheus.Gatherer
+	builtin          prometheus.Gatherer
+	namespaces       map[string]string
+	types            ServiceTypeProvider
+	regions          DatacenterGroupProvider
+	typeSubsystems   map[string]string
+	scrapes          chan struct{}
+	scrapeCache      *scrapeCache
+	environment      *environmentLabel
+	pairs            *pairLabels
+	standby          int32 // atomic; 1 until promoted
+	maintenanceUntil int64 // atomic; Unix timestamp
+	selectors        map[string]Selector
+	adminEnabled     bool
+	admin            map[string]http.Handler
+	adminQuery       map[string]http.Handler
+	debug            map[string]http.Handler
+	now              func() time.Time
+	created          time.Time
+	top              *topServices
+	byteSizeBuckets  []float64
+	labelOrder       map[string]int
 
 	http.Handler
 }
 
-// NewRegistry returns a new and empty registry for Prometheus metrics.
+// RegistryOption provides some additional behavior to a registry.
+type RegistryOption func(*Registry)
+
+// WithDefaultGatherers adds gatherers whose metrics are served with every
+// scrape of the `/metrics` endpoint, regardless of the target. By default, only
+// per-service metrics are served.
+func WithDefaultGatherers(gatherers ...prometheus.Gatherer) RegistryOption {
+	return func(r *Registry) { r.defaultGatherers = append(r.defaultGatherers, gatherers...) }
+}
+
+// WithServiceNamespace overrides the Prometheus namespace for the metrics of
+// the provided service IDs. This is useful to keep dashboards built for other
+// exporters working for a subset of services. By default, all services use the
+// namespace provided to the constructor.
+func WithServiceNamespace(namespace string, serviceIDs ...string) RegistryOption {
+	return func(r *Registry) {
+		for _, id := range serviceIDs {
+			r.namespaces[id] = namespace
+		}
+	}
+}
+
+// ServiceTypeProvider is a consumer contract for the registry.
+// It models the service type lookup method of an api.ServiceCache.
+type ServiceTypeProvider interface {
+	ServiceType(id string) (serviceType string, found bool)
+}
+
+// WithServiceTypeSubsystem overrides the Prometheus subsystem for the metrics
+// of services of the given type, e.g. "wasm" for Compute services, as looked up
+// via the provider, so metric names describe the type of service. A service's
+// type is looked up once, when its metrics are first requested; services whose
+// type isn't known by then keep the default. By default, all services use the
+// subsystem provided to the constructor.
+func WithServiceTypeSubsystem(p ServiceTypeProvider, serviceType, subsystem string) RegistryOption {
+	return func(r *Registry) { r.types, r.typeSubsystems[serviceType] = p, subsystem }
+}
+
+// WithMaxConcurrentScrapes limits the number of concurrent requests to the
+// `/metrics` endpoint which are gathering metrics. Requests beyond the limit
+// fail immediately with 503 Service Unavailable and a Retry-After header. By
+// default, concurrent scrapes are unlimited.
+func WithMaxConcurrentScrapes(n int) RegistryOption {
+	return func(r *Registry) {
+		if n > 0 {
+			r.scrapes = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithScrapeCache makes the `/metrics` endpoint reuse each rendered response
+// for ttl, e.g. 500ms, so near-simultaneous scrapes by several scrapers only
+// gather the metrics once. Responses are cached separately for each query
+// string and negotiated format, and only if they succeed. Cached responses can
+// be up to ttl stale. By default, every scrape gathers the metrics afresh.
+func WithScrapeCache(ttl time.Duration) RegistryOption {
+	return func(r *Registry) {
+		if ttl > 0 {
+			r.scrapeCache = &scrapeCache{ttl: ttl, entries: map[string]*scrapeEntry{}}
+		}
+	}
+}
+
+// WithEnvironmentLabel adds an "environment" label to every per-service series,
+// derived from the service_name label via the first capture group of the
+// provided regex. Names that don't match get the fallback value. By default,
+// no environment label is added.
+func WithEnvironmentLabel(re *regexp.Regexp, fallback string) RegistryOption {
+	return func(r *Registry) { r.environment = &environmentLabel{re, fallback} }
+}
+
+// WithServicePairLabels adds "service" and "env" labels to every per-service
+// series, derived from the service_name label via the named capture groups
+// "service" and "env" of the provided regex, e.g. `^(?P<service>.+)-(?P<env>prod|staging)$`.
+// This joins paired services, e.g. api-prod and api-staging, under one canonical
+// service label, while keeping them apart by env. Names that don't match get
+// their full name as the service label, and an empty env label. By default, no
+// service or env labels are added.
+func WithServicePairLabels(re *regexp.Regexp) RegistryOption {
+	return func(r *Registry) { r.pairs = newPairLabels(re) }
+}
+
+// DatacenterGroupProvider is a consumer contract for the registry.
+// It models the datacenter group lookup method of an api.DatacenterCache.
+type DatacenterGroupProvider interface {
+	DatacenterGroup(code string) (group string, found bool)
+}
+
+// WithRegionLabels groups the targets in the `/sd` document by region, and
+// labels each group with a "region" label. A service's region is the group of
+// the datacenter which has served the most of its requests so far, as looked
+// up via the provider. Services which haven't served any requests yet, or whose
+// top datacenter isn't known, are in a group without a region label. By
+// default, all targets are in a single group without labels.
+func WithRegionLabels(p DatacenterGroupProvider) RegistryOption {
+	return func(r *Registry) { r.regions = p }
+}
+
+// WithStandby starts the registry in standby mode. Metrics are collected as
+// usual, but the `/metrics` endpoint fails with 503 Service Unavailable, and
+// Gather yields no metrics, until the registry is promoted via Promote or, with
+// WithAdminEndpoints, a POST to the `/admin/promote` endpoint. This allows a warm standby to take over
+// from another instance with its counters already populated. By default, the
+// registry is active.
+func WithStandby() RegistryOption {
+	return func(r *Registry) { atomic.StoreInt32(&r.standby, 1) }
+}
+
+// Selector is a predefined combination of filters for the `/metrics` endpoint,
+// which is applied by name via `/metrics?selector=<name>`. This keeps scrape
+// configs tidy, and lets the filters be managed centrally.
+type Selector struct {
+	// Targets restricts per-service metrics to the given service IDs. If it's
+	// empty, metrics for all services are served.
+	Targets []string
+
+	// Datacenters restricts metrics with a datacenter label to those whose
+	// datacenter passes the filter. Metrics without a datacenter label are
+	// always served.
+	Datacenters filter.Filter
+}
+
+// WithSelector defines a named selector for the `/metrics` endpoint. Defining
+// the same name again replaces the earlier selector. By default, no selectors
+// are defined, and requests for any selector fail with 404 Not Found.
+func WithSelector(name string, s Selector) RegistryOption {
+	return func(r *Registry) { r.selectors[name] = s }
+}
+
+// WithAdminEndpoints serves the endpoints under `/admin/`: the builtin promote
+// and maintenance endpoints, and those added via WithAdminHandler and
+// WithAdminQueryHandler. They aren't authenticated, and they change how the
+// exporter behaves, so they should only be enabled when the listen address is
+// reachable only by trusted clients. By default, requests to any of them fail
+// with 404 Not Found.
+func WithAdminEndpoints() RegistryOption {
+	return func(r *Registry) { r.adminEnabled = true }
+}
+
+// WithAdminHandler serves POST requests to `/admin/<name>` with the handler.
+// This allows callers to expose runtime controls for the components around the
+// registry alongside the builtin admin endpoints. It has no effect without
+// WithAdminEndpoints. By default, only the builtin admin endpoints are served.
+func WithAdminHandler(name string, h http.Handler) RegistryOption {
+	return func(r *Registry) { r.admin[name] = h }
+}
+
+// WithAdminQueryHandler serves GET requests to `/admin/<name>` with the
+// handler. It's meant for read-only endpoints, which report on the components
+// around the registry without changing them. It has no effect without
+// WithAdminEndpoints. By default, no such endpoints are served.
+func WithAdminQueryHandler(name string, h http.Handler) RegistryOption {
+	return func(r *Registry) { r.adminQuery[name] = h }
+}
+
+// WithDebugHandler serves GET requests to `/debug/<name>` with the handler.
+// It's meant for diagnostic endpoints, which help to triage problems with the
+// components around the registry. By default, no such endpoints are served.
+func WithDebugHandler(name string, h http.Handler) RegistryOption {
+	return func(r *Registry) { r.debug[name] = h }
+}
+
+// WithTopServices restricts the per-service metrics which are served to those
+// of the n services with the most requests. The services are ranked once the
+// registry has observed traffic for the warmup duration, and re-ranked by their
+// requests since the previous ranking every interval thereafter; until the
+// first ranking, all services are served. If other is true, the requests of
+// the services which aren't served are summed into an other_requests gauge,
+// named with the same namespace and subsystem as those services' metrics. It's
+// a gauge, because services move in and out of the top services, so the sum
+// can decrease. By default, all services are served.
+func WithTopServices(n int, warmup, interval time.Duration, other bool) RegistryOption {
+	return func(r *Registry) {
+		if n > 0 {
+			r.top = &topServices{n: n, warmup: warmup, interval: interval, other: other, last: map[string]float64{}}
+		}
+	}
+}
+
+// WithByteSizeBuckets sets the bucket boundaries, in bytes, of the per-service
+// ByteSizeBytes histogram, which must be sorted in increasing order. By default,
+// the same buckets as the object size histogram are used, from 1KiB to 1GiB.
+func WithByteSizeBuckets(buckets []float64) RegistryOption {
+	return func(r *Registry) { r.byteSizeBuckets = buckets }
+}
+
+// WithLabelOrder changes the order of labels in the output of the `/metrics`
+// endpoint. The given labels come first, in the given order, and any others
+// follow in alphabetical order. Only the rendering changes; series and their
+// values are the same. By default, all labels are in alphabetical order.
+func WithLabelOrder(labels ...string) RegistryOption {
+	return func(r *Registry) {
+		r.labelOrder = make(map[string]int, len(labels))
+		for i, label := range labels {
+			r.labelOrder[label] = i
+		}
+	}
+}
+
+// WithClock sets the function used by the registry to get the current time.
+// By default, time.Now is used. This option is only useful for tests.
+func WithClock(now func() time.Time) RegistryOption {
+	return func(r *Registry) { r.now = now }
+}
+
+// NewRegistry returns a new and empty registry for Prometheus metrics. The
+// default gatherers are served with every scrape of the `/metrics` endpoint, as
+// with WithDefaultGatherers.
 func NewRegistry(version, namespace, subsystem string, metricNameFilter filter.Filter, defaultGatherers ...prometheus.Gatherer) *Registry {
+	return NewRegistryWithOptions(version, namespace, subsystem, metricNameFilter, WithDefaultGatherers(defaultGatherers...))
+}
+
+// NewRegistryWithOptions returns a new and empty registry for Prometheus
+// metrics, like NewRegistry, with options for additional behavior.
+func NewRegistryWithOptions(version, namespace, subsystem string, metricNameFilter filter.Filter, options ...RegistryOption) *Registry {
 	r := &Registry{
 		version:          version,
 		namespace:        namespace,
 		subsystem:        subsystem,
 		metricNameFilter: metricNameFilter,
 		byServiceID:      map[string]*metricsRegistry{},
-		defaultGatherers: defaultGatherers,
+		restored:         counterState{},
+		namespaces:       map[string]string{},
+		typeSubsystems:   map[string]string{},
+		selectors:        map[string]Selector{},
+		admin:            map[string]http.Handler{},
+		adminQuery:       map[string]http.Handler{},
+		debug:            map[string]http.Handler{},
+		now:              time.Now,
+	}
+	for _, option := range options {
+		option(r)
 	}
+	r.created = r.now()
+
+	builtin := prometheus.NewRegistry()
+	builtin.MustRegister(newHeartbeatCollector(namespace, r.now))
+	builtin.MustRegister(newMaintenanceCollector(namespace, r.MaintenanceActive))
+	r.builtin = builtin
 
 	router := mux.NewRouter()
 	router.StrictSlash(true)
 	router.Methods("GET").Path("/").HandlerFunc(r.handleIndex)
 	router.Methods("GET").Path("/sd").HandlerFunc(r.handleServiceDiscovery)
 	router.Methods("GET").Path("/metrics").HandlerFunc(r.handleMetrics)
+	if r.adminEnabled {
+		router.Methods("POST").Path("/admin/promote").HandlerFunc(r.handlePromote)
+		router.Methods("POST").Path("/admin/maintenance").HandlerFunc(r.handleMaintenance)
+		for name, h := range r.admin {
+			router.Methods("POST").Path("/admin/" + name).Handler(h)
+		}
+		for name, h := range r.adminQuery {
+			router.Methods("GET").Path("/admin/" + name).Handler(h)
+		}
+	}
+	for name, h := range r.debug {
+		router.Methods("GET").Path("/debug/" + name).Handler(h)
+	}
 	r.Handler = router
 
 	return r
@@ -63,8 +334,10 @@ func NewRegistry(version, namespace, subsystem string, metricNameFilter filter.F
 // with other registries and served as a single set of metrics via the
 // prometheus.Gatherers helper type.
 type metricsRegistry struct {
-	metrics  *gen.Metrics
-	registry *prometheus.Registry
+	metrics   *gen.Metrics
+	registry  *prometheus.Registry
+	namespace string
+	subsystem string
 }
 
 // MetricsFor returns a set of Prometheus metrics for a specific service, with
@@ -76,15 +349,116 @@ func (r *Registry) MetricsFor(serviceID string) *gen.Metrics {
 
 	mr, ok := r.byServiceID[serviceID]
 	if !ok {
+		namespace, ok := r.namespaces[serviceID]
+		if !ok {
+			namespace = r.namespace
+		}
+		subsystem := r.subsystem
+		if r.types != nil {
+			if t, ok := r.types.ServiceType(serviceID); ok {
+				if s, ok := r.typeSubsystems[t]; ok {
+					subsystem = s
+				}
+			}
+		}
 		registry := prometheus.NewRegistry()
-		metrics := gen.NewMetrics(r.namespace, r.subsystem, r.metricNameFilter, registry)
-		mr = &metricsRegistry{metrics, registry}
+		metrics := gen.NewMetrics(namespace, subsystem, r.metricNameFilter, registry)
+		if len(r.byteSizeBuckets) > 0 && registry.Unregister(metrics.ByteSizeBytes) {
+			metrics.ByteSizeBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "byte_size_bytes",
+				Help:      "Histogram of the per-second byte totals of selected real-time fields in each datacenter. Only observed for fields configured as byte size histograms.",
+				Buckets:   r.byteSizeBuckets,
+			}, []string{"service_id", "service_name", "datacenter", "field"})
+			registry.MustRegister(metrics.ByteSizeBytes)
+		}
+		if counters, ok := r.restored[serviceID]; ok {
+			restoreCounters(metrics, counters)
+			delete(r.restored, serviceID)
+		}
+		mr = &metricsRegistry{metrics, registry, namespace, subsystem}
 		r.byServiceID[serviceID] = mr // TODO(pb): at some point, expire and remove?
 	}
 
 	return mr.metrics
 }
 
+// CheckLabels returns an error if any per-service metric would have more than
+// max labels per series, counting both the labels of the metric itself, per
+// gen.MetricLabels, and those added by the registry, e.g. via
+// WithEnvironmentLabel. It also returns an error if the labels of any metric
+// aren't known. It's meant to be called at startup, so a misconfiguration fails
+// fast rather than exploding the label set of every series.
+func (r *Registry) CheckLabels(max int) error {
+	var added int
+	if r.environment != nil {
+		added++
+	}
+	if r.pairs != nil {
+		added += 2
+	}
+
+	names := make([]string, 0, len(gen.MetricLabels))
+	for name := range gen.MetricLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var checked int
+	for _, name := range names {
+		fqName := prometheus.BuildFQName(r.namespace, r.subsystem, name)
+		if !r.metricNameFilter.Permit(fqName) {
+			continue
+		}
+		checked++
+		if n := len(gen.MetricLabels[name]) + added; n > max {
+			return fmt.Errorf("metric %s would have %d labels per series, more than the maximum of %d", fqName, n, max)
+		}
+	}
+
+	// Every registered metric must have been checked, or its labels are unknown.
+	descs := &descRegisterer{}
+	gen.NewMetrics(r.namespace, r.subsystem, r.metricNameFilter, descs)
+	if registered := len(descs.descs); checked != registered {
+		return fmt.Errorf("labels are known for %d of %d metrics, so their labels per series can't be checked", checked, registered)
+	}
+
+	return nil
+}
+
+// FilteredMetrics returns the number of per-service metric families which the
+// metric name filter keeps from being registered.
+func (r *Registry) FilteredMetrics() int {
+	all, kept := &descRegisterer{}, &descRegisterer{}
+	gen.NewMetrics(r.namespace, r.subsystem, filter.Filter{}, all)
+	gen.NewMetrics(r.namespace, r.subsystem, r.metricNameFilter, kept)
+	return len(all.descs) - len(kept.descs)
+}
+
+// descRegisterer is a prometheus.Registerer which records the descriptors of
+// the collectors registered with it, without collecting anything.
+type descRegisterer struct {
+	descs []*prometheus.Desc
+}
+
+func (r *descRegisterer) Register(c prometheus.Collector) error {
+	ch := make(chan *prometheus.Desc)
+	go func() { c.Describe(ch); close(ch) }()
+	for d := range ch {
+		r.descs = append(r.descs, d)
+	}
+	return nil
+}
+
+func (r *descRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		r.Register(c)
+	}
+}
+
+func (r *descRegisterer) Unregister(prometheus.Collector) bool { return false }
+
 func (r *Registry) handleIndex(w http.ResponseWriter, req *http.Request) {
 	type link struct {
 		Path string `json:"path"`
@@ -130,12 +504,28 @@ func (r *Registry) handleIndex(w http.ResponseWriter, req *http.Request) {
 }
 
 func (r *Registry) handleServiceDiscovery(w http.ResponseWriter, req *http.Request) {
-	targets := r.serviceIDs()
+	type targetGroup struct {
+		Targets []string          `json:"targets"`
+		Labels  map[string]string `json:"labels,omitempty"`
+	}
 
-	response := []struct {
-		Targets []string `json:"targets"`
-	}{
-		{Targets: targets},
+	var response []targetGroup
+	if r.regions == nil {
+		response = []targetGroup{{Targets: r.serviceIDs()}}
+	} else {
+		byRegion := r.serviceIDsByRegion()
+		regions := make([]string, 0, len(byRegion))
+		for region := range byRegion {
+			regions = append(regions, region)
+		}
+		sort.Strings(regions)
+		for _, region := range regions {
+			group := targetGroup{Targets: byRegion[region]}
+			if region != "" {
+				group.Labels = map[string]string{"region": region}
+			}
+			response = append(response, group)
+		}
 	}
 
 	buf, err := json.MarshalIndent(response, "", "    ")
@@ -148,15 +538,227 @@ func (r *Registry) handleServiceDiscovery(w http.ResponseWriter, req *http.Reque
 	w.Write(buf)
 }
 
+// Promote switches a registry in standby mode to active, so its metrics are
+// served. It's a no-op for an active registry.
+func (r *Registry) Promote() {
+	atomic.StoreInt32(&r.standby, 0)
+}
+
+// Standby returns true if the registry is in standby mode.
+func (r *Registry) Standby() bool {
+	return atomic.LoadInt32(&r.standby) == 1
+}
+
+func (r *Registry) handlePromote(w http.ResponseWriter, req *http.Request) {
+	r.Promote()
+	w.Header().Set("content-type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "active")
+}
+
+// SetMaintenance marks a maintenance window until the given time, during which
+// the maintenance_active gauge is 1, so dashboards and alerts can be silenced.
+// The window clears itself once the time passes. A time in the past clears any
+// current window.
+func (r *Registry) SetMaintenance(until time.Time) {
+	atomic.StoreInt64(&r.maintenanceUntil, until.Unix())
+}
+
+// MaintenanceActive returns true during a maintenance window.
+func (r *Registry) MaintenanceActive() bool {
+	return r.now().Unix() < atomic.LoadInt64(&r.maintenanceUntil)
+}
+
+func (r *Registry) handleMaintenance(w http.ResponseWriter, req *http.Request) {
+	until, err := strconv.ParseInt(req.URL.Query().Get("until"), 10, 64)
+	if err != nil {
+		http.Error(w, "until must be a Unix timestamp", http.StatusBadRequest)
+		return
+	}
+
+	r.SetMaintenance(time.Unix(until, 0))
+	w.Header().Set("content-type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "maintenance until %s\n", time.Unix(until, 0).UTC().Format(time.RFC3339))
+}
+
+// openMetricsVersion1 is the version of the OpenMetrics specification that
+// scrapers commonly ask for by number. It's accepted as a format version, and
+// served as the OpenMetrics version the client library writes.
+const openMetricsVersion1 = "1.0.0"
+
 func (r *Registry) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	if r.Standby() {
+		http.Error(w, "standby: metrics are served once promoted via POST /admin/promote", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.scrapeCache != nil {
+		r.scrapeCache.serve(w, req, r.now(), r.serveMetrics)
+		return
+	}
+
+	r.serveMetrics(w, req)
+}
+
+// serveMetrics gathers and renders the metrics for a scrape.
+func (r *Registry) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if r.scrapes != nil {
+		select {
+		case r.scrapes <- struct{}{}:
+			defer func() { <-r.scrapes }()
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent scrapes", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	var opts promhttp.HandlerOpts
+	if version := req.URL.Query().Get("version"); version != "" {
+		// An explicit format version overrides content negotiation.
+		req = req.Clone(req.Context())
+		switch version {
+		case expfmt.TextVersion:
+			req.Header.Set("Accept", "text/plain; version="+expfmt.TextVersion)
+		case expfmt.OpenMetricsVersion, openMetricsVersion1:
+			req.Header.Set("Accept", expfmt.OpenMetricsType+"; version="+expfmt.OpenMetricsVersion)
+			opts.EnableOpenMetrics = true
+		default:
+			http.Error(w, fmt.Sprintf("unsupported format version %q (supported: %s for text, %s or %s for OpenMetrics)", version, expfmt.TextVersion, openMetricsVersion1, expfmt.OpenMetricsVersion), http.StatusBadRequest)
+			return
+		}
+	}
+
 	var (
 		target    = req.URL.Query().Get("target") // empty target string means all targets
-		gatherers = prometheus.Gatherers(append(r.defaultGatherers, r.servicesGathererFor(target)))
-		handler   = promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+		name      = req.URL.Query().Get("selector")
+		gatherers prometheus.Gatherer
 	)
+	switch {
+	case name == "" && target == "":
+		gatherers = r.gatherersFor(allowTargets())
+	case name == "":
+		gatherers = r.gatherersFor(allowTargets(target))
+	case target != "":
+		http.Error(w, "target and selector can't be combined", http.StatusBadRequest)
+		return
+	default:
+		selector, ok := r.selectors[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown selector %q", name), http.StatusNotFound)
+			return
+		}
+		gatherers = datacenterGatherer{r.gatherersFor(allowTargets(selector.Targets...)), selector.Datacenters}
+	}
+
+	var g prometheus.Gatherer = r.withSeriesCounts(gatherers)
+	if r.labelOrder != nil {
+		g = labelOrderGatherer{g, r.labelOrder}
+	}
+
+	handler := promhttp.HandlerFor(g, opts)
 	handler.ServeHTTP(w, req)
 }
 
+// scrapeCache holds recently rendered `/metrics` responses, per WithScrapeCache.
+type scrapeCache struct {
+	ttl     time.Duration
+	mtx     sync.Mutex
+	entries map[string]*scrapeEntry
+}
+
+// scrapeEntry is a cached response. Its mutex is held while the response is
+// rendered, so concurrent scrapes wait for it, rather than gathering again.
+type scrapeEntry struct {
+	mtx     sync.Mutex
+	expires time.Time
+	header  http.Header
+	body    []byte
+}
+
+// serve writes the cached response for the request, if it hasn't expired, or
+// else renders a new one with next, and caches it if it succeeds.
+func (c *scrapeCache) serve(w http.ResponseWriter, req *http.Request, now time.Time, next http.HandlerFunc) {
+	key := strings.Join([]string{req.URL.RawQuery, req.Header.Get("Accept"), req.Header.Get("Accept-Encoding")}, "\n")
+
+	c.mtx.Lock()
+	for k, e := range c.entries {
+		if k != key && e.expired(now) {
+			delete(c.entries, k)
+		}
+	}
+	e, ok := c.entries[key]
+	if !ok {
+		e = &scrapeEntry{}
+		c.entries[key] = e
+	}
+	c.mtx.Unlock()
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.expired(now) {
+		rec := &responseBuffer{header: http.Header{}, code: http.StatusOK}
+		next(rec, req)
+		if rec.code != http.StatusOK {
+			rec.writeTo(w)
+			return
+		}
+		e.header, e.body, e.expires = rec.header, rec.body.Bytes(), now.Add(c.ttl)
+	}
+
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	w.Write(e.body)
+}
+
+func (e *scrapeEntry) expired(now time.Time) bool {
+	return !now.Before(e.expires)
+}
+
+// responseBuffer is an http.ResponseWriter which keeps the response in memory.
+type responseBuffer struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header         { return b.header }
+func (b *responseBuffer) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *responseBuffer) WriteHeader(code int)        { b.code = code }
+
+func (b *responseBuffer) writeTo(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(b.code)
+	w.Write(b.body.Bytes())
+}
+
+// Gather implements prometheus.Gatherer, yielding the same metrics as a scrape
+// of the `/metrics` endpoint for all services. This allows programs which embed
+// the registry to read current metric values without going through HTTP.
+//
+// Gather is safe to call concurrently with itself and with writers updating
+// the metrics. The returned metric families are a copy, owned by the caller.
+// Each series is read atomically, but series are read one after another, so
+// writes concurrent with Gather may be reflected in some series and not others.
+//
+// In standby mode, Gather yields no metrics.
+func (r *Registry) Gather() ([]*dto.MetricFamily, error) {
+	if r.Standby() {
+		return nil, nil
+	}
+	return r.withSeriesCounts(r.gatherersFor(allowTargets())).Gather()
+}
+
+func (r *Registry) gatherersFor(allow func(serviceID string) bool) prometheus.Gatherers {
+	gatherers := make(prometheus.Gatherers, 0, len(r.defaultGatherers)+2)
+	gatherers = append(gatherers, r.builtin)
+	gatherers = append(gatherers, r.defaultGatherers...)
+	return append(gatherers, r.servicesGathererFor(allow))
+}
+
 func (r *Registry) serviceIDs() []string {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
@@ -171,28 +773,460 @@ func (r *Registry) serviceIDs() []string {
 	return serviceIDs
 }
 
-func (r *Registry) servicesGathererFor(target string) prometheus.Gatherer {
-	var allow func(candidate string) bool
-	switch target {
-	case "":
-		allow = func(candidate string) bool { return true }
-	default:
-		allow = func(candidate string) bool { return candidate == target }
+// serviceIDsByRegion returns the sorted service IDs in each region, per
+// WithRegionLabels. Services without a known region are under the empty string.
+func (r *Registry) serviceIDsByRegion() map[string][]string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	byRegion := map[string][]string{}
+	for serviceID, mr := range r.byServiceID {
+		region, _ := r.regions.DatacenterGroup(topDatacenter(mr.metrics.RequestsTotal))
+		byRegion[region] = append(byRegion[region], serviceID)
+	}
+	for _, serviceIDs := range byRegion {
+		sort.Strings(serviceIDs)
+	}
+	return byRegion
+}
+
+// topDatacenter returns the datacenter label value with the greatest sum of
+// the counters yielded by the collector, or the empty string if every sum is
+// zero. Ties are broken by the datacenter label value.
+func topDatacenter(c prometheus.Collector) string {
+	ch := make(chan prometheus.Metric)
+	go func() { c.Collect(ch); close(ch) }()
+
+	sums := map[string]float64{}
+	for m := range ch {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil || metric.Counter == nil {
+			continue
+		}
+		for _, pair := range metric.GetLabel() {
+			if pair.GetName() == "datacenter" {
+				sums[pair.GetValue()] += metric.Counter.GetValue()
+			}
+		}
 	}
 
+	var (
+		top string
+		max float64
+	)
+	for datacenter, sum := range sums {
+		if sum > max || (sum == max && sum > 0 && datacenter < top) {
+			top, max = datacenter, sum
+		}
+	}
+	return top
+}
+
+// allowTargets returns a predicate which allows only the given service IDs, or
+// every service ID if none are given.
+func allowTargets(targets ...string) func(serviceID string) bool {
+	if len(targets) == 0 {
+		return func(string) bool { return true }
+	}
+	allowed := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		allowed[target] = true
+	}
+	return func(serviceID string) bool { return allowed[serviceID] }
+}
+
+func (r *Registry) servicesGathererFor(allow func(serviceID string) bool) prometheus.Gatherer {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
 
-	var gatherers prometheus.Gatherers
+	var (
+		gatherers prometheus.Gatherers
+		top       = r.topServicesWithLock()
+		other     = map[string]float64{prometheus.BuildFQName(r.namespace, r.subsystem, "other_requests"): 0}
+	)
 	for serviceID, mr := range r.byServiceID {
-		if allow(serviceID) {
-			gatherers = append(gatherers, mr.registry)
+		if !allow(serviceID) {
+			continue
+		}
+		if top != nil && !top[serviceID] {
+			other[prometheus.BuildFQName(mr.namespace, mr.subsystem, "other_requests")] += counterSum(mr.metrics.RequestsTotal)
+			continue
+		}
+		var g prometheus.Gatherer = mr.registry
+		if r.environment != nil {
+			g = environmentGatherer{g, r.environment}
+		}
+		if r.pairs != nil {
+			g = pairGatherer{g, r.pairs}
+		}
+		gatherers = append(gatherers, g)
+	}
+
+	if top != nil && r.top.other {
+		for name, requests := range other {
+			if r.metricNameFilter.Permit(name) {
+				gatherers = append(gatherers, otherGatherer{name, requests})
+			}
 		}
 	}
 
 	return gatherers
 }
 
+// topServices tracks the services with the most requests, per WithTopServices.
+type topServices struct {
+	n        int
+	warmup   time.Duration
+	interval time.Duration
+	other    bool
+
+	ranked   map[string]bool    // nil until the first ranking
+	rankedAt time.Time          // of the last ranking
+	last     map[string]float64 // requests per service as of the last ranking
+}
+
+// topServicesWithLock returns the set of services whose metrics should be
+// served, re-ranking the services if the interval has passed, or nil if all
+// services should be served. The caller must hold r.mtx.
+func (r *Registry) topServicesWithLock() map[string]bool {
+	if r.top == nil {
+		return nil
+	}
+
+	now := r.now()
+	if now.Sub(r.created) < r.top.warmup {
+		return nil
+	}
+	if r.top.ranked != nil && now.Sub(r.top.rankedAt) < r.top.interval {
+		return r.top.ranked
+	}
+
+	type volume struct {
+		serviceID string
+		requests  float64
+	}
+	volumes := make([]volume, 0, len(r.byServiceID))
+	for serviceID, mr := range r.byServiceID {
+		total := counterSum(mr.metrics.RequestsTotal)
+		volumes = append(volumes, volume{serviceID, total - r.top.last[serviceID]})
+		r.top.last[serviceID] = total
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		if volumes[i].requests != volumes[j].requests {
+			return volumes[i].requests > volumes[j].requests
+		}
+		return volumes[i].serviceID < volumes[j].serviceID
+	})
+
+	r.top.ranked = map[string]bool{}
+	for i := 0; i < len(volumes) && i < r.top.n; i++ {
+		r.top.ranked[volumes[i].serviceID] = true
+	}
+	r.top.rankedAt = now
+	return r.top.ranked
+}
+
+// counterSum returns the sum of every counter yielded by the collector.
+func counterSum(c prometheus.Collector) float64 {
+	ch := make(chan prometheus.Metric)
+	go func() { c.Collect(ch); close(ch) }()
+
+	var sum float64
+	for m := range ch {
+		var metric dto.Metric
+		if err := m.Write(&metric); err == nil && metric.Counter != nil {
+			sum += metric.Counter.GetValue()
+		}
+	}
+	return sum
+}
+
+// otherGatherer yields the summed requests of the services which aren't
+// served due to WithTopServices, as a gauge.
+type otherGatherer struct {
+	name     string
+	requests float64
+}
+
+func (g otherGatherer) Gather() ([]*dto.MetricFamily, error) {
+	var (
+		name  = g.name
+		help  = "Summed requests of the services whose metrics aren't served, because they aren't among the top services by requests. Not a counter, as services move in and out of the top services."
+		typ   = dto.MetricType_GAUGE
+		value = g.requests
+	)
+	return []*dto.MetricFamily{{
+		Name:   &name,
+		Help:   &help,
+		Type:   &typ,
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: &value}}},
+	}}, nil
+}
+
+// withSeriesCounts wraps the gatherer so that it also yields the number of
+// series in each metric family it gathers.
+func (r *Registry) withSeriesCounts(g prometheus.Gatherer) prometheus.Gatherer {
+	return seriesGatherer{g, prometheus.BuildFQName(r.namespace, "exporter", "series")}
+}
+
+// seriesGatherer adds a gauge family to the metrics gathered from the wrapped
+// gatherer, with the number of series in each of those metric families. That
+// gives early warning of cardinality regressions, at no extra cost to gather.
+type seriesGatherer struct {
+	prometheus.Gatherer
+	name string
+}
+
+func (g seriesGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	if len(families) == 0 {
+		return families, err
+	}
+
+	var (
+		name   = g.name
+		help   = "Number of series in each metric family, as of this gather."
+		typ    = dto.MetricType_GAUGE
+		label  = "metric_family"
+		series = &dto.MetricFamily{Name: &name, Help: &help, Type: &typ}
+	)
+	for _, family := range families {
+		var (
+			familyName = family.GetName()
+			count      = float64(len(family.GetMetric()))
+		)
+		series.Metric = append(series.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: &label, Value: &familyName}},
+			Gauge: &dto.Gauge{Value: &count},
+		})
+	}
+
+	families = append(families, series)
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families, err
+}
+
+// labelOrderGatherer reorders the labels of each metric gathered from the
+// wrapped gatherer. Labels with a rank come first, by rank, and the rest keep
+// their order, which is alphabetical, after them.
+type labelOrderGatherer struct {
+	prometheus.Gatherer
+	rank map[string]int
+}
+
+func (g labelOrderGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := metric.Label
+			sort.SliceStable(labels, func(i, j int) bool {
+				return g.rankOf(labels[i].GetName()) < g.rankOf(labels[j].GetName())
+			})
+		}
+	}
+	return families, err
+}
+
+func (g labelOrderGatherer) rankOf(name string) int {
+	if rank, ok := g.rank[name]; ok {
+		return rank
+	}
+	return len(g.rank)
+}
+
+// datacenterGatherer drops every metric gathered from the wrapped gatherer with
+// a datacenter label that doesn't pass the filter.
+type datacenterGatherer struct {
+	prometheus.Gatherer
+	datacenters filter.Filter
+}
+
+func (g datacenterGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	kept := families[:0]
+	for _, family := range families {
+		metrics := family.Metric[:0]
+		for _, metric := range family.GetMetric() {
+			if g.permit(metric) {
+				metrics = append(metrics, metric)
+			}
+		}
+		if family.Metric = metrics; len(metrics) > 0 {
+			kept = append(kept, family)
+		}
+	}
+	return kept, err
+}
+
+func (g datacenterGatherer) permit(metric *dto.Metric) bool {
+	for _, pair := range metric.GetLabel() {
+		if pair.GetName() == "datacenter" {
+			return g.datacenters.Permit(pair.GetValue())
+		}
+	}
+	return true
+}
+
+// heartbeatCollector yields metrics which prove the exporter is alive and
+// serving metrics, independent of any data from Fastly. They're collected with
+// every gather, for all targets.
+type heartbeatCollector struct {
+	up             *prometheus.Desc
+	lastCollection *prometheus.Desc
+	now            func() time.Time
+}
+
+func newHeartbeatCollector(namespace string, now func() time.Time) *heartbeatCollector {
+	return &heartbeatCollector{
+		now:            now,
+		up:             prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "up"), "Always 1 while the exporter is serving metrics.", nil, nil),
+		lastCollection: prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "last_collection_timestamp"), "Unix timestamp of the most recent collection of metrics, i.e. this one.", nil, nil),
+	}
+}
+
+func (c *heartbeatCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.lastCollection
+}
+
+func (c *heartbeatCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 1)
+	ch <- prometheus.MustNewConstMetric(c.lastCollection, prometheus.GaugeValue, float64(c.now().UnixNano())/1e9)
+}
+
+// maintenanceCollector yields a gauge which is 1 during a maintenance window,
+// and 0 otherwise. It's collected with every gather, for all targets.
+type maintenanceCollector struct {
+	active *prometheus.Desc
+	during func() bool
+}
+
+func newMaintenanceCollector(namespace string, during func() bool) *maintenanceCollector {
+	return &maintenanceCollector{
+		active: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "maintenance_active"), "1 during a maintenance window set via POST /admin/maintenance, 0 otherwise.", nil, nil),
+		during: during,
+	}
+}
+
+func (c *maintenanceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.active
+}
+
+func (c *maintenanceCollector) Collect(ch chan<- prometheus.Metric) {
+	var value float64
+	if c.during() {
+		value = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, value)
+}
+
+// environmentLabel derives an environment from a service name.
+type environmentLabel struct {
+	re       *regexp.Regexp
+	fallback string
+}
+
+func (e *environmentLabel) from(serviceName string) string {
+	if m := e.re.FindStringSubmatch(serviceName); len(m) > 1 {
+		return m[1]
+	}
+	return e.fallback
+}
+
+// environmentGatherer adds an environment label to every metric gathered from
+// the wrapped gatherer that has a service_name label.
+type environmentGatherer struct {
+	prometheus.Gatherer
+	environment *environmentLabel
+}
+
+func (g environmentGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() != "service_name" {
+					continue
+				}
+				var (
+					name  = "environment"
+					value = g.environment.from(pair.GetValue())
+				)
+				metric.Label = append(metric.Label, &dto.LabelPair{Name: &name, Value: &value})
+				sort.Slice(metric.Label, func(i, j int) bool { return metric.Label[i].GetName() < metric.Label[j].GetName() })
+				break
+			}
+		}
+	}
+	return families, err
+}
+
+// pairLabels derives a canonical service and an env from a service name.
+type pairLabels struct {
+	re      *regexp.Regexp
+	service int // index of the capture group, or -1
+	env     int // index of the capture group, or -1
+}
+
+func newPairLabels(re *regexp.Regexp) *pairLabels {
+	p := &pairLabels{re: re, service: -1, env: -1}
+	for i, name := range re.SubexpNames() {
+		switch name {
+		case "service":
+			p.service = i
+		case "env":
+			p.env = i
+		}
+	}
+	return p
+}
+
+func (p *pairLabels) from(serviceName string) (service, env string) {
+	m := p.re.FindStringSubmatch(serviceName)
+	if m == nil {
+		return serviceName, ""
+	}
+	service = serviceName
+	if p.service >= 0 && m[p.service] != "" {
+		service = m[p.service]
+	}
+	if p.env >= 0 {
+		env = m[p.env]
+	}
+	return service, env
+}
+
+// pairGatherer adds service and env labels to every metric gathered from the
+// wrapped gatherer that has a service_name label.
+type pairGatherer struct {
+	prometheus.Gatherer
+	pairs *pairLabels
+}
+
+func (g pairGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() != "service_name" {
+					continue
+				}
+				var (
+					serviceName, envName = "service", "env"
+					service, env         = g.pairs.from(pair.GetValue())
+				)
+				metric.Label = append(metric.Label,
+					&dto.LabelPair{Name: &serviceName, Value: &service},
+					&dto.LabelPair{Name: &envName, Value: &env},
+				)
+				sort.Slice(metric.Label, func(i, j int) bool { return metric.Label[i].GetName() < metric.Label[j].GetName() })
+				break
+			}
+		}
+	}
+	return families, err
+}
+
 var indexTemplate = template.Must(template.New("").Parse(`
 <html>
 <head>
@@ -1,26 +1,41 @@
 package prom_test
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/fastly/fastly-exporter/pkg/filter"
 	"github.com/fastly/fastly-exporter/pkg/prom"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestRegistryEndpoints(t *testing.T) {
 	t.Parallel()
 
+	var elsewhere filter.Filter
+	elsewhere.Block("^NYC$")
+
 	var (
 		version          = "dev"
 		namespace        = "fastly"
 		subsystem        = "rt"
 		metricNameFilter = filter.Filter{}
-		registry         = prom.NewRegistry(version, namespace, subsystem, metricNameFilter)
+		selectors        = []prom.RegistryOption{
+			prom.WithSelector("one", prom.Selector{Targets: []string{"AAA"}}),
+			prom.WithSelector("elsewhere", prom.Selector{Datacenters: elsewhere}),
+		}
+		registry = prom.NewRegistryWithOptions(version, namespace, subsystem, metricNameFilter, selectors...)
 	)
 
 	registry.MetricsFor("AAA").RequestsTotal.With(prometheus.Labels{
@@ -102,6 +117,46 @@ func TestRegistryEndpoints(t *testing.T) {
 		expect(strings.Contains(body, "BBB"), "BBB missing")
 	})
 
+	t.Run("sd regions", func(t *testing.T) {
+		regional := prom.NewRegistryWithOptions(version, namespace, subsystem, metricNameFilter, prom.WithRegionLabels(datacenterGroups{"NYC": "North America", "LHR": "Europe"}))
+		for _, s := range []struct {
+			serviceID, datacenter string
+			requests              float64
+		}{
+			{"AAA", "NYC", 1},
+			{"BBB", "NYC", 1},
+			{"BBB", "LHR", 3},
+			{"CCC", "LHR", 2},
+		} {
+			regional.MetricsFor(s.serviceID).RequestsTotal.With(prometheus.Labels{
+				"service_id": s.serviceID, "service_name": s.serviceID, "datacenter": s.datacenter,
+			}).Add(s.requests)
+		}
+		regional.MetricsFor("DDD") // no traffic yet
+
+		rec := httptest.NewRecorder()
+		regional.ServeHTTP(rec, httptest.NewRequest("GET", "/sd", nil))
+
+		var have []struct {
+			Targets []string          `json:"targets"`
+			Labels  map[string]string `json:"labels"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &have); err != nil {
+			t.Fatal(err)
+		}
+		want := []struct {
+			Targets []string          `json:"targets"`
+			Labels  map[string]string `json:"labels"`
+		}{
+			{Targets: []string{"DDD"}},
+			{Targets: []string{"BBB", "CCC"}, Labels: map[string]string{"region": "Europe"}},
+			{Targets: []string{"AAA"}, Labels: map[string]string{"region": "North America"}},
+		}
+		if !reflect.DeepEqual(want, have) {
+			t.Errorf("\nwant %+v\nhave %+v", want, have)
+		}
+	})
+
 	t.Run("metrics", func(t *testing.T) {
 		body := get("/metrics")
 		want, dont := []string{
@@ -139,4 +194,800 @@ func TestRegistryEndpoints(t *testing.T) {
 		}
 		checkMetrics(body, want, dont)
 	})
+
+	t.Run("metrics?selector=one", func(t *testing.T) {
+		body := get("/metrics?selector=one")
+		want, dont := []string{
+			`fastly_rt_requests_total{datacenter="NYC",service_id="AAA",service_name="Service One"} 1`,
+		}, []string{
+			`fastly_rt_requests_total{datacenter="NYC",service_id="BBB",service_name="Service Two"} 2`,
+		}
+		checkMetrics(body, want, dont)
+	})
+
+	t.Run("metrics?selector=elsewhere", func(t *testing.T) {
+		body := get("/metrics?selector=elsewhere")
+		want, dont := []string{
+			`fastly_exporter_up 1`,
+		}, []string{
+			`fastly_rt_requests_total{datacenter="NYC",service_id="AAA",service_name="Service One"} 1`,
+			`fastly_rt_requests_total{datacenter="NYC",service_id="BBB",service_name="Service Two"} 2`,
+		}
+		checkMetrics(body, want, dont)
+	})
+
+	t.Run("metrics series", func(t *testing.T) {
+		body := get("/metrics")
+		want, dont := []string{
+			`fastly_exporter_series{metric_family="fastly_rt_requests_total"} 2`,
+		}, []string{}
+		checkMetrics(body, want, dont)
+	})
+
+	t.Run("metrics heartbeat", func(t *testing.T) {
+		fresh := httptest.NewServer(prom.NewRegistry(version, namespace, subsystem, metricNameFilter))
+		defer fresh.Close()
+
+		resp, err := http.Get(fresh.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		buf, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, dont := []string{
+			`fastly_exporter_up 1`,
+			`fastly_exporter_last_collection_timestamp `,
+		}, []string{
+			`fastly_rt_`,
+		}
+		checkMetrics(string(buf), want, dont)
+	})
+
+	t.Run("metrics label order", func(t *testing.T) {
+		ordered := prom.NewRegistryWithOptions(version, namespace, subsystem, metricNameFilter, prom.WithLabelOrder("service_name", "service_id"))
+		ordered.MetricsFor("AAA").RequestsTotal.With(prometheus.Labels{
+			"service_id": "AAA", "service_name": "Service One", "datacenter": "NYC",
+		}).Add(1)
+
+		rec := httptest.NewRecorder()
+		ordered.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+		want, dont := []string{
+			`fastly_rt_requests_total{service_name="Service One",service_id="AAA",datacenter="NYC"} 1`,
+		}, []string{
+			`fastly_rt_requests_total{datacenter="NYC",service_id="AAA",service_name="Service One"} 1`,
+		}
+		checkMetrics(rec.Body.String(), want, dont)
+	})
+
+	t.Run("default gatherers", func(t *testing.T) {
+		var (
+			gathers  = &countingGatherer{}
+			embedded = prom.NewRegistry(version, namespace, subsystem, metricNameFilter, gathers)
+		)
+
+		embedded.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+		if want, have := 1, gathers.count(); want != have {
+			t.Errorf("gathers: want %d, have %d", want, have)
+		}
+	})
+
+	t.Run("metrics scrape cache", func(t *testing.T) {
+		var (
+			gathers = &countingGatherer{}
+			options = []prom.RegistryOption{prom.WithDefaultGatherers(gathers), prom.WithScrapeCache(time.Minute)}
+			cached  = prom.NewRegistryWithOptions(version, namespace, subsystem, metricNameFilter, options...)
+			scrape  = func(path string) string {
+				rec := httptest.NewRecorder()
+				cached.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+				return rec.Body.String()
+			}
+		)
+		cached.MetricsFor("AAA").RequestsTotal.With(prometheus.Labels{
+			"service_id": "AAA", "service_name": "Service One", "datacenter": "NYC",
+		}).Add(1)
+
+		first := scrape("/metrics")
+		cached.MetricsFor("AAA").RequestsTotal.With(prometheus.Labels{
+			"service_id": "AAA", "service_name": "Service One", "datacenter": "NYC",
+		}).Add(1)
+		second := scrape("/metrics")
+
+		if want, have := 1, gathers.count(); want != have {
+			t.Errorf("gathers: want %d, have %d", want, have)
+		}
+		if first != second {
+			t.Errorf("second scrape wasn't served from cache")
+		}
+		checkMetrics(second, []string{`fastly_rt_requests_total{datacenter="NYC",service_id="AAA",service_name="Service One"} 1`}, nil)
+
+		scrape("/metrics?target=AAA")
+		if want, have := 2, gathers.count(); want != have {
+			t.Errorf("gathers after scrape with another query: want %d, have %d", want, have)
+		}
+	})
+
+	for _, testcase := range []struct {
+		path        string
+		accept      string
+		code        int
+		contentType string
+	}{
+		{"/metrics", "", http.StatusOK, "text/plain; version=0.0.4; charset=utf-8"},
+		{"/metrics?version=0.0.4", "application/openmetrics-text; version=0.0.1", http.StatusOK, "text/plain; version=0.0.4; charset=utf-8"},
+		{"/metrics?version=0.0.1", "", http.StatusOK, "application/openmetrics-text; version=0.0.1; charset=utf-8"},
+		{"/metrics?version=1.0.0", "", http.StatusOK, "application/openmetrics-text; version=0.0.1; charset=utf-8"},
+		{"/metrics?version=9.9.9", "", http.StatusBadRequest, "text/plain; charset=utf-8"},
+		{"/metrics?selector=unknown", "", http.StatusNotFound, "text/plain; charset=utf-8"},
+		{"/metrics?selector=one&target=AAA", "", http.StatusBadRequest, "text/plain; charset=utf-8"},
+	} {
+		testcase := testcase
+		t.Run(testcase.path, func(t *testing.T) {
+			req, err := http.NewRequest("GET", server.URL+testcase.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if testcase.accept != "" {
+				req.Header.Set("Accept", testcase.accept)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if want, have := testcase.code, resp.StatusCode; want != have {
+				t.Errorf("code: want %d, have %d", want, have)
+			}
+			if want, have := testcase.contentType, resp.Header.Get("Content-Type"); want != have {
+				t.Errorf("Content-Type: want %q, have %q", want, have)
+			}
+		})
+	}
+}
+
+func TestRegistryServiceNamespace(t *testing.T) {
+	t.Parallel()
+
+	var (
+		option   = prom.WithServiceNamespace("legacy", "AAA")
+		registry = prom.NewRegistryWithOptions("dev", "fastly", "rt", filter.Filter{}, option)
+	)
+
+	registry.MetricsFor("AAA").RequestsTotal.With(prometheus.Labels{
+		"service_id": "AAA", "service_name": "Service One", "datacenter": "NYC",
+	}).Add(1)
+
+	registry.MetricsFor("BBB").RequestsTotal.With(prometheus.Labels{
+		"service_id": "BBB", "service_name": "Service Two", "datacenter": "NYC",
+	}).Add(2)
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`legacy_rt_requests_total{datacenter="NYC",service_id="AAA",service_name="Service One"} 1`,
+		`fastly_rt_requests_total{datacenter="NYC",service_id="BBB",service_name="Service Two"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing: %s", want)
+		}
+	}
+
+	for _, dont := range []string{
+		`fastly_rt_requests_total{datacenter="NYC",service_id="AAA"`,
+		`legacy_rt_requests_total{datacenter="NYC",service_id="BBB"`,
+	} {
+		if strings.Contains(body, dont) {
+			t.Errorf("extra: %s", dont)
+		}
+	}
+}
+
+func TestRegistryServiceTypeSubsystem(t *testing.T) {
+	t.Parallel()
+
+	var (
+		types    = serviceTypes{"AAA": "vcl", "BBB": "wasm"}
+		option   = prom.WithServiceTypeSubsystem(types, "wasm", "compute")
+		registry = prom.NewRegistryWithOptions("dev", "fastly", "rt", filter.Filter{}, option)
+	)
+
+	for id, n := range map[string]float64{"AAA": 1, "BBB": 2, "CCC": 3} {
+		registry.MetricsFor(id).RequestsTotal.With(prometheus.Labels{
+			"service_id": id, "service_name": id, "datacenter": "NYC",
+		}).Add(n)
+	}
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`fastly_rt_requests_total{datacenter="NYC",service_id="AAA",service_name="AAA"} 1`,
+		`fastly_compute_requests_total{datacenter="NYC",service_id="BBB",service_name="BBB"} 2`,
+		`fastly_rt_requests_total{datacenter="NYC",service_id="CCC",service_name="CCC"} 3`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing: %s", want)
+		}
+	}
+
+	if dont := `fastly_rt_requests_total{datacenter="NYC",service_id="BBB"`; strings.Contains(body, dont) {
+		t.Errorf("extra: %s", dont)
+	}
+}
+
+type countingGatherer struct{ n int64 }
+
+func (g *countingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	atomic.AddInt64(&g.n, 1)
+	return nil, nil
+}
+
+func (g *countingGatherer) count() int { return int(atomic.LoadInt64(&g.n)) }
+
+type datacenterGroups map[string]string
+
+func (g datacenterGroups) DatacenterGroup(code string) (string, bool) {
+	group, ok := g[code]
+	return group, ok
+}
+
+type serviceTypes map[string]string
+
+func (t serviceTypes) ServiceType(id string) (string, bool) {
+	serviceType, ok := t[id]
+	return serviceType, ok
+}
+
+func TestRegistryEnvironmentLabel(t *testing.T) {
+	t.Parallel()
+
+	var (
+		option   = prom.WithEnvironmentLabel(regexp.MustCompile(`^(prod|staging)-`), "none")
+		registry = prom.NewRegistryWithOptions("dev", "fastly", "rt", filter.Filter{}, option)
+	)
+
+	registry.MetricsFor("AAA").RequestsTotal.With(prometheus.Labels{
+		"service_id": "AAA", "service_name": "prod-api", "datacenter": "NYC",
+	}).Add(1)
+
+	registry.MetricsFor("BBB").RequestsTotal.With(prometheus.Labels{
+		"service_id": "BBB", "service_name": "sandbox", "datacenter": "NYC",
+	}).Add(2)
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`fastly_rt_requests_total{datacenter="NYC",environment="prod",service_id="AAA",service_name="prod-api"} 1`,
+		`fastly_rt_requests_total{datacenter="NYC",environment="none",service_id="BBB",service_name="sandbox"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing: %s", want)
+		}
+	}
+}
+
+func TestRegistryServicePairLabels(t *testing.T) {
+	t.Parallel()
+
+	var (
+		option   = prom.WithServicePairLabels(regexp.MustCompile(`^(?P<service>.+)-(?P<env>prod|staging)$`))
+		registry = prom.NewRegistryWithOptions("dev", "fastly", "rt", filter.Filter{}, option)
+	)
+
+	for id, name := range map[string]string{"AAA": "api-prod", "BBB": "api-staging", "CCC": "sandbox"} {
+		registry.MetricsFor(id).RequestsTotal.With(prometheus.Labels{
+			"service_id": id, "service_name": name, "datacenter": "NYC",
+		}).Add(1)
+	}
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`fastly_rt_requests_total{datacenter="NYC",env="prod",service="api",service_id="AAA",service_name="api-prod"} 1`,
+		`fastly_rt_requests_total{datacenter="NYC",env="staging",service="api",service_id="BBB",service_name="api-staging"} 1`,
+		`fastly_rt_requests_total{datacenter="NYC",env="",service="sandbox",service_id="CCC",service_name="sandbox"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing: %s", want)
+		}
+	}
+}
+
+func TestRegistryByteSizeBuckets(t *testing.T) {
+	t.Parallel()
+
+	var (
+		option   = prom.WithByteSizeBuckets([]float64{100, 1000})
+		registry = prom.NewRegistryWithOptions("dev", "fastly", "rt", filter.Filter{}, option)
+		labels   = prometheus.Labels{"service_id": "AAA", "service_name": "www", "datacenter": "NYC", "field": "resp_body_bytes"}
+	)
+
+	histogram := registry.MetricsFor("AAA").ByteSizeBytes.With(labels)
+	histogram.Observe(50)
+	histogram.Observe(500)
+	histogram.Observe(5000)
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`fastly_rt_byte_size_bytes_bucket{datacenter="NYC",field="resp_body_bytes",service_id="AAA",service_name="www",le="100"} 1`,
+		`fastly_rt_byte_size_bytes_bucket{datacenter="NYC",field="resp_body_bytes",service_id="AAA",service_name="www",le="1000"} 2`,
+		`fastly_rt_byte_size_bytes_bucket{datacenter="NYC",field="resp_body_bytes",service_id="AAA",service_name="www",le="+Inf"} 3`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing: %s", want)
+		}
+	}
+	if strings.Contains(body, `le="1024"`) {
+		t.Errorf("default buckets still present")
+	}
+}
+
+func TestRegistryFilteredMetrics(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		name      string
+		blocklist []string
+		want      int
+	}{
+		{"no filter", nil, 0},
+		{"one", []string{`^fastly_rt_http2_total$`}, 1},
+		{"several", []string{`^fastly_rt_(tls|video|pci)_total$`}, 3},
+		{"repeated", []string{`^fastly_rt_tls_total$`, `^fastly_rt_(tls|pci)_total$`}, 2},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			var f filter.Filter
+			for _, expr := range testcase.blocklist {
+				if err := f.Block(expr); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			registry := prom.NewRegistry("dev", "fastly", "rt", f)
+			if want, have := testcase.want, registry.FilteredMetrics(); want != have {
+				t.Errorf("want %d, have %d", want, have)
+			}
+		})
+	}
+}
+
+func TestRegistryCheckLabels(t *testing.T) {
+	environment := prom.WithEnvironmentLabel(regexp.MustCompile(`^(prod|staging)-`), "none")
+
+	var requestsOnly filter.Filter
+	requestsOnly.Allow(`_requests_total$`)
+
+	for _, testcase := range []struct {
+		name    string
+		max     int
+		names   filter.Filter
+		options []prom.RegistryOption
+		err     bool
+	}{
+		{"within max", 5, filter.Filter{}, nil, false},
+		{"above max", 4, filter.Filter{}, nil, true}, // byte_size_bytes, counting le
+		{"environment within max", 6, filter.Filter{}, []prom.RegistryOption{environment}, false},
+		{"environment above max", 5, filter.Filter{}, []prom.RegistryOption{environment}, true},
+		{"filtered within max", 4, requestsOnly, nil, false}, // http_version_requests_total
+		{"filtered above max", 3, requestsOnly, nil, true},
+	} {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			registry := prom.NewRegistryWithOptions("v0.0.0-DEV", "namespace", "subsystem", testcase.names, testcase.options...)
+			err := registry.CheckLabels(testcase.max)
+			if want, have := testcase.err, err != nil; want != have {
+				t.Fatalf("error: want %v, have %v", want, err)
+			}
+		})
+	}
+}
+
+func TestRegistryTopServices(t *testing.T) {
+	t.Parallel()
+
+	var (
+		clock    = int64(1000)
+		now      = func() time.Time { return time.Unix(atomic.LoadInt64(&clock), 0) }
+		option   = prom.WithTopServices(2, time.Minute, 5*time.Minute, true)
+		registry = prom.NewRegistryWithOptions("dev", "fastly", "rt", filter.Filter{}, prom.WithClock(now), option)
+	)
+
+	traffic := func(requests map[string]float64) {
+		for id, n := range requests {
+			registry.MetricsFor(id).RequestsTotal.WithLabelValues(id, "service "+id, "NYC").Add(n)
+		}
+	}
+
+	t.Run("warmup", func(t *testing.T) {
+		traffic(map[string]float64{"AAA": 10, "BBB": 30, "CCC": 20})
+		want := `
+# HELP fastly_rt_requests_total Number of requests processed.
+# TYPE fastly_rt_requests_total counter
+fastly_rt_requests_total{datacenter="NYC",service_id="AAA",service_name="service AAA"} 10
+fastly_rt_requests_total{datacenter="NYC",service_id="BBB",service_name="service BBB"} 30
+fastly_rt_requests_total{datacenter="NYC",service_id="CCC",service_name="service CCC"} 20
+`
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "fastly_rt_requests_total", "fastly_rt_other_requests"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("ranked", func(t *testing.T) {
+		atomic.StoreInt64(&clock, 1060)
+		want := `
+# HELP fastly_rt_other_requests Summed requests of the services whose metrics aren't served, because they aren't among the top services by requests. Not a counter, as services move in and out of the top services.
+# TYPE fastly_rt_other_requests gauge
+fastly_rt_other_requests 10
+# HELP fastly_rt_requests_total Number of requests processed.
+# TYPE fastly_rt_requests_total counter
+fastly_rt_requests_total{datacenter="NYC",service_id="BBB",service_name="service BBB"} 30
+fastly_rt_requests_total{datacenter="NYC",service_id="CCC",service_name="service CCC"} 20
+`
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "fastly_rt_requests_total", "fastly_rt_other_requests"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("reranked", func(t *testing.T) {
+		traffic(map[string]float64{"AAA": 100, "BBB": 1, "CCC": 5})
+		atomic.StoreInt64(&clock, 1360)
+		want := `
+# HELP fastly_rt_other_requests Summed requests of the services whose metrics aren't served, because they aren't among the top services by requests. Not a counter, as services move in and out of the top services.
+# TYPE fastly_rt_other_requests gauge
+fastly_rt_other_requests 31
+# HELP fastly_rt_requests_total Number of requests processed.
+# TYPE fastly_rt_requests_total counter
+fastly_rt_requests_total{datacenter="NYC",service_id="AAA",service_name="service AAA"} 110
+fastly_rt_requests_total{datacenter="NYC",service_id="CCC",service_name="service CCC"} 25
+`
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "fastly_rt_requests_total", "fastly_rt_other_requests"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRegistryTopServicesOtherNamespace(t *testing.T) {
+	t.Parallel()
+
+	var (
+		clock    = int64(1000)
+		now      = func() time.Time { return time.Unix(atomic.LoadInt64(&clock), 0) }
+		top      = prom.WithTopServices(1, time.Minute, 5*time.Minute, true)
+		override = prom.WithServiceNamespace("legacy", "CCC")
+		registry = prom.NewRegistryWithOptions("dev", "fastly", "rt", filter.Filter{}, prom.WithClock(now), top, override)
+	)
+
+	for id, n := range map[string]float64{"AAA": 10, "BBB": 30, "CCC": 20} {
+		registry.MetricsFor(id).RequestsTotal.WithLabelValues(id, "service "+id, "NYC").Add(n)
+	}
+	atomic.StoreInt64(&clock, 1060)
+
+	want := `
+# HELP fastly_rt_other_requests Summed requests of the services whose metrics aren't served, because they aren't among the top services by requests. Not a counter, as services move in and out of the top services.
+# TYPE fastly_rt_other_requests gauge
+fastly_rt_other_requests 10
+# HELP legacy_rt_other_requests Summed requests of the services whose metrics aren't served, because they aren't among the top services by requests. Not a counter, as services move in and out of the top services.
+# TYPE legacy_rt_other_requests gauge
+legacy_rt_other_requests 20
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "fastly_rt_other_requests", "legacy_rt_other_requests"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRegistryMaxConcurrentScrapes(t *testing.T) {
+	t.Parallel()
+
+	var (
+		entered  = make(chan struct{}, 10)
+		release  = make(chan struct{})
+		blocking = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			entered <- struct{}{}
+			<-release
+			return nil, nil
+		})
+		registry = prom.NewRegistryWithOptions("dev", "fastly", "rt", filter.Filter{},
+			prom.WithDefaultGatherers(blocking),
+			prom.WithMaxConcurrentScrapes(2),
+		)
+		server = httptest.NewServer(registry)
+	)
+	defer server.Close()
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := http.Get(server.URL + "/metrics")
+			if err != nil {
+				t.Error(err)
+				codes <- 0
+				return
+			}
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}()
+	}
+	<-entered
+	<-entered // both scrapes are now gathering
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(server.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want, have := http.StatusServiceUnavailable, resp.StatusCode; want != have {
+			t.Errorf("over limit: want %d, have %d", want, have)
+		}
+		if resp.Header.Get("Retry-After") == "" {
+			t.Errorf("over limit: missing Retry-After header")
+		}
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if want, have := http.StatusOK, <-codes; want != have {
+			t.Errorf("under limit: want %d, have %d", want, have)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want, have := http.StatusOK, resp.StatusCode; want != have {
+		t.Errorf("after release: want %d, have %d", want, have)
+	}
+}
+
+func TestRegistryStandby(t *testing.T) {
+	t.Parallel()
+
+	var (
+		registry = prom.NewRegistryWithOptions("dev", "fastly", "rt", filter.Filter{}, prom.WithStandby(), prom.WithAdminEndpoints())
+		server   = httptest.NewServer(registry)
+		series   = `fastly_rt_requests_total{datacenter="NYC",service_id="AAA",service_name="Service One"} 3`
+	)
+	defer server.Close()
+
+	// Subscribers keep the counters warm while in standby.
+	registry.MetricsFor("AAA").RequestsTotal.With(prometheus.Labels{
+		"service_id": "AAA", "service_name": "Service One", "datacenter": "NYC",
+	}).Add(3)
+
+	scrape := func() (int, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		buf, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(buf)
+	}
+
+	t.Run("standby", func(t *testing.T) {
+		code, body := scrape()
+		if want, have := http.StatusServiceUnavailable, code; want != have {
+			t.Errorf("code: want %d, have %d", want, have)
+		}
+		if strings.Contains(body, series) {
+			t.Errorf("standby: unexpected series in body")
+		}
+	})
+
+	t.Run("promote", func(t *testing.T) {
+		resp, err := http.Post(server.URL+"/admin/promote", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want, have := http.StatusOK, resp.StatusCode; want != have {
+			t.Fatalf("promote code: want %d, have %d", want, have)
+		}
+
+		code, body := scrape()
+		if want, have := http.StatusOK, code; want != have {
+			t.Errorf("code: want %d, have %d", want, have)
+		}
+		if !strings.Contains(body, series) {
+			t.Errorf("active: missing series %s", series)
+		}
+	})
+}
+
+func TestRegistryMaintenance(t *testing.T) {
+	t.Parallel()
+
+	var (
+		clock    = int64(1000)
+		now      = func() time.Time { return time.Unix(atomic.LoadInt64(&clock), 0) }
+		registry = prom.NewRegistryWithOptions("dev", "fastly", "rt", filter.Filter{}, prom.WithClock(now), prom.WithAdminEndpoints())
+		server   = httptest.NewServer(registry)
+	)
+	defer server.Close()
+
+	gauge := func() string {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		buf, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(buf), "\n") {
+			if strings.HasPrefix(line, "fastly_maintenance_active ") {
+				return line
+			}
+		}
+		t.Fatal("fastly_maintenance_active missing")
+		return ""
+	}
+
+	t.Run("set", func(t *testing.T) {
+		resp, err := http.Post(server.URL+"/admin/maintenance?until=1060", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want, have := http.StatusOK, resp.StatusCode; want != have {
+			t.Fatalf("maintenance code: want %d, have %d", want, have)
+		}
+
+		if want, have := "fastly_maintenance_active 1", gauge(); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		atomic.StoreInt64(&clock, 1060)
+		if want, have := "fastly_maintenance_active 0", gauge(); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		resp, err := http.Post(server.URL+"/admin/maintenance?until=tomorrow", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want, have := http.StatusBadRequest, resp.StatusCode; want != have {
+			t.Errorf("code: want %d, have %d", want, have)
+		}
+	})
+}
+
+func TestRegistryAdminEndpoints(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ok      = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		options = []prom.RegistryOption{prom.WithAdminHandler("shard", ok), prom.WithAdminQueryHandler("filter-test", ok)}
+	)
+
+	for _, testcase := range []struct {
+		name    string
+		enabled bool
+		want    int
+	}{
+		{"disabled", false, http.StatusNotFound},
+		{"enabled", true, http.StatusOK},
+	} {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			opts := options
+			if testcase.enabled {
+				opts = append(opts[:len(opts):len(opts)], prom.WithAdminEndpoints())
+			}
+			registry := prom.NewRegistryWithOptions("dev", "fastly", "rt", filter.Filter{}, opts...)
+
+			for _, req := range []*http.Request{
+				httptest.NewRequest("POST", "/admin/promote", nil),
+				httptest.NewRequest("POST", "/admin/maintenance?until=0", nil),
+				httptest.NewRequest("POST", "/admin/shard", nil),
+				httptest.NewRequest("GET", "/admin/filter-test", nil),
+			} {
+				rec := httptest.NewRecorder()
+				registry.ServeHTTP(rec, req)
+				if want, have := testcase.want, rec.Code; want != have {
+					t.Errorf("%s %s: want %d, have %d", req.Method, req.URL.Path, want, have)
+				}
+			}
+		})
+	}
+}
+
+func TestRegistryConcurrentGather(t *testing.T) {
+	t.Parallel()
+
+	var (
+		registry = prom.NewRegistry("dev", "fastly", "rt", filter.Filter{})
+		services = []string{"AAA", "BBB", "CCC"}
+		writes   = 1000
+		wg       sync.WaitGroup
+	)
+
+	for _, id := range services {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			counter := registry.MetricsFor(id).RequestsTotal.WithLabelValues(id, "Service "+id, "NYC")
+			for i := 0; i < writes; i++ {
+				counter.Inc()
+			}
+		}(id)
+	}
+
+	requests := func() map[string]float64 {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := map[string]float64{}
+		for _, family := range families {
+			if family.GetName() != "fastly_rt_requests_total" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				for _, pair := range metric.GetLabel() {
+					if pair.GetName() == "service_id" {
+						values[pair.GetValue()] = metric.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+		return values
+	}
+
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+
+	prev := map[string]float64{}
+	for gathering := true; gathering; {
+		select {
+		case <-done:
+			gathering = false
+		default:
+		}
+		next := requests()
+		for id, value := range next {
+			if value < prev[id] {
+				t.Fatalf("%s: counter went backwards, from %v to %v", id, prev[id], value)
+			}
+		}
+		prev = next
+	}
+
+	for _, id := range services {
+		if want, have := float64(writes), prev[id]; want != have {
+			t.Errorf("%s: want %v, have %v", id, want, have)
+		}
+	}
 }
@@ -0,0 +1,121 @@
+package prom
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/fastly/fastly-exporter/pkg/gen"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterState is the persisted state of every counter for every service,
+// keyed by service ID, then by gen.Metrics field name.
+type counterState map[string]map[string][]counterSample
+
+// counterSample is the value of a single counter series.
+type counterSample struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// SaveState writes the current values of all per-service counters to w, so
+// that they can be restored by RestoreState after a restart. Histograms and
+// gauges aren't saved.
+func (r *Registry) SaveState(w io.Writer) error {
+	r.mtx.Lock()
+	state := counterState{}
+	for serviceID, counters := range r.restored {
+		state[serviceID] = counters // not yet claimed by MetricsFor
+	}
+	for serviceID, mr := range r.byServiceID {
+		state[serviceID] = saveCounters(mr.metrics)
+	}
+	r.mtx.Unlock()
+
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		return fmt.Errorf("error encoding state: %w", err)
+	}
+
+	return nil
+}
+
+// RestoreState reads counter values previously written by SaveState. The
+// values for a service are added to its counters when MetricsFor is first
+// called for that service, so services which are never seen again don't
+// reappear. RestoreState should be called before any calls to MetricsFor.
+func (r *Registry) RestoreState(rd io.Reader) error {
+	var state counterState
+	if err := json.NewDecoder(rd).Decode(&state); err != nil {
+		return fmt.Errorf("error decoding state: %w", err)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for serviceID, counters := range state {
+		if mr, ok := r.byServiceID[serviceID]; ok {
+			restoreCounters(mr.metrics, counters)
+			continue
+		}
+		r.restored[serviceID] = counters
+	}
+
+	return nil
+}
+
+var counterVecType = reflect.TypeOf(&prometheus.CounterVec{})
+
+func saveCounters(m *gen.Metrics) map[string][]counterSample {
+	var (
+		counters = map[string][]counterSample{}
+		v        = reflect.ValueOf(m).Elem()
+	)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Type() != counterVecType {
+			continue
+		}
+
+		ch := make(chan prometheus.Metric)
+		go func(vec *prometheus.CounterVec) { vec.Collect(ch); close(ch) }(v.Field(i).Interface().(*prometheus.CounterVec))
+
+		var samples []counterSample
+		for metric := range ch {
+			var pb dto.Metric
+			if err := metric.Write(&pb); err != nil {
+				continue
+			}
+			labels := map[string]string{}
+			for _, pair := range pb.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			samples = append(samples, counterSample{Labels: labels, Value: pb.GetCounter().GetValue()})
+		}
+
+		if len(samples) > 0 {
+			counters[v.Type().Field(i).Name] = samples
+		}
+	}
+	return counters
+}
+
+func restoreCounters(m *gen.Metrics, counters map[string][]counterSample) {
+	v := reflect.ValueOf(m).Elem()
+	for name, samples := range counters {
+		f := v.FieldByName(name)
+		if !f.IsValid() || f.Type() != counterVecType {
+			continue // metric removed since the state was saved
+		}
+
+		vec := f.Interface().(*prometheus.CounterVec)
+		for _, s := range samples {
+			counter, err := vec.GetMetricWith(s.Labels)
+			if err != nil {
+				continue // labels changed since the state was saved
+			}
+			counter.Add(s.Value)
+		}
+	}
+}
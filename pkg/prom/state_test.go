@@ -0,0 +1,46 @@
+package prom_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fastly/fastly-exporter/pkg/filter"
+	"github.com/fastly/fastly-exporter/pkg/prom"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRegistryStateRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	var (
+		labels = prometheus.Labels{"service_id": "AAA", "service_name": "Service One", "datacenter": "NYC"}
+		before = prom.NewRegistry("dev", "fastly", "rt", filter.Filter{})
+	)
+	before.MetricsFor("AAA").RequestsTotal.With(labels).Add(123)
+	before.MetricsFor("AAA").StatusCodeTotal.WithLabelValues("AAA", "Service One", "NYC", "200").Add(45)
+
+	var buf bytes.Buffer
+	if err := before.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a restart with a fresh registry.
+	after := prom.NewRegistry("dev", "fastly", "rt", filter.Filter{})
+	if err := after.RestoreState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := after.MetricsFor("AAA")
+	metrics.RequestsTotal.With(labels).Add(1)
+
+	if want, have := 124.0, testutil.ToFloat64(metrics.RequestsTotal.With(labels)); want != have {
+		t.Errorf("requests_total: want %v, have %v", want, have)
+	}
+	if want, have := 45.0, testutil.ToFloat64(metrics.StatusCodeTotal.WithLabelValues("AAA", "Service One", "NYC", "200")); want != have {
+		t.Errorf("status_code_total: want %v, have %v", want, have)
+	}
+	if want, have := 0.0, testutil.ToFloat64(after.MetricsFor("BBB").RequestsTotal.With(labels)); want != have {
+		t.Errorf("other service requests_total: want %v, have %v", want, have)
+	}
+}
@@ -0,0 +1,52 @@
+package prom
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TextfileWriter periodically writes the metrics from a gatherer to a file in
+// the Prometheus text format, for collection by e.g. the node exporter's
+// textfile collector. Each write replaces the file atomically, so readers never
+// see a partial snapshot.
+type TextfileWriter struct {
+	gatherer prometheus.Gatherer
+	path     string
+	interval time.Duration
+	logger   log.Logger
+}
+
+// NewTextfileWriter returns a writer which writes the metrics from the gatherer
+// to path every interval. Run must be called to write anything.
+func NewTextfileWriter(gatherer prometheus.Gatherer, path string, interval time.Duration, logger log.Logger) *TextfileWriter {
+	return &TextfileWriter{
+		gatherer: gatherer,
+		path:     path,
+		interval: interval,
+		logger:   log.With(logger, "textfile", path),
+	}
+}
+
+// Run writes the metrics immediately, and then every interval, until the
+// context is canceled. Errors writing the file are logged, and don't stop the
+// writer.
+func (w *TextfileWriter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := prometheus.WriteToTextfile(w.path, w.gatherer); err != nil {
+			level.Warn(w.logger).Log("during", "write", "err", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package prom_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fastly/fastly-exporter/pkg/filter"
+	"github.com/fastly/fastly-exporter/pkg/prom"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTextfileWriter(t *testing.T) {
+	t.Parallel()
+
+	var (
+		path     = filepath.Join(t.TempDir(), "fastly.prom")
+		registry = prom.NewRegistry("dev", "fastly", "rt", filter.Filter{})
+		counter  = registry.MetricsFor("AAA").RequestsTotal.With(prometheus.Labels{"service_id": "AAA", "service_name": "Service One", "datacenter": "NYC"})
+		writer   = prom.NewTextfileWriter(registry, path, 10*time.Millisecond, log.NewNopLogger())
+	)
+	counter.Add(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go writer.Run(ctx)
+
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if buf, err := os.ReadFile(path); err == nil && strings.Contains(string(buf), want) {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("timeout waiting for %s", want)
+	}
+
+	waitFor(`fastly_rt_requests_total{datacenter="NYC",service_id="AAA",service_name="Service One"} 1`)
+
+	counter.Add(1)
+
+	waitFor(`fastly_rt_requests_total{datacenter="NYC",service_id="AAA",service_name="Service One"} 2`)
+}
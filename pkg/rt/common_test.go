@@ -2,7 +2,12 @@ package rt_test
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"sort"
@@ -11,6 +16,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/fastly/fastly-exporter/pkg/api"
@@ -104,6 +110,27 @@ func (c *mockCache) Metadata(id string) (name string, version int, found bool) {
 	return name, version, false
 }
 
+func (c *mockCache) VersionComment(id string) (comment string, found bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	for _, s := range c.services {
+		if s.ID != id {
+			continue
+		}
+		for _, v := range s.Versions {
+			if v.Number == s.Version {
+				return v.Comment, true
+			}
+		}
+	}
+	return "", false
+}
+
+type staticDatacenters []string
+
+func (dcs staticDatacenters) DatacenterCodes() []string { return dcs }
+
 //
 //
 //
@@ -146,6 +173,38 @@ func (c *mockRealtimeClient) advance() {
 	c.next <- struct{}{}
 }
 
+type recordingRealtimeClient struct {
+	*mockRealtimeClient
+	mtx   sync.Mutex
+	paths []string
+}
+
+func (c *recordingRealtimeClient) Do(req *http.Request) (*http.Response, error) {
+	c.mtx.Lock()
+	c.paths = append(c.paths, req.URL.Path)
+	c.mtx.Unlock()
+	return c.mockRealtimeClient.Do(req)
+}
+
+func (c *recordingRealtimeClient) requested() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]string{}, c.paths...)
+}
+
+type datedRealtimeClient struct {
+	*mockRealtimeClient
+	date time.Time
+}
+
+func (c datedRealtimeClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := c.mockRealtimeClient.Do(req)
+	if err == nil {
+		resp.Header.Set("Date", c.date.UTC().Format(http.TimeFormat))
+	}
+	return resp, err
+}
+
 //
 //
 //
@@ -179,6 +238,109 @@ func (c fixedResponseClient) Do(req *http.Request) (*http.Response, error) {
 	return rec.Result(), nil
 }
 
+// brokenBodyClient responds 200 OK with a body which can't be read, as if the
+// connection broke, or with gzip encoding, a body which isn't valid gzip.
+type brokenBodyClient struct {
+	gzip bool
+}
+
+func (c brokenBodyClient) Do(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+	if c.gzip {
+		resp.Header.Set("Content-Encoding", "gzip")
+		resp.Body = ioutil.NopCloser(strings.NewReader("this is not gzip data"))
+	} else {
+		resp.Body = ioutil.NopCloser(io.MultiReader(strings.NewReader(`{"Data":[`), errorReader{errors.New("connection reset")}))
+	}
+	return resp, nil
+}
+
+type errorReader struct{ err error }
+
+func (r errorReader) Read([]byte) (int, error) { return 0, r.err }
+
+// wedgedRealtimeClient blocks every request until released, regardless of the
+// request's context, like a client stuck on a broken connection.
+type wedgedRealtimeClient struct {
+	release chan struct{}
+}
+
+func (c wedgedRealtimeClient) Do(req *http.Request) (*http.Response, error) {
+	<-c.release
+	return nil, errors.New("released")
+}
+
+// lateRealtimeClient wedges the first request until released, regardless of
+// the request's context, and then returns the response anyway, like a broken
+// connection that recovers. Later requests block until their context is done.
+type lateRealtimeClient struct {
+	release  chan struct{}
+	returned chan struct{}
+	response string
+	calls    int32
+}
+
+func (c *lateRealtimeClient) Do(req *http.Request) (*http.Response, error) {
+	if atomic.AddInt32(&c.calls, 1) == 1 {
+		<-c.release
+		defer close(c.returned)
+		return fixedResponseClient{http.StatusOK, c.response}.Do(req)
+	}
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+// gzipRealtimeClient gzip-encodes the responses of the wrapped client, but only
+// for requests which accept that encoding.
+type gzipRealtimeClient struct {
+	*mockRealtimeClient
+	compressed uint64
+}
+
+func (c *gzipRealtimeClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := c.mockRealtimeClient.Do(req)
+	if err != nil || !strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		return resp, err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := io.Copy(gz, resp.Body); err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Body = io.NopCloser(&buf)
+	atomic.AddUint64(&c.compressed, 1)
+	return resp, nil
+}
+
+type slowRealtimeClient struct {
+	delay    time.Duration
+	response string
+	served   uint64
+	inflight int64
+	overlaps int64
+}
+
+func (c *slowRealtimeClient) Do(req *http.Request) (*http.Response, error) {
+	if atomic.AddInt64(&c.inflight, 1) > 1 {
+		atomic.AddInt64(&c.overlaps, 1)
+	}
+	defer atomic.AddInt64(&c.inflight, -1)
+	select {
+	case <-time.After(c.delay):
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	atomic.AddUint64(&c.served, 1)
+	return fixedResponseClient{200, c.response}.Do(req)
+}
+
 //
 //
 //
@@ -2097,6 +2259,16 @@ var expetedMetricsOutputMap = map[string]float64{
 	`testspace_testsystem_body_size_total{datacenter="TYO",service_id="my-service-id",service_name="my-service-name"}`:                              118928,
 	`testspace_testsystem_body_size_total{datacenter="YUL",service_id="my-service-id",service_name="my-service-name"}`:                              17018,
 	`testspace_testsystem_body_size_total{datacenter="YYZ",service_id="my-service-id",service_name="my-service-name"}`:                              10944,
+	`testspace_testsystem_bytes_total{datacenter="BUR",service_id="my-service-id",service_name="my-service-name"}`:                                  242,
+	`testspace_testsystem_bytes_total{datacenter="BWI",service_id="my-service-id",service_name="my-service-name"}`:                                  11368,
+	`testspace_testsystem_bytes_total{datacenter="FRA",service_id="my-service-id",service_name="my-service-name"}`:                                  11371,
+	`testspace_testsystem_bytes_total{datacenter="HHN",service_id="my-service-id",service_name="my-service-name"}`:                                  438751,
+	`testspace_testsystem_bytes_total{datacenter="LGA",service_id="my-service-id",service_name="my-service-name"}`:                                  11774249,
+	`testspace_testsystem_bytes_total{datacenter="SEA",service_id="my-service-id",service_name="my-service-name"}`:                                  11371,
+	`testspace_testsystem_bytes_total{datacenter="SYD",service_id="my-service-id",service_name="my-service-name"}`:                                  11372,
+	`testspace_testsystem_bytes_total{datacenter="TYO",service_id="my-service-id",service_name="my-service-name"}`:                                  119748,
+	`testspace_testsystem_bytes_total{datacenter="YUL",service_id="my-service-id",service_name="my-service-name"}`:                                  17916,
+	`testspace_testsystem_bytes_total{datacenter="YYZ",service_id="my-service-id",service_name="my-service-name"}`:                                  11370,
 	`testspace_testsystem_compute_bereq_body_bytes_total{datacenter="BUR",service_id="my-service-id",service_name="my-service-name"}`:               0,
 	`testspace_testsystem_compute_bereq_body_bytes_total{datacenter="BWI",service_id="my-service-id",service_name="my-service-name"}`:               0,
 	`testspace_testsystem_compute_bereq_body_bytes_total{datacenter="FRA",service_id="my-service-id",service_name="my-service-name"}`:               0,
@@ -2447,6 +2619,7 @@ var expetedMetricsOutputMap = map[string]float64{
 	`testspace_testsystem_fetch_sub_time_total{datacenter="TYO",service_id="my-service-id",service_name="my-service-name"}`:                         0,
 	`testspace_testsystem_fetch_sub_time_total{datacenter="YUL",service_id="my-service-id",service_name="my-service-name"}`:                         0,
 	`testspace_testsystem_fetch_sub_time_total{datacenter="YYZ",service_id="my-service-id",service_name="my-service-name"}`:                         0,
+	`testspace_testsystem_first_bucket_latency_seconds{service_id="my-service-id",service_name="my-service-name"}`:                                  0,
 	`testspace_testsystem_hash_sub_count_total{datacenter="BUR",service_id="my-service-id",service_name="my-service-name"}`:                         1,
 	`testspace_testsystem_hash_sub_count_total{datacenter="BWI",service_id="my-service-id",service_name="my-service-name"}`:                         1,
 	`testspace_testsystem_hash_sub_count_total{datacenter="FRA",service_id="my-service-id",service_name="my-service-name"}`:                         1,
@@ -2717,6 +2890,7 @@ var expetedMetricsOutputMap = map[string]float64{
 	`testspace_testsystem_ipv6_total{datacenter="TYO",service_id="my-service-id",service_name="my-service-name"}`:                                   0,
 	`testspace_testsystem_ipv6_total{datacenter="YUL",service_id="my-service-id",service_name="my-service-name"}`:                                   0,
 	`testspace_testsystem_ipv6_total{datacenter="YYZ",service_id="my-service-id",service_name="my-service-name"}`:                                   0,
+	`testspace_testsystem_last_bucket_timestamp{service_id="my-service-id",service_name="my-service-name"}`:                                         1603401004,
 	`testspace_testsystem_log_bytes_total{datacenter="BUR",service_id="my-service-id",service_name="my-service-name"}`:                              0,
 	`testspace_testsystem_log_bytes_total{datacenter="BWI",service_id="my-service-id",service_name="my-service-name"}`:                              0,
 	`testspace_testsystem_log_bytes_total{datacenter="FRA",service_id="my-service-id",service_name="my-service-name"}`:                              0,
@@ -3057,6 +3231,7 @@ var expetedMetricsOutputMap = map[string]float64{
 	`testspace_testsystem_object_size_bytes_sum{datacenter="TYO",service_id="my-service-id",service_name="my-service-name"}`:                        1.1264e+06,
 	`testspace_testsystem_object_size_bytes_sum{datacenter="YUL",service_id="my-service-id",service_name="my-service-name"}`:                        20480,
 	`testspace_testsystem_object_size_bytes_sum{datacenter="YYZ",service_id="my-service-id",service_name="my-service-name"}`:                        102400,
+	`testspace_testsystem_oldest_pending_bucket_age_seconds{service_id="my-service-id",service_name="my-service-name"}`:                             3,
 	`testspace_testsystem_origin_fetch_body_bytes_total{datacenter="BUR",service_id="my-service-id",service_name="my-service-name"}`:                0,
 	`testspace_testsystem_origin_fetch_body_bytes_total{datacenter="BWI",service_id="my-service-id",service_name="my-service-name"}`:                0,
 	`testspace_testsystem_origin_fetch_body_bytes_total{datacenter="FRA",service_id="my-service-id",service_name="my-service-name"}`:                0,
@@ -3337,6 +3512,7 @@ var expetedMetricsOutputMap = map[string]float64{
 	`testspace_testsystem_pipe{datacenter="TYO",service_id="my-service-id",service_name="my-service-name"}`:                                         0,
 	`testspace_testsystem_pipe{datacenter="YUL",service_id="my-service-id",service_name="my-service-name"}`:                                         0,
 	`testspace_testsystem_pipe{datacenter="YYZ",service_id="my-service-id",service_name="my-service-name"}`:                                         0,
+	`testspace_testsystem_poll_interval_seconds{service_id="my-service-id",service_name="my-service-name"}`:                                         0,
 	`testspace_testsystem_predeliver_sub_count_total{datacenter="BUR",service_id="my-service-id",service_name="my-service-name"}`:                   1,
 	`testspace_testsystem_predeliver_sub_count_total{datacenter="BWI",service_id="my-service-id",service_name="my-service-name"}`:                   1,
 	`testspace_testsystem_predeliver_sub_count_total{datacenter="FRA",service_id="my-service-id",service_name="my-service-name"}`:                   1,
@@ -3418,6 +3594,26 @@ var expetedMetricsOutputMap = map[string]float64{
 	`testspace_testsystem_req_header_bytes_total{datacenter="TYO",service_id="my-service-id",service_name="my-service-name"}`:                       845,
 	`testspace_testsystem_req_header_bytes_total{datacenter="YUL",service_id="my-service-id",service_name="my-service-name"}`:                       1186,
 	`testspace_testsystem_req_header_bytes_total{datacenter="YYZ",service_id="my-service-id",service_name="my-service-name"}`:                       441,
+	`testspace_testsystem_request_collapse_unusable_total{datacenter="BUR",service_id="my-service-id",service_name="my-service-name"}`:              0,
+	`testspace_testsystem_request_collapse_unusable_total{datacenter="BWI",service_id="my-service-id",service_name="my-service-name"}`:              0,
+	`testspace_testsystem_request_collapse_unusable_total{datacenter="FRA",service_id="my-service-id",service_name="my-service-name"}`:              0,
+	`testspace_testsystem_request_collapse_unusable_total{datacenter="HHN",service_id="my-service-id",service_name="my-service-name"}`:              0,
+	`testspace_testsystem_request_collapse_unusable_total{datacenter="LGA",service_id="my-service-id",service_name="my-service-name"}`:              0,
+	`testspace_testsystem_request_collapse_unusable_total{datacenter="SEA",service_id="my-service-id",service_name="my-service-name"}`:              0,
+	`testspace_testsystem_request_collapse_unusable_total{datacenter="SYD",service_id="my-service-id",service_name="my-service-name"}`:              0,
+	`testspace_testsystem_request_collapse_unusable_total{datacenter="TYO",service_id="my-service-id",service_name="my-service-name"}`:              0,
+	`testspace_testsystem_request_collapse_unusable_total{datacenter="YUL",service_id="my-service-id",service_name="my-service-name"}`:              0,
+	`testspace_testsystem_request_collapse_unusable_total{datacenter="YYZ",service_id="my-service-id",service_name="my-service-name"}`:              0,
+	`testspace_testsystem_request_collapse_usable_total{datacenter="BUR",service_id="my-service-id",service_name="my-service-name"}`:                0,
+	`testspace_testsystem_request_collapse_usable_total{datacenter="BWI",service_id="my-service-id",service_name="my-service-name"}`:                0,
+	`testspace_testsystem_request_collapse_usable_total{datacenter="FRA",service_id="my-service-id",service_name="my-service-name"}`:                0,
+	`testspace_testsystem_request_collapse_usable_total{datacenter="HHN",service_id="my-service-id",service_name="my-service-name"}`:                0,
+	`testspace_testsystem_request_collapse_usable_total{datacenter="LGA",service_id="my-service-id",service_name="my-service-name"}`:                0,
+	`testspace_testsystem_request_collapse_usable_total{datacenter="SEA",service_id="my-service-id",service_name="my-service-name"}`:                0,
+	`testspace_testsystem_request_collapse_usable_total{datacenter="SYD",service_id="my-service-id",service_name="my-service-name"}`:                0,
+	`testspace_testsystem_request_collapse_usable_total{datacenter="TYO",service_id="my-service-id",service_name="my-service-name"}`:                0,
+	`testspace_testsystem_request_collapse_usable_total{datacenter="YUL",service_id="my-service-id",service_name="my-service-name"}`:                0,
+	`testspace_testsystem_request_collapse_usable_total{datacenter="YYZ",service_id="my-service-id",service_name="my-service-name"}`:                0,
 	`testspace_testsystem_requests_total{datacenter="BUR",service_id="my-service-id",service_name="my-service-name"}`:                               1,
 	`testspace_testsystem_requests_total{datacenter="BWI",service_id="my-service-id",service_name="my-service-name"}`:                               1,
 	`testspace_testsystem_requests_total{datacenter="FRA",service_id="my-service-id",service_name="my-service-name"}`:                               1,
@@ -2,12 +2,15 @@ package rt
 
 import (
 	"context"
+	"errors"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/fastly/fastly-exporter/pkg/gen"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // ServiceIdentifier is a consumer contract for a subscriber manager.
@@ -33,17 +36,42 @@ type Manager struct {
 	metrics           MetricsProvider
 	subscriberOptions []SubscriberOption
 	logger            log.Logger
+	rampInterval      time.Duration
+	rampFloor         int
+	reapThreshold     time.Duration
+	restarts          prometheus.Counter
 
-	mtx     sync.RWMutex
-	managed map[string]interrupt
+	mtx      sync.RWMutex
+	managed  map[string]interrupt
+	rampNext time.Time
+}
+
+// ManagerOption provides some additional behavior to a manager.
+type ManagerOption func(*Manager)
+
+// WithStartupRamp staggers the start of new subscribers, so that a large fleet
+// of services doesn't hit the real-time stats API all at once. While fewer than
+// floor subscribers are running, new subscribers start immediately, so small
+// fleets warm up without delay. Beyond the floor, new subscribers start one per
+// interval. By default, all new subscribers start immediately.
+func WithStartupRamp(interval time.Duration, floor int) ManagerOption {
+	return func(m *Manager) { m.rampInterval, m.rampFloor = interval, floor }
+}
+
+// WithReaper enables Reap, which restarts any subscriber that hasn't completed
+// a request to the real-time stats API within the threshold, e.g. because it's
+// wedged on a broken connection. Each restart increments the restarts counter.
+// By default, subscribers are never restarted.
+func WithReaper(threshold time.Duration, restarts prometheus.Counter) ManagerOption {
+	return func(m *Manager) { m.reapThreshold, m.restarts = threshold, restarts }
 }
 
 // NewManager returns a usable manager. Callers should invoke Refresh on a
 // regular schedule to keep the set of managed subscribers up-to-date. The HTTP
 // client, token, metrics, and subscriber options parameters are passed thru to
 // constructed subscribers.
-func NewManager(ids ServiceIdentifier, client HTTPClient, token string, metrics MetricsProvider, subscriberOptions []SubscriberOption, logger log.Logger) *Manager {
-	return &Manager{
+func NewManager(ids ServiceIdentifier, client HTTPClient, token string, metrics MetricsProvider, subscriberOptions []SubscriberOption, logger log.Logger, options ...ManagerOption) *Manager {
+	m := &Manager{
 		ids:               ids,
 		client:            client,
 		token:             token,
@@ -53,6 +81,10 @@ func NewManager(ids ServiceIdentifier, client HTTPClient, token string, metrics
 
 		managed: map[string]interrupt{},
 	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
 }
 
 // Refresh the set of subscribers managed by the manager, by asking the
@@ -66,15 +98,30 @@ func (m *Manager) Refresh() {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	var (
+		ids     = m.ids.ServiceIDs()
+		running = 0
+	)
+	for _, id := range ids {
+		if _, ok := m.managed[id]; ok {
+			running++
+		}
+	}
+
 	nextgen := map[string]interrupt{}
-	for _, id := range m.ids.ServiceIDs() {
+	for _, id := range ids {
 		if irq, ok := m.managed[id]; ok {
 			level.Debug(m.logger).Log("service_id", id, "subscriber", "maintain")
 			nextgen[id] = irq // move
 			delete(m.managed, id)
 		} else {
+			delay := m.startDelayWithLock(running)
 			level.Info(m.logger).Log("service_id", id, "subscriber", "create")
-			nextgen[id] = m.spawn(id)
+			if delay > 0 {
+				level.Debug(m.logger).Log("service_id", id, "subscriber", "delay start", "delay", delay)
+			}
+			nextgen[id] = m.spawn(id, delay)
+			running++
 		}
 	}
 
@@ -91,7 +138,11 @@ func (m *Manager) Refresh() {
 		select {
 		default: // still running (good)
 		case err := <-irq.done: // exited (bad)
-			level.Error(m.logger).Log("service_id", id, "interrupt", err, "err", "premature termination", "msg", "will attempt to reconnect on next refresh")
+			if errors.Is(err, ErrForbidden) {
+				level.Warn(m.logger).Log("service_id", id, "interrupt", err, "msg", "token may not have access to service; will attempt to reconnect on next refresh")
+			} else {
+				level.Error(m.logger).Log("service_id", id, "interrupt", err, "err", "premature termination", "msg", "will attempt to reconnect on next refresh")
+			}
 			delete(nextgen, id)
 		}
 	}
@@ -107,6 +158,28 @@ func (m *Manager) Active() (serviceIDs []string) {
 	return m.managedIDsWithLock()
 }
 
+// SubscriberError is the most recent error encountered by a subscriber.
+type SubscriberError struct {
+	ServiceID string
+	Err       string
+	Time      time.Time
+}
+
+// LastErrors returns the most recent error of each managed subscriber which
+// has encountered one, ordered by service ID.
+func (m *Manager) LastErrors() []SubscriberError {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	var errs []SubscriberError
+	for _, id := range m.managedIDsWithLock() {
+		if msg, at, ok := m.managed[id].subscriber.LastError(); ok {
+			errs = append(errs, SubscriberError{ServiceID: id, Err: msg, Time: at})
+		}
+	}
+	return errs
+}
+
 // StopAll terminates and cleans up all active subscribers.
 func (m *Manager) StopAll() {
 	m.mtx.Lock()
@@ -122,16 +195,71 @@ func (m *Manager) StopAll() {
 	}
 }
 
-func (m *Manager) spawn(serviceID string) interrupt {
+// Reap restarts any managed subscriber that hasn't made progress within the
+// threshold set by WithReaper. A subscriber that hasn't completed a request yet
+// is measured from when it was due to start. The old subscriber is canceled,
+// but not waited for, as a wedged subscriber may never return. If it does,
+// it exits without writing to the metrics shared with its replacement. Callers
+// should invoke Reap on a regular schedule. Without WithReaper, it does nothing.
+func (m *Manager) Reap() {
+	if m.reapThreshold <= 0 {
+		return
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	now := time.Now()
+	for _, id := range m.managedIDsWithLock() {
+		irq := m.managed[id]
+		last := irq.subscriber.LastProgress()
+		if last.Before(irq.due) {
+			last = irq.due
+		}
+		if stalled := now.Sub(last); stalled > m.reapThreshold {
+			level.Warn(m.logger).Log("service_id", id, "subscriber", "restart", "stalled", stalled, "msg", "no progress within reap threshold")
+			irq.cancel()
+			go func(id string, done <-chan error) {
+				err := <-done
+				level.Debug(m.logger).Log("service_id", id, "interrupt", err, "msg", "reaped subscriber exited")
+			}(id, irq.done)
+			m.managed[id] = m.spawn(id, 0)
+			if m.restarts != nil {
+				m.restarts.Inc()
+			}
+		}
+	}
+}
+
+// startDelayWithLock returns how long a new subscriber should wait before it
+// starts, given the number of subscribers already running or waiting to start.
+func (m *Manager) startDelayWithLock(running int) time.Duration {
+	if m.rampInterval <= 0 || running < m.rampFloor {
+		return 0
+	}
+
+	now := time.Now()
+	if m.rampNext.Before(now) {
+		m.rampNext = now
+	}
+	m.rampNext = m.rampNext.Add(m.rampInterval)
+	return m.rampNext.Sub(now)
+}
+
+func (m *Manager) spawn(serviceID string, delay time.Duration) interrupt {
 	var (
 		subscriber  = NewSubscriber(m.client, m.token, serviceID, m.metrics.MetricsFor(serviceID), m.subscriberOptions...)
 		ctx, cancel = context.WithCancel(context.Background())
 		done        = make(chan error, 1)
 	)
 	go func() {
+		if contextSleep(ctx, delay); ctx.Err() != nil {
+			done <- ctx.Err()
+			return
+		}
 		done <- subscriber.Run(ctx)
 	}()
-	return interrupt{cancel, done}
+	return interrupt{cancel, done, subscriber, time.Now().Add(delay)}
 }
 
 func (m *Manager) managedIDsWithLock() []string {
@@ -144,6 +272,8 @@ func (m *Manager) managedIDsWithLock() []string {
 }
 
 type interrupt struct {
-	cancel func()
-	done   <-chan error
+	cancel     func()
+	done       <-chan error
+	subscriber *Subscriber
+	due        time.Time // when the subscriber was due to start
 }
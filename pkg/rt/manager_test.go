@@ -2,8 +2,11 @@ package rt_test
 
 import (
 	"bytes"
+	"context"
+	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -12,6 +15,8 @@ import (
 	"github.com/fastly/fastly-exporter/pkg/filter"
 	"github.com/fastly/fastly-exporter/pkg/prom"
 	"github.com/fastly/fastly-exporter/pkg/rt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestManager(t *testing.T) {
@@ -76,3 +81,169 @@ func TestManager(t *testing.T) {
 		t.Error(cmp.Diff(want, have))
 	}
 }
+
+func TestManagerStartupRamp(t *testing.T) {
+	var (
+		s1       = api.Service{ID: "101010", Name: "service 1", Version: 1}
+		s2       = api.Service{ID: "2f2f2f", Name: "service 2", Version: 2}
+		s3       = api.Service{ID: "3a3b3c", Name: "service 3", Version: 3}
+		token    = "irrelevant-token"
+		registry = prom.NewRegistry("v0.0.0-DEV", "namespace", "subsystem", filter.Filter{})
+		ramp     = rt.WithStartupRamp(time.Hour, 2)
+	)
+
+	// started waits briefly for subscribers to make their first requests, and
+	// returns how many distinct services made requests.
+	started := func(client *recordingRealtimeClient) int {
+		time.Sleep(100 * time.Millisecond)
+		services := map[string]bool{}
+		for _, path := range client.requested() {
+			services[strings.Split(path, "/")[3]] = true // /v1/channel/{id}/ts/{ts}
+		}
+		return len(services)
+	}
+
+	t.Run("small fleet", func(t *testing.T) {
+		var (
+			cache   = &mockCache{}
+			client  = &recordingRealtimeClient{mockRealtimeClient: newMockRealtimeClient(`{}`)}
+			manager = rt.NewManager(cache, client, token, registry, nil, log.NewNopLogger(), ramp)
+		)
+		defer manager.StopAll()
+
+		cache.update([]api.Service{s1, s2})
+		manager.Refresh()
+		if want, have := 2, started(client); want != have {
+			t.Errorf("started subscribers: want %d, have %d", want, have)
+		}
+	})
+
+	t.Run("large fleet", func(t *testing.T) {
+		var (
+			cache   = &mockCache{}
+			client  = &recordingRealtimeClient{mockRealtimeClient: newMockRealtimeClient(`{}`)}
+			manager = rt.NewManager(cache, client, token, registry, nil, log.NewNopLogger(), ramp)
+		)
+		defer manager.StopAll()
+
+		cache.update([]api.Service{s1, s2, s3})
+		manager.Refresh()
+		if want, have := 2, started(client); want != have {
+			t.Errorf("started subscribers: want %d, have %d", want, have)
+		}
+		assertStringSliceEqual(t, []string{s1.ID, s2.ID, s3.ID}, manager.Active())
+	})
+}
+
+func TestManagerReshard(t *testing.T) {
+	var (
+		// With m=3, 4d4d4d hashes to shard 1, 2f2f2f to shard 2, and 101010
+		// to shard 3.
+		client = fixedResponseClient{code: http.StatusOK, response: `[
+			{"id": "101010", "name": "service 1", "version": 1},
+			{"id": "2f2f2f", "name": "service 2", "version": 2},
+			{"id": "4d4d4d", "name": "service 4", "version": 4}
+		]`}
+		token    = "irrelevant-token"
+		cache    = api.NewServiceCache(client, token, api.WithShard(1, 3))
+		registry = prom.NewRegistry("v0.0.0-DEV", "namespace", "subsystem", filter.Filter{})
+		options  = []rt.SubscriberOption{rt.WithMetadataProvider(cache)}
+		manager  = rt.NewManager(cache, newMockRealtimeClient(`{}`), token, registry, options, log.NewNopLogger())
+		ctx      = context.Background()
+	)
+	defer manager.StopAll()
+
+	refresh := func() {
+		if err := cache.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+		manager.Refresh()
+	}
+
+	refresh()
+	assertStringSliceEqual(t, []string{"4d4d4d"}, manager.Active())
+
+	cache.SetShard(2, 3)
+	manager.Refresh() // stop 4d4d4d, but don't start 2f2f2f until the next refresh
+	assertStringSliceEqual(t, []string{}, manager.Active())
+
+	refresh() // create 2f2f2f
+	assertStringSliceEqual(t, []string{"2f2f2f"}, manager.Active())
+
+	cache.SetShard(1, 1)
+	manager.Refresh() // no effect
+	assertStringSliceEqual(t, []string{"2f2f2f"}, manager.Active())
+
+	refresh() // create 101010, create 4d4d4d
+	assertStringSliceEqual(t, []string{"101010", "2f2f2f", "4d4d4d"}, manager.Active())
+}
+
+func TestManagerReaper(t *testing.T) {
+	var (
+		cache    = &mockCache{}
+		s1       = api.Service{ID: "101010", Name: "service 1", Version: 1}
+		client   = wedgedRealtimeClient{release: make(chan struct{})}
+		token    = "irrelevant-token"
+		registry = prom.NewRegistry("v0.0.0-DEV", "namespace", "subsystem", filter.Filter{})
+		restarts = prometheus.NewCounter(prometheus.CounterOpts{Name: "restarts_total"})
+		reaper   = rt.WithReaper(100*time.Millisecond, restarts)
+		manager  = rt.NewManager(cache, client, token, registry, nil, log.NewNopLogger(), reaper)
+	)
+	defer func() { close(client.release); manager.StopAll() }()
+
+	cache.update([]api.Service{s1})
+	manager.Refresh()
+
+	manager.Reap() // within the threshold
+	if want, have := 0.0, testutil.ToFloat64(restarts); want != have {
+		t.Errorf("restarts before threshold: want %v, have %v", want, have)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	manager.Reap() // wedged beyond the threshold
+	if want, have := 1.0, testutil.ToFloat64(restarts); want != have {
+		t.Errorf("restarts after threshold: want %v, have %v", want, have)
+	}
+	assertStringSliceEqual(t, []string{s1.ID}, manager.Active())
+
+	manager.Reap() // the replacement gets a fresh threshold
+	if want, have := 1.0, testutil.ToFloat64(restarts); want != have {
+		t.Errorf("restarts after replacement: want %v, have %v", want, have)
+	}
+}
+
+func TestManagerReaperLateResponse(t *testing.T) {
+	var (
+		cache  = &mockCache{}
+		s1     = api.Service{ID: "101010", Name: "service 1", Version: 1}
+		client = &lateRealtimeClient{
+			release:  make(chan struct{}),
+			returned: make(chan struct{}),
+			response: `{"Data":[{"datacenter":{"AMS":{"requests":1}},"recorded":100}],"Timestamp":101}`,
+		}
+		registry = prom.NewRegistry("v0.0.0-DEV", "namespace", "subsystem", filter.Filter{})
+		options  = []rt.SubscriberOption{rt.WithMetadataProvider(cache)}
+		restarts = prometheus.NewCounter(prometheus.CounterOpts{Name: "restarts_total"})
+		reaper   = rt.WithReaper(50*time.Millisecond, restarts)
+		manager  = rt.NewManager(cache, client, "irrelevant-token", registry, options, log.NewNopLogger(), reaper)
+	)
+	defer manager.StopAll()
+
+	cache.update([]api.Service{s1})
+	manager.Refresh()
+
+	time.Sleep(100 * time.Millisecond)
+	manager.Reap() // the first subscriber is wedged, so it's replaced
+	if want, have := 1.0, testutil.ToFloat64(restarts); want != have {
+		t.Fatalf("restarts: want %v, have %v", want, have)
+	}
+
+	close(client.release) // the wedged request completes with data
+	<-client.returned
+	time.Sleep(50 * time.Millisecond)
+
+	requests := registry.MetricsFor(s1.ID).RequestsTotal.WithLabelValues(s1.ID, s1.Name, "AMS")
+	if want, have := 0.0, testutil.ToFloat64(requests); want != have {
+		t.Errorf("requests from the reaped subscriber: want %v, have %v", want, have)
+	}
+}
@@ -0,0 +1,40 @@
+package rt
+
+import "sync"
+
+// Replay is shared by subscribers to replay real-time data from a historical
+// timestamp, rather than starting with the most recent data. The real-time
+// stats API retains a short history, so this can recover data from just before
+// the exporter started. Each service is replayed at most once, so a subscriber
+// restarted for the same service doesn't count the same data twice.
+type Replay struct {
+	mtx      sync.Mutex
+	from     uint64
+	replayed map[string]bool
+}
+
+// NewReplay returns a replay from the given Unix timestamp.
+func NewReplay(from uint64) *Replay {
+	return &Replay{
+		from:     from,
+		replayed: map[string]bool{},
+	}
+}
+
+// start returns the timestamp from which the subscriber for the service should
+// start, which is the replay timestamp the first time, and 0 (i.e. the most
+// recent data) thereafter.
+func (r *Replay) start(serviceID string) uint64 {
+	if r == nil {
+		return 0
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.replayed[serviceID] {
+		return 0
+	}
+	r.replayed[serviceID] = true
+	return r.from
+}
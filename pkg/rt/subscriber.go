@@ -1,18 +1,32 @@
 package rt
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cespare/xxhash"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/fastly/fastly-exporter/pkg/filter"
 	"github.com/fastly/fastly-exporter/pkg/gen"
 )
 
@@ -28,6 +42,18 @@ type MetadataProvider interface {
 	Metadata(id string) (name string, version int, found bool)
 }
 
+// VersionCommentProvider is a consumer contract for the subscriber.
+// It models the version comment lookup method of an api.ServiceCache.
+type VersionCommentProvider interface {
+	VersionComment(id string) (comment string, found bool)
+}
+
+// DatacenterProvider is a consumer contract for the subscriber.
+// It models the datacenter listing method of an api.DatacenterCache.
+type DatacenterProvider interface {
+	DatacenterCodes() []string
+}
+
 // Subscriber polls rt.fastly.com for a single service ID.
 // It emits the received real-time stats data to Prometheus.
 type Subscriber struct {
@@ -35,9 +61,67 @@ type Subscriber struct {
 	token       string
 	serviceID   string
 	provider    MetadataProvider
+	comments    VersionCommentProvider
 	metrics     *gen.Metrics
 	postprocess func()
 	logger      log.Logger
+	skipIdle    bool
+	dcFilter    filter.Filter
+	knownDCs    filter.Filter
+	catchAll    string
+	dcOverride  string
+	dcSample    uint64
+	dcLimit     int
+	dcOverflow  string
+	dcTracked   map[string]bool
+
+	requestRates bool
+	lastRecorded uint64
+	rateLabels   map[string]bool
+
+	smoothing    float64
+	smoothedLast uint64
+	smoothedRate float64
+	smoothedOK   bool
+
+	dcShares    bool
+	shareLabels map[string]bool
+
+	errorRatios bool
+	errorLabels map[string]bool
+
+	byteSizeFields []string
+	httpVersions   map[string]bool
+
+	fleetRequests prometheus.Counter
+	fleetBytes    prometheus.Counter
+
+	forbiddenLimit int
+	forbidden      int  // consecutive 403 responses
+	cleared        bool // whether the Forbidden gauge has been cleared
+
+	alwaysPresent []string
+	datacenters   DatacenterProvider
+	zeroedName    string
+
+	replay *Replay
+
+	minBucketAge time.Duration
+	pollInterval time.Duration
+	deferred     map[uint64]map[string]gen.Datacenter
+	now          func() time.Time
+	started      time.Time
+	firstBucket  bool
+	renameGrace  time.Duration
+	sanitizeName func(string) string
+	lastRawName  string
+	lastName     string
+	renamedAway  map[string]time.Time // old name: when to prune its series
+	progress     int64                // atomic; Unix nanoseconds of the last completed request
+
+	errMtx    sync.Mutex
+	lastErr   string
+	lastErrAt time.Time
 }
 
 // SubscriberOption provides some additional behavior to a subscriber.
@@ -51,6 +135,14 @@ func WithMetadataProvider(p MetadataProvider) SubscriberOption {
 	return func(s *Subscriber) { s.provider = p }
 }
 
+// WithVersionComments sets the provider used to look up the comment of each
+// service's active version. When the comment is non-empty, it's used as the
+// service_version label instead of the version number. By default, the
+// version number is always used.
+func WithVersionComments(p VersionCommentProvider) SubscriberOption {
+	return func(s *Subscriber) { s.comments = p }
+}
+
 // WithLogger sets the logger used by the subscriber while running.
 // By default, no log events are emitted.
 func WithLogger(logger log.Logger) SubscriberOption {
@@ -64,6 +156,211 @@ func WithPostprocess(f func()) SubscriberOption {
 	return func(s *Subscriber) { s.postprocess = f }
 }
 
+// WithSkipIdleDatacenters controls whether datacenters which served no traffic
+// in a given bucket are skipped when processing that bucket. Skipped
+// datacenters don't create or update any series, so datacenters that are idle
+// don't contribute to the cardinality of the exported metrics. By default, all
+// datacenters in the response are processed.
+func WithSkipIdleDatacenters(skip bool) SubscriberOption {
+	return func(s *Subscriber) { s.skipIdle = skip }
+}
+
+// WithRequestRates controls whether the subscriber computes the
+// RequestsPerSecond gauge for each datacenter, from the requests in each bucket
+// and the time since the previous bucket. That duplicates the information in
+// the requests counter, but some dashboards can't compute rates themselves. By
+// default, request rates aren't computed.
+func WithRequestRates(enabled bool) SubscriberOption {
+	return func(s *Subscriber) { s.requestRates = enabled }
+}
+
+// WithSmoothedRequestRate makes the subscriber compute the RequestsRateSmoothed
+// gauge, which is the service's requests per second across all datacenters,
+// smoothed with an exponentially weighted moving average. Each bucket's rate
+// contributes with weight alpha, in (0, 1]: smaller values smooth more, and 1
+// doesn't smooth at all. That's for dashboards which find the 1s buckets too
+// noisy. By default, or if alpha is 0, the smoothed rate isn't computed.
+func WithSmoothedRequestRate(alpha float64) SubscriberOption {
+	return func(s *Subscriber) { s.smoothing = alpha }
+}
+
+// WithDatacenterShares controls whether the subscriber computes the
+// DatacenterShare gauge, which is each datacenter's share of the service's
+// requests in each bucket. That's useful for load balancing analysis, but adds
+// a series per datacenter. By default, datacenter shares aren't computed.
+func WithDatacenterShares(enabled bool) SubscriberOption {
+	return func(s *Subscriber) { s.dcShares = enabled }
+}
+
+// WithErrorRatios controls whether the subscriber computes the ErrorRatio gauge,
+// which is the ratio of 5xx responses to requests in each datacenter in each
+// bucket. That helps to spot a bad datacenter, but adds a series per datacenter.
+// Datacenters without requests in a bucket have no ratio. By default, error
+// ratios aren't computed.
+func WithErrorRatios(enabled bool) SubscriberOption {
+	return func(s *Subscriber) { s.errorRatios = enabled }
+}
+
+// WithByteSizeHistograms makes the subscriber observe the per-second total of
+// each of the given real-time fields, e.g. resp_body_bytes, in each datacenter
+// in the ByteSizeBytes histogram, labeled with the field. Fields must satisfy
+// IsByteSizeField; others are ignored. The corresponding counters are updated
+// as usual. By default, no fields are observed.
+func WithByteSizeHistograms(fields ...string) SubscriberOption {
+	return func(s *Subscriber) {
+		for _, f := range fields {
+			if IsByteSizeField(f) {
+				s.byteSizeFields = append(s.byteSizeFields, f)
+			}
+		}
+	}
+}
+
+// WithHTTPVersions makes the subscriber count requests in each datacenter by
+// HTTP version in the HTTPVersionRequestsTotal counter. Versions in the
+// allowlist get their own series, and the rest are folded into a series with
+// version "other". The real-time data only breaks out HTTP/2 requests, so
+// versions are "2", and "non_http2" for everything else, i.e. HTTP/1.0, 1.1,
+// and 3 combined. By default, HTTP versions aren't tracked.
+func WithHTTPVersions(allowlist ...string) SubscriberOption {
+	return func(s *Subscriber) {
+		s.httpVersions = make(map[string]bool, len(allowlist))
+		for _, v := range allowlist {
+			s.httpVersions[v] = true
+		}
+	}
+}
+
+// WithFleetTotals makes the subscriber add the requests and bytes delivered in
+// every datacenter it processes to the given counters, which are meant to be
+// shared by all subscribers, so they total the whole fleet of services. Bytes
+// are counted like the BytesTotal metric. By default, no fleet totals are kept.
+func WithFleetTotals(requests, bytes prometheus.Counter) SubscriberOption {
+	return func(s *Subscriber) { s.fleetRequests, s.fleetBytes = requests, bytes }
+}
+
+// WithForbiddenLimit makes the subscriber stop after k consecutive 403
+// Forbidden responses from the real-time stats API, which usually mean the
+// token can't access the service. Run then returns ErrForbidden, and the
+// Forbidden gauge is set for the service, until a later subscriber for it gets
+// a successful response. By default, the subscriber keeps trying forever.
+func WithForbiddenLimit(k int) SubscriberOption {
+	return func(s *Subscriber) { s.forbiddenLimit = k }
+}
+
+// WithDatacenterFilter restricts the subscriber to process data only for those
+// datacenters whose codes pass the provided filter. Every datacenter dropped by
+// the filter is counted in the DatacentersFilteredTotal metric, once per bucket.
+// By default, no datacenter filtering occurs.
+func WithDatacenterFilter(f filter.Filter) SubscriberOption {
+	return func(s *Subscriber) { s.dcFilter = f }
+}
+
+// WithDatacenterCatchAll causes the subscriber to report data for datacenters
+// whose codes don't pass the known filter under the catch-all label value,
+// e.g. "other", rather than under their own codes. This bounds the cardinality
+// of the datacenter label without losing any traffic. Datacenters dropped by
+// the datacenter filter are dropped, not folded. By default, every datacenter
+// is reported under its own code.
+func WithDatacenterCatchAll(known filter.Filter, catchAll string) SubscriberOption {
+	return func(s *Subscriber) { s.knownDCs, s.catchAll = known, catchAll }
+}
+
+// WithDatacenterOverride causes the subscriber to report data for every
+// datacenter under the given label value, regardless of the datacenter codes in
+// the response. That's useful for accounts which effectively serve from a
+// single datacenter, where the label is noise but is still needed for joins.
+// It takes precedence over WithDatacenterCatchAll. By default, every datacenter
+// is reported under its own code.
+func WithDatacenterOverride(label string) SubscriberOption {
+	return func(s *Subscriber) { s.dcOverride = label }
+}
+
+// WithDatacenterSampling restricts the subscriber to process data for only one
+// in every k datacenters, chosen by a hash of the datacenter code. The same
+// datacenters are kept for every bucket, and by every subscriber, so the
+// cardinality of the datacenter label scales down predictably, and the series
+// remain stable across scrapes. Datacenters which aren't sampled are counted
+// in the DatacentersFilteredTotal metric, like those dropped by the datacenter
+// filter. By default, or if k is 1 or less, every datacenter is processed.
+func WithDatacenterSampling(k uint64) SubscriberOption {
+	return func(s *Subscriber) { s.dcSample = k }
+}
+
+// WithDatacenterLimit caps the number of distinct datacenter label values the
+// subscriber reports for its service at k. Once k are tracked, data for any
+// further datacenter is reported under the overflow label value, e.g. "other",
+// and counted in the DatacenterOverflowTotal metric, once per bucket. That's a
+// safety valve against a runaway datacenter list. The overflow label itself
+// doesn't count toward the cap. By default, or if k is 0 or less, there's no
+// cap.
+func WithDatacenterLimit(k int, overflow string) SubscriberOption {
+	return func(s *Subscriber) { s.dcLimit, s.dcOverflow = k, overflow }
+}
+
+// WithRenameGrace sets how long the series under a service's old name are kept
+// after the service is renamed, before they're pruned. During the grace period,
+// the series under both names coexist, which avoids a gap for queries that
+// match on the name. By default, the old series are pruned immediately.
+func WithRenameGrace(d time.Duration) SubscriberOption {
+	return func(s *Subscriber) { s.renameGrace = d }
+}
+
+// WithServiceNameSanitizer rewrites the service name before it's used as the
+// service_name label value, e.g. to replace whitespace and control characters
+// that are awkward for downstream tooling. While enabled, the service_name_info
+// metric maps each sanitized name to its raw name. By default, service names
+// are used as-is.
+func WithServiceNameSanitizer(sanitize func(name string) string) SubscriberOption {
+	return func(s *Subscriber) { s.sanitizeName = sanitize }
+}
+
+// WithMinimumBucketAge defers processing each bucket of real-time data until
+// its recorded timestamp is at least the given age. The most recent buckets can
+// be incomplete and later revised, so a small age (e.g. 2s) trades freshness
+// for accuracy. If a deferred bucket is revised in a later response, only the
+// revision is processed. By default, buckets are processed immediately.
+func WithMinimumBucketAge(age time.Duration) SubscriberOption {
+	return func(s *Subscriber) { s.minBucketAge = age }
+}
+
+// WithPollInterval sets the minimum interval between the starts of successive
+// requests to the real-time stats API, which reduces the request rate at the
+// cost of freshness. No data is lost, since each response includes all buckets
+// since the previous one. If the subscriber's service ID has an override, that
+// interval is used instead. By default, requests are made back to back.
+func WithPollInterval(interval time.Duration, overrides map[string]time.Duration) SubscriberOption {
+	return func(s *Subscriber) {
+		s.pollInterval = interval
+		if override, ok := overrides[s.serviceID]; ok {
+			s.pollInterval = override
+		}
+	}
+}
+
+// WithAlwaysPresent causes the subscriber to create the named metrics, by their
+// fully-qualified names, with zero values for every datacenter before any data
+// is received, so they're always present in the exported metrics. Only metrics
+// whose labels are exactly service_id, service_name, and datacenter can be
+// created in this way; others are ignored. By default, metrics only appear once
+// the corresponding data is received.
+func WithAlwaysPresent(datacenters DatacenterProvider, names ...string) SubscriberOption {
+	return func(s *Subscriber) { s.datacenters, s.alwaysPresent = datacenters, names }
+}
+
+// WithReplay causes the subscriber to start with real-time data from the replay
+// timestamp, if its service hasn't already been replayed, and then continue
+// with live data. By default, subscribers start with the most recent data.
+func WithReplay(r *Replay) SubscriberOption {
+	return func(s *Subscriber) { s.replay = r }
+}
+
+// WithClock sets the function used by the subscriber to get the current time.
+// By default, time.Now is used. This option is only useful for tests.
+func WithClock(now func() time.Time) SubscriberOption {
+	return func(s *Subscriber) { s.now = now }
+}
+
 // NewSubscriber returns a ready-to-use subscriber.
 // Run must be called to update the metrics.
 func NewSubscriber(client HTTPClient, token, serviceID string, metrics *gen.Metrics, options ...SubscriberOption) *Subscriber {
@@ -73,8 +370,12 @@ func NewSubscriber(client HTTPClient, token, serviceID string, metrics *gen.Metr
 		serviceID:   serviceID,
 		metrics:     metrics,
 		provider:    nopMetadataProvider{},
+		comments:    nopVersionCommentProvider{},
+		datacenters: nopDatacenterProvider{},
 		postprocess: func() {},
 		logger:      log.NewNopLogger(),
+		deferred:    map[uint64]map[string]gen.Datacenter{},
+		now:         time.Now,
 	}
 	for _, option := range options {
 		option(s)
@@ -86,20 +387,34 @@ func NewSubscriber(client HTTPClient, token, serviceID string, metrics *gen.Metr
 // and emitting it to the Prometheus metrics provided to the constructor. The
 // method returns when the context is canceled, or a non-recoverable error
 // occurs.
+//
+// Each request is made only after the previous one has been processed, so no
+// matter how long a request takes, there's never more than one request in
+// flight, or more than one response being processed, per subscriber.
 func (s *Subscriber) Run(ctx context.Context) error {
-	var ts uint64
+	ts := s.replay.start(s.serviceID)
+	s.started = s.now()
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 
 		default:
+			begin := time.Now()
 			name, result, delay, newts, fatal := s.query(ctx, ts)
+			if ctx.Err() != nil {
+				return ctx.Err() // canceled, e.g. reaped, so leave the metrics to any replacement
+			}
 			s.metrics.RealtimeAPIRequestsTotal.WithLabelValues(s.serviceID, name, string(result)).Inc()
 			if fatal != nil {
 				return fatal
 			}
 			s.metrics.LastSuccessfulResponse.WithLabelValues(s.serviceID, name).Set(float64(time.Now().Unix()))
+			atomic.StoreInt64(&s.progress, time.Now().UnixNano())
+			s.metrics.PollIntervalSeconds.WithLabelValues(s.serviceID, name).Set(s.pollInterval.Seconds())
+			if wait := s.pollInterval - time.Since(begin); wait > delay {
+				delay = wait
+			}
 			if delay > 0 {
 				contextSleep(ctx, delay)
 			}
@@ -108,6 +423,39 @@ func (s *Subscriber) Run(ctx context.Context) error {
 	}
 }
 
+// LastProgress returns when the subscriber last completed a request to the
+// real-time stats API, whatever its result, or the zero time if it hasn't yet.
+func (s *Subscriber) LastProgress() time.Time {
+	if ns := atomic.LoadInt64(&s.progress); ns > 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// LastError returns the most recent error the subscriber encountered while
+// fetching real-time data, and when it happened. The message is capped at
+// maxErrorLength bytes, and the token is redacted from it. If the subscriber
+// hasn't encountered any error, ok is false.
+func (s *Subscriber) LastError() (msg string, at time.Time, ok bool) {
+	s.errMtx.Lock()
+	defer s.errMtx.Unlock()
+	return s.lastErr, s.lastErrAt, s.lastErr != ""
+}
+
+// recordError saves the error message for LastError.
+func (s *Subscriber) recordError(msg string) {
+	if s.token != "" {
+		msg = strings.Replace(msg, s.token, "<redacted>", -1)
+	}
+	if len(msg) > maxErrorLength {
+		msg = msg[:maxErrorLength] + "..."
+	}
+
+	s.errMtx.Lock()
+	defer s.errMtx.Unlock()
+	s.lastErr, s.lastErrAt = msg, s.now()
+}
+
 // query rt.fastly.com for the service ID represented by the subscriber, and
 // with the provided starting timestamp. The function may block for several
 // seconds; cancel the context to provoke early termination. On success, the
@@ -125,7 +473,20 @@ func (s *Subscriber) query(ctx context.Context, ts uint64) (currentName string,
 	if !found {
 		name, version = s.serviceID, "unknown"
 	}
+	if comment, ok := s.comments.VersionComment(s.serviceID); found && ok && comment != "" {
+		version = comment
+	}
+	if s.sanitizeName != nil {
+		raw := name
+		name = s.sanitizeName(raw)
+		if s.lastRawName != "" && s.lastRawName != raw && s.sanitizeName(s.lastRawName) == name {
+			s.metrics.ServiceNameInfo.DeleteLabelValues(s.serviceID, name, s.lastRawName) // renamed to an equivalent name
+		}
+		s.lastRawName = raw
+		s.metrics.ServiceNameInfo.WithLabelValues(s.serviceID, name, raw).Set(1)
+	}
 	s.metrics.ServiceInfo.WithLabelValues(s.serviceID, name, version).Set(1)
+	s.zeroInitialize(name)
 
 	// rt.fastly.com blocks until it has data to return.
 	// It's safe to call in a (single-threaded!) hot loop.
@@ -137,19 +498,60 @@ func (s *Subscriber) query(ctx context.Context, ts uint64) (currentName string,
 
 	req.Header.Set("Fastly-Key", s.token)
 	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
 	resp, err := s.client.Do(req.WithContext(ctx))
 	if err != nil {
 		levelForError(s.logger, err).Log("during", "execute request", "err", err)
+		if ctx.Err() == nil {
+			s.recordError(err.Error())
+		}
 		return name, apiResultError, time.Second, ts, nil
 	}
 
-	var response gen.APIResponse
-	if err := jsoniterAPI.NewDecoder(resp.Body).Decode(&response); err != nil {
+	// A request that was wedged, e.g. on a broken connection, can complete
+	// after the subscriber is canceled and replaced. Its response mustn't be
+	// processed into the metrics the replacement writes to.
+	if ctx.Err() != nil {
 		resp.Body.Close()
+		return name, apiResultError, 0, ts, ctx.Err()
+	}
+
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		s.metrics.ClockSkewSeconds.WithLabelValues(s.serviceID, name).Set(s.now().Sub(date).Seconds())
+	}
+
+	body, err := readBody(resp)
+	if err != nil {
+		if isDecompressError(err) {
+			s.metrics.DecodeErrorsTotal.WithLabelValues(s.serviceID, name, "gzip").Inc()
+			level.Error(s.logger).Log("during", "decompress response", "err", err)
+		} else {
+			levelForError(s.logger, err).Log("during", "read response", "err", err)
+		}
+		if ctx.Err() == nil {
+			s.recordError(err.Error())
+		}
+		return name, apiResultError, time.Second, ts, nil
+	}
+	if ctx.Err() != nil {
+		return name, apiResultError, 0, ts, ctx.Err()
+	}
+
+	// An empty body isn't a decode error, just a response with nothing in it.
+	// Still, back off briefly, so a misbehaving server can't spin us.
+	if resp.StatusCode == http.StatusOK && len(bytes.TrimSpace(body)) == 0 {
+		s.metrics.EmptyResponsesTotal.WithLabelValues(s.serviceID, name).Inc()
+		level.Debug(s.logger).Log("status_code", resp.StatusCode, "msg", "empty response")
+		return name, apiResultNoData, time.Second, ts, nil
+	}
+
+	var response gen.APIResponse
+	if err := jsoniterAPI.Unmarshal(body, &response); err != nil {
+		s.metrics.DecodeErrorsTotal.WithLabelValues(s.serviceID, name, decodeErrorKind(body, err)).Inc()
 		level.Error(s.logger).Log("during", "decode response", "err", err)
+		s.recordError(err.Error())
 		return name, apiResultError, time.Second, ts, nil
 	}
-	resp.Body.Close()
 
 	apiErr := response.Error
 	if apiErr == "" {
@@ -159,21 +561,46 @@ func (s *Subscriber) query(ctx context.Context, ts uint64) (currentName string,
 	switch resp.StatusCode {
 	case http.StatusOK:
 		level.Debug(s.logger).Log("status_code", resp.StatusCode, "response_ts", response.Timestamp, "err", apiErr)
+		s.forbidden = 0
+		if !s.cleared {
+			s.metrics.Forbidden.DeleteLabelValues(s.serviceID, name)
+			s.cleared = true
+		}
 		if strings.Contains(apiErr, "No data available") {
 			result = apiResultNoData
 		} else {
 			result = apiResultSuccess
 		}
-		gen.Process(&response, s.serviceID, name, version, s.metrics)
+		s.pruneRenamed(name)
+		s.process(&response, name)
+		if !s.firstBucket && result == apiResultSuccess && len(response.Data) > 0 {
+			s.firstBucket = true
+			s.metrics.FirstBucketLatencySeconds.WithLabelValues(s.serviceID, name).Set(s.now().Sub(s.started).Seconds())
+		}
+		if oldest, ok := s.oldestPending(response.Timestamp); ok {
+			s.metrics.OldestPendingBucketAgeSeconds.WithLabelValues(s.serviceID, name).Set(s.now().Sub(time.Unix(int64(oldest), 0)).Seconds())
+		}
 		s.postprocess()
 
 	case http.StatusUnauthorized, http.StatusForbidden:
 		result = apiResultError
+		s.recordError(fmt.Sprintf("status code %d: %s", resp.StatusCode, apiErr))
+		if resp.StatusCode == http.StatusForbidden {
+			s.forbidden++
+		} else {
+			s.forbidden = 0
+		}
+		if s.forbiddenLimit > 0 && s.forbidden >= s.forbiddenLimit {
+			s.metrics.Forbidden.WithLabelValues(s.serviceID, name).Set(1)
+			return name, result, 0, ts, ErrForbidden
+		}
 		level.Error(s.logger).Log("status_code", resp.StatusCode, "response_ts", response.Timestamp, "err", apiErr, "msg", "token may be invalid")
 		delay = 15 * time.Second
 
 	default:
 		result = apiResultUnknown
+		s.forbidden = 0
+		s.recordError(fmt.Sprintf("status code %d: %s", resp.StatusCode, apiErr))
 		level.Error(s.logger).Log("status_code", resp.StatusCode, "response_ts", response.Timestamp, "err", apiErr)
 		delay = 5 * time.Second
 	}
@@ -181,12 +608,470 @@ func (s *Subscriber) query(ctx context.Context, ts uint64) (currentName string,
 	return name, result, delay, response.Timestamp, nil
 }
 
+// pruneRenamed deletes the series under the names the service had before it
+// was renamed, once the rename grace period has passed.
+func (s *Subscriber) pruneRenamed(name string) {
+	if s.lastName != "" && s.lastName != name {
+		if s.renamedAway == nil {
+			s.renamedAway = map[string]time.Time{}
+		}
+		s.renamedAway[s.lastName] = s.now().Add(s.renameGrace)
+	}
+	s.lastName = name
+	delete(s.renamedAway, name) // renamed back
+
+	for old, at := range s.renamedAway {
+		if s.now().Before(at) {
+			continue
+		}
+		level.Debug(s.logger).Log("service_name", old, "msg", "pruning series under old service name")
+		deleteSeries(s.metrics, prometheus.Labels{"service_id": s.serviceID, "service_name": old})
+		delete(s.renamedAway, old)
+	}
+}
+
+// deleteSeries deletes every series of every metric whose labels include all of
+// the match labels.
+func deleteSeries(m *gen.Metrics, match prometheus.Labels) {
+	type deleter interface {
+		prometheus.Collector
+		Delete(prometheus.Labels) bool
+	}
+
+	v := reflect.ValueOf(m).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		vec, ok := v.Field(i).Interface().(deleter)
+		if !ok {
+			continue
+		}
+
+		ch := make(chan prometheus.Metric)
+		go func() { vec.Collect(ch); close(ch) }()
+
+		var matched []prometheus.Labels
+		for metric := range ch {
+			var pb dto.Metric
+			if err := metric.Write(&pb); err != nil {
+				continue
+			}
+			labels := prometheus.Labels{}
+			for _, pair := range pb.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			if containsLabels(labels, match) {
+				matched = append(matched, labels)
+			}
+		}
+		for _, labels := range matched {
+			vec.Delete(labels)
+		}
+	}
+}
+
+func containsLabels(labels, match prometheus.Labels) bool {
+	for name, value := range match {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// zeroInitialize creates the always-present metrics for every datacenter, once
+// per service name. It's retried until the datacenters are known.
+func (s *Subscriber) zeroInitialize(name string) {
+	if len(s.alwaysPresent) == 0 || name == s.zeroedName {
+		return
+	}
+
+	datacenters := s.datacenters.DatacenterCodes()
+	if len(datacenters) == 0 {
+		return
+	}
+
+	for _, metricName := range s.alwaysPresent {
+		c := s.metrics.ByName(metricName)
+		if c == nil {
+			level.Debug(s.logger).Log("during", "zero initialize", "metric", metricName, "err", "no such metric")
+			continue
+		}
+		for _, code := range datacenters {
+			var (
+				datacenter = s.datacenterLabel(code)
+				err        error
+			)
+			switch vec := c.(type) {
+			case *prometheus.CounterVec:
+				_, err = vec.GetMetricWithLabelValues(s.serviceID, name, datacenter)
+			case *prometheus.GaugeVec:
+				_, err = vec.GetMetricWithLabelValues(s.serviceID, name, datacenter)
+			case *prometheus.HistogramVec:
+				_, err = vec.GetMetricWithLabelValues(s.serviceID, name, datacenter)
+			default:
+				err = fmt.Errorf("unsupported metric type %T", c)
+			}
+			if err != nil {
+				level.Debug(s.logger).Log("during", "zero initialize", "metric", metricName, "err", err)
+				break
+			}
+		}
+	}
+
+	s.zeroedName = name
+}
+
+// process updates the Prometheus metrics with the real-time data in the
+// response, bucket by bucket and datacenter by datacenter. If a minimum bucket
+// age is set, buckets are deferred until they're old enough, and a deferred
+// bucket is replaced if a later response contains a revision of it.
+func (s *Subscriber) process(response *gen.APIResponse, name string) {
+	if s.minBucketAge <= 0 {
+		for _, d := range response.Data {
+			s.processBucket(d.Recorded, d.Datacenter, name)
+		}
+		return
+	}
+
+	for _, d := range response.Data {
+		s.deferred[d.Recorded] = d.Datacenter
+	}
+
+	cutoff := uint64(s.now().Add(-s.minBucketAge).Unix())
+	recorded := make([]uint64, 0, len(s.deferred))
+	for r := range s.deferred {
+		if r <= cutoff {
+			recorded = append(recorded, r)
+		}
+	}
+	sort.Slice(recorded, func(i, j int) bool { return recorded[i] < recorded[j] })
+
+	for _, r := range recorded {
+		s.processBucket(r, s.deferred[r], name)
+		delete(s.deferred, r)
+	}
+}
+
+// datacenterLabel returns the datacenter label value for a datacenter code,
+// which is the code itself unless it's overridden or folded into the catch-all
+// value.
+func (s *Subscriber) datacenterLabel(code string) string {
+	if s.dcOverride != "" {
+		return s.dcOverride
+	}
+	if s.catchAll != "" && !s.knownDCs.Permit(code) {
+		return s.catchAll
+	}
+	return code
+}
+
+// limitDatacenter returns the datacenter label value to report data under,
+// which is the given label unless the datacenter limit has been reached, and
+// the label isn't already tracked.
+func (s *Subscriber) limitDatacenter(label, name string) string {
+	if s.dcLimit <= 0 || label == s.dcOverflow || s.dcTracked[label] {
+		return label
+	}
+	if len(s.dcTracked) >= s.dcLimit {
+		s.metrics.DatacenterOverflowTotal.WithLabelValues(s.serviceID, name).Inc()
+		return s.dcOverflow
+	}
+	if s.dcTracked == nil {
+		s.dcTracked = map[string]bool{}
+	}
+	s.dcTracked[label] = true
+	return label
+}
+
+// sampled returns true if the datacenter is among those kept by datacenter
+// sampling, which is all of them unless sampling is enabled.
+func (s *Subscriber) sampled(code string) bool {
+	return s.dcSample <= 1 || xxhash.Sum64String(code)%s.dcSample == 0
+}
+
+// oldestPending returns the recorded timestamp of the oldest bucket that hasn't
+// been processed. That's the oldest deferred bucket, if any, or else the next
+// bucket to be fetched, which starts at the given timestamp.
+func (s *Subscriber) oldestPending(next uint64) (recorded uint64, ok bool) {
+	recorded, ok = next, next > 0
+	for r := range s.deferred {
+		if !ok || r < recorded {
+			recorded, ok = r, true
+		}
+	}
+	return recorded, ok
+}
+
+// processBucket updates the Prometheus metrics with the real-time data in a
+// single bucket, datacenter by datacenter, and records the bucket's timestamp.
+func (s *Subscriber) processBucket(recorded uint64, datacenters map[string]gen.Datacenter, name string) {
+	var (
+		requests     = map[string]uint64{}
+		serverErrors = map[string]uint64{}
+	)
+	for datacenter, stats := range datacenters {
+		if !s.dcFilter.Permit(datacenter) || !s.sampled(datacenter) {
+			s.metrics.DatacentersFilteredTotal.WithLabelValues(s.serviceID, name).Inc()
+			continue
+		}
+		if s.skipIdle && stats.Empty() {
+			continue
+		}
+		label := s.limitDatacenter(s.datacenterLabel(datacenter), name)
+		gen.ProcessDatacenter(&stats, s.serviceID, name, label, s.metrics)
+		s.observeByteSizes(&stats, label, name)
+		if s.httpVersions != nil {
+			s.countHTTPVersions(&stats, label, name)
+		}
+		if s.fleetRequests != nil {
+			s.fleetRequests.Add(float64(stats.Requests))
+			s.fleetBytes.Add(float64(stats.EdgeRespHeaderBytes + stats.EdgeRespBodyBytes))
+		}
+		requests[label] += stats.Requests
+		serverErrors[label] += stats.Status5xx
+	}
+
+	if s.requestRates {
+		s.updateRequestRates(recorded, requests, name)
+	}
+	if s.smoothing > 0 {
+		s.updateSmoothedRate(recorded, requests, name)
+	}
+	if s.dcShares {
+		s.updateDatacenterShares(requests, name)
+	}
+	if s.errorRatios {
+		s.updateErrorRatios(requests, serverErrors, name)
+	}
+
+	s.metrics.LastBucketTimestamp.WithLabelValues(s.serviceID, name).Set(float64(recorded))
+}
+
+// observeByteSizes observes the configured byte size fields of the stats for a
+// single datacenter in the ByteSizeBytes histogram.
+func (s *Subscriber) observeByteSizes(stats *gen.Datacenter, label, name string) {
+	v := reflect.ValueOf(stats).Elem()
+	for _, f := range s.byteSizeFields {
+		n := v.Field(byteSizeFieldIndex[f]).Uint()
+		s.metrics.ByteSizeBytes.WithLabelValues(s.serviceID, name, label, f).Observe(float64(n))
+	}
+}
+
+// countHTTPVersions adds the requests of a single datacenter to the
+// HTTPVersionRequestsTotal counter, by HTTP version.
+func (s *Subscriber) countHTTPVersions(stats *gen.Datacenter, label, name string) {
+	nonHTTP2 := uint64(0)
+	if stats.Requests > stats.HTTP2 {
+		nonHTTP2 = stats.Requests - stats.HTTP2
+	}
+	for _, v := range []struct {
+		version string
+		n       uint64
+	}{
+		{"2", stats.HTTP2},
+		{"non_http2", nonHTTP2},
+	} {
+		version := v.version
+		if !s.httpVersions[version] {
+			version = "other"
+		}
+		s.metrics.HTTPVersionRequestsTotal.WithLabelValues(s.serviceID, name, label, version).Add(float64(v.n))
+	}
+}
+
+// byteSizeFieldIndex maps the JSON key of each byte size field in the
+// per-datacenter real-time data to its index in the gen.Datacenter struct.
+var byteSizeFieldIndex = func() map[string]int {
+	index := map[string]int{}
+	t := reflect.TypeOf(gen.Datacenter{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Type.Kind() == reflect.Uint64 && strings.HasSuffix(key, "_bytes") {
+			index[key] = i
+		}
+	}
+	return index
+}()
+
+// IsByteSizeField returns true if the key names a field of the per-datacenter
+// real-time data which counts bytes, e.g. resp_body_bytes, and so can be used
+// with WithByteSizeHistograms.
+func IsByteSizeField(key string) bool {
+	_, ok := byteSizeFieldIndex[key]
+	return ok
+}
+
+// updateRequestRates sets the RequestsPerSecond gauge for each datacenter label
+// to its requests in the bucket, divided by the seconds elapsed since the
+// previous bucket. Labels which were set for the previous bucket but aren't in
+// this one are deleted, rather than left with a stale rate. The first bucket
+// only sets the baseline, and buckets that aren't newer are ignored.
+func (s *Subscriber) updateRequestRates(recorded uint64, requests map[string]uint64, name string) {
+	if recorded <= s.lastRecorded {
+		return
+	}
+
+	previous := s.lastRecorded
+	s.lastRecorded = recorded
+	if previous == 0 {
+		return
+	}
+
+	elapsed := float64(recorded - previous)
+	for label := range s.rateLabels {
+		if _, ok := requests[label]; !ok {
+			s.metrics.RequestsPerSecond.DeleteLabelValues(s.serviceID, name, label)
+		}
+	}
+	s.rateLabels = make(map[string]bool, len(requests))
+	for label, n := range requests {
+		s.metrics.RequestsPerSecond.WithLabelValues(s.serviceID, name, label).Set(float64(n) / elapsed)
+		s.rateLabels[label] = true
+	}
+}
+
+// updateSmoothedRate folds the service's requests in the bucket, divided by the
+// seconds elapsed since the previous bucket, into the RequestsRateSmoothed
+// gauge. The first bucket only sets the baseline, and the second sets the
+// initial average. Buckets that aren't newer are ignored.
+func (s *Subscriber) updateSmoothedRate(recorded uint64, requests map[string]uint64, name string) {
+	if recorded <= s.smoothedLast {
+		return
+	}
+
+	previous := s.smoothedLast
+	s.smoothedLast = recorded
+	if previous == 0 {
+		return
+	}
+
+	var total uint64
+	for _, n := range requests {
+		total += n
+	}
+	rate := float64(total) / float64(recorded-previous)
+	if s.smoothedOK {
+		rate = s.smoothing*rate + (1-s.smoothing)*s.smoothedRate
+	}
+	s.smoothedRate, s.smoothedOK = rate, true
+	s.metrics.RequestsRateSmoothed.WithLabelValues(s.serviceID, name).Set(rate)
+}
+
+// updateDatacenterShares sets the DatacenterShare gauge for each datacenter
+// label to its share of the requests in the bucket. Labels which were set for
+// the previous bucket but aren't in this one are deleted. If the bucket has no
+// requests, shares are undefined, so every label is deleted.
+func (s *Subscriber) updateDatacenterShares(requests map[string]uint64, name string) {
+	var total uint64
+	for _, n := range requests {
+		total += n
+	}
+
+	next := make(map[string]bool, len(requests))
+	if total > 0 {
+		for label, n := range requests {
+			s.metrics.DatacenterShare.WithLabelValues(s.serviceID, name, label).Set(float64(n) / float64(total))
+			next[label] = true
+		}
+	}
+	for label := range s.shareLabels {
+		if !next[label] {
+			s.metrics.DatacenterShare.DeleteLabelValues(s.serviceID, name, label)
+		}
+	}
+	s.shareLabels = next
+}
+
+// updateErrorRatios sets the ErrorRatio gauge for each datacenter label with
+// requests in the bucket to its 5xx responses divided by its requests. Labels
+// without requests in this bucket are deleted, rather than left with a stale
+// ratio.
+func (s *Subscriber) updateErrorRatios(requests, serverErrors map[string]uint64, name string) {
+	next := make(map[string]bool, len(requests))
+	for label, n := range requests {
+		if n > 0 {
+			s.metrics.ErrorRatio.WithLabelValues(s.serviceID, name, label).Set(float64(serverErrors[label]) / float64(n))
+			next[label] = true
+		}
+	}
+	for label := range s.errorLabels {
+		if !next[label] {
+			s.metrics.ErrorRatio.DeleteLabelValues(s.serviceID, name, label)
+		}
+	}
+	s.errorLabels = next
+}
+
 //
 //
 //
 
+// ErrForbidden is returned by Run when the subscriber stops after repeated 403
+// Forbidden responses, per WithForbiddenLimit.
+var ErrForbidden = errors.New("real-time stats API repeatedly responded 403 Forbidden")
+
 var jsoniterAPI = jsoniter.ConfigFastest
 
+// maxErrorLength caps the length of the message returned by LastError, as
+// error messages can include arbitrarily large response bodies.
+const maxErrorLength = 512
+
+// readBody reads and closes the body of the response, decompressing it if it's
+// gzip-encoded. Setting Accept-Encoding explicitly disables the transparent
+// decompression of http.Transport, so it has to be done here.
+func readBody(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing response: %w", err)
+	}
+	defer gz.Close()
+
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return body, fmt.Errorf("error decompressing response: %w", err)
+	}
+	return body, nil
+}
+
+// isDecompressError returns true if the error from readBody means the body
+// wasn't valid gzip, as opposed to failing to read it, e.g. due to a timeout,
+// a broken connection, or a canceled context.
+func isDecompressError(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.As(err, &corrupt)
+}
+
+// decodeErrorKind classifies an error reading or decoding a real-time stats
+// API response body as "truncated", "type", "syntax", or "unknown". Errors from
+// jsoniter are opaque, so the body is decoded again with encoding/json, whose
+// errors are typed. That's only done on the error path, where it's cheap enough.
+func decodeErrorKind(body []byte, err error) string {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return "truncated"
+	}
+
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch err := json.Unmarshal(body, &gen.APIResponse{}); {
+	case errors.As(err, &typeErr):
+		return "type"
+	case errors.As(err, &syntaxErr) && syntaxErr.Error() == "unexpected end of JSON input":
+		return "truncated"
+	case errors.As(err, &syntaxErr):
+		return "syntax"
+	default:
+		return "unknown"
+	}
+}
+
 type apiResult string
 
 const (
@@ -200,6 +1085,14 @@ type nopMetadataProvider struct{}
 
 func (nopMetadataProvider) Metadata(string) (string, int, bool) { return "", 0, false }
 
+type nopVersionCommentProvider struct{}
+
+func (nopVersionCommentProvider) VersionComment(string) (string, bool) { return "", false }
+
+type nopDatacenterProvider struct{}
+
+func (nopDatacenterProvider) DatacenterCodes() []string { return nil }
+
 func contextSleep(ctx context.Context, d time.Duration) {
 	select {
 	case <-time.After(d):
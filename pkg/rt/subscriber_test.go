@@ -2,15 +2,22 @@ package rt_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/fastly/fastly-exporter/pkg/api"
 	"github.com/fastly/fastly-exporter/pkg/filter"
 	"github.com/fastly/fastly-exporter/pkg/gen"
 	"github.com/fastly/fastly-exporter/pkg/rt"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestSubscriberFixture(t *testing.T) {
@@ -30,7 +37,8 @@ func TestSubscriberFixture(t *testing.T) {
 		cache          = &mockCache{}
 		processed      = make(chan struct{})
 		postprocess    = func() { close(processed) }
-		options        = []rt.SubscriberOption{rt.WithMetadataProvider(cache), rt.WithPostprocess(postprocess)}
+		now            = func() time.Time { return time.Unix(1603401013+3, 0) } // 3s after the fixture timestamp
+		options        = []rt.SubscriberOption{rt.WithMetadataProvider(cache), rt.WithPostprocess(postprocess), rt.WithClock(now)}
 		subscriber     = rt.NewSubscriber(client, "irrelevant token", serviceID, metrics, options...)
 	)
 	cache.update([]api.Service{{ID: serviceID, Name: serviceName, Version: serviceVersion}})
@@ -93,3 +101,1076 @@ func TestBadTokenNoSpam(t *testing.T) {
 		t.Fatalf("Unauthorized rt.fastly.com request count: want %d, have %d", want, have)
 	}
 }
+
+func TestSubscriberSkipIdleDatacenters(t *testing.T) {
+	var (
+		client      = newMockRealtimeClient(`{"Data":[{"datacenter":{"AMS":{"requests":3},"LHR":{}}}],"Timestamp":123}`, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess), rt.WithSkipIdleDatacenters(true)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+
+	output := prometheusOutput(t, registry, "ns_ss_")
+	if want, have := 3.0, output[`ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`]; want != have {
+		t.Errorf("AMS requests: want %v, have %v", want, have)
+	}
+	for series := range output {
+		if strings.Contains(series, `datacenter="LHR"`) {
+			t.Errorf("idle datacenter: unexpected series %s", series)
+		}
+	}
+}
+
+func TestSubscriberBaseLabels(t *testing.T) {
+	var (
+		client      = newMockRealtimeClient(rtResponseFixture, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess), rt.WithDatacenterLimit(2, "other")} // so some datacenters overflow
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+
+	families, err := registry.Gather()
+	assertNoErr(t, err)
+
+	nonDatacenter := map[string]bool{
+		"ns_ss_realtime_api_requests_total":       true,
+		"ns_ss_service_info":                      true,
+		"ns_ss_last_successful_response":          true,
+		"ns_ss_datacenters_filtered_total":        true,
+		"ns_ss_clock_skew_seconds":                true,
+		"ns_ss_oldest_pending_bucket_age_seconds": true,
+		"ns_ss_poll_interval_seconds":             true,
+		"ns_ss_first_bucket_latency_seconds":      true,
+		"ns_ss_last_bucket_timestamp":             true,
+		"ns_ss_datacenter_overflow_total":         true,
+	}
+
+	seen := map[string]bool{}
+	for _, family := range families {
+		seen[family.GetName()] = true
+		want := []string{"service_id", "service_name", "datacenter"}
+		if nonDatacenter[family.GetName()] {
+			want = want[:2]
+		}
+		for _, metric := range family.GetMetric() {
+			have := map[string]bool{}
+			for _, pair := range metric.GetLabel() {
+				have[pair.GetName()] = true
+			}
+			for _, label := range want {
+				if !have[label] {
+					t.Errorf("%s: missing base label %q", family.GetName(), label)
+				}
+			}
+		}
+	}
+	if !seen["ns_ss_datacenter_overflow_total"] {
+		t.Errorf("ns_ss_datacenter_overflow_total: not emitted, so not checked")
+	}
+}
+
+func TestSubscriberDatacenterFilter(t *testing.T) {
+	var dcFilter filter.Filter
+	dcFilter.Block("^LHR$")
+
+	var (
+		response    = `{"Data":[{"datacenter":{"AMS":{"requests":3},"LHR":{"requests":5}}}],"Timestamp":123}`
+		client      = newMockRealtimeClient(response, response, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess), rt.WithDatacenterFilter(dcFilter)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+	client.advance()
+	<-processed
+
+	output := prometheusOutput(t, registry, "ns_ss_")
+	if want, have := 6.0, output[`ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`]; want != have {
+		t.Errorf("AMS requests: want %v, have %v", want, have)
+	}
+	if want, have := 2.0, output[`ns_ss_datacenters_filtered_total{service_id="service_id",service_name="service_id"}`]; want != have {
+		t.Errorf("datacenters filtered: want %v, have %v", want, have)
+	}
+	for series := range output {
+		if strings.Contains(series, `datacenter="LHR"`) {
+			t.Errorf("filtered datacenter: unexpected series %s", series)
+		}
+	}
+}
+
+func TestSubscriberDatacenterCatchAll(t *testing.T) {
+	var known filter.Filter
+	known.Allow("^(AMS|LHR)$")
+
+	var (
+		response    = `{"Data":[{"datacenter":{"AMS":{"requests":3},"LHR":{"requests":5},"WLG":{"requests":7},"XYZ":{"requests":11}}}],"Timestamp":123}`
+		client      = newMockRealtimeClient(response, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess), rt.WithDatacenterCatchAll(known, "other")}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+
+	want := map[string]float64{
+		`ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`:   3,
+		`ns_ss_requests_total{datacenter="LHR",service_id="service_id",service_name="service_id"}`:   5,
+		`ns_ss_requests_total{datacenter="other",service_id="service_id",service_name="service_id"}`: 18,
+	}
+	have := prometheusOutput(t, registry, "ns_ss_requests_total")
+	assertMetricOutput(t, want, have)
+}
+
+func TestSubscriberDatacenterOverride(t *testing.T) {
+	var (
+		response    = `{"Data":[{"datacenter":{"AMS":{"requests":3},"LHR":{"requests":5}}}],"Timestamp":123}`
+		client      = newMockRealtimeClient(response, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess), rt.WithDatacenterOverride("POP")}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+
+	want := map[string]float64{
+		`ns_ss_requests_total{datacenter="POP",service_id="service_id",service_name="service_id"}`: 8,
+	}
+	have := prometheusOutput(t, registry, "ns_ss_requests_total")
+	assertMetricOutput(t, want, have)
+}
+
+func TestSubscriberDatacenterSampling(t *testing.T) {
+	var (
+		// With k=3, AMS and NYC are sampled, and the rest aren't.
+		first       = `{"Data":[{"datacenter":{"AMS":{"requests":1},"LHR":{"requests":2},"NYC":{"requests":3},"SJC":{"requests":4},"FRA":{"requests":5}}}],"Timestamp":123}`
+		second      = `{"Data":[{"datacenter":{"AMS":{"requests":10},"LHR":{"requests":20},"NYC":{"requests":30},"SJC":{"requests":40}}}],"Timestamp":124}`
+		client      = newMockRealtimeClient(first, second, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess), rt.WithDatacenterSampling(3)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+	want := map[string]float64{
+		`ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`: 1,
+		`ns_ss_requests_total{datacenter="NYC",service_id="service_id",service_name="service_id"}`: 3,
+	}
+	assertMetricOutput(t, want, prometheusOutput(t, registry, "ns_ss_requests_total"))
+
+	client.advance()
+	<-processed
+	want = map[string]float64{
+		`ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`: 11,
+		`ns_ss_requests_total{datacenter="NYC",service_id="service_id",service_name="service_id"}`: 33,
+	}
+	assertMetricOutput(t, want, prometheusOutput(t, registry, "ns_ss_requests_total"))
+
+	want = map[string]float64{
+		`ns_ss_datacenters_filtered_total{service_id="service_id",service_name="service_id"}`: 5,
+	}
+	assertMetricOutput(t, want, prometheusOutput(t, registry, "ns_ss_datacenters_filtered_total"))
+}
+
+func TestSubscriberFirstBucketLatency(t *testing.T) {
+	var (
+		empty       = `{"Data":[],"Timestamp":123}`
+		response    = `{"Data":[{"datacenter":{"AMS":{"requests":1}}}],"Timestamp":124}`
+		client      = newMockRealtimeClient(empty, response, response)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		clock       = int64(1000)
+		now         = func() time.Time { return time.Unix(atomic.LoadInt64(&clock), 0) }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess), rt.WithClock(now)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed // no data yet
+	if have := prometheusOutput(t, registry, "ns_ss_first_bucket_latency_seconds"); len(have) != 0 {
+		t.Errorf("before first bucket: unexpected %v", have)
+	}
+
+	atomic.StoreInt64(&clock, 1007)
+	client.advance()
+	<-processed // first bucket
+	want := map[string]float64{
+		`ns_ss_first_bucket_latency_seconds{service_id="service_id",service_name="service_id"}`: 7,
+	}
+	assertMetricOutput(t, want, prometheusOutput(t, registry, "ns_ss_first_bucket_latency_seconds"))
+
+	atomic.StoreInt64(&clock, 1020)
+	client.advance()
+	<-processed // later buckets don't change it
+	assertMetricOutput(t, want, prometheusOutput(t, registry, "ns_ss_first_bucket_latency_seconds"))
+}
+
+func TestSubscriberRenameGrace(t *testing.T) {
+	var (
+		response    = `{"Data":[{"datacenter":{"AMS":{"requests":1}}}],"Timestamp":123}`
+		client      = newMockRealtimeClient(response)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		cache       = &mockCache{}
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		clock       = int64(1000)
+		now         = func() time.Time { return time.Unix(atomic.LoadInt64(&clock), 0) }
+		options     = []rt.SubscriberOption{rt.WithMetadataProvider(cache), rt.WithPostprocess(postprocess), rt.WithClock(now), rt.WithRenameGrace(30 * time.Second)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	cache.update([]api.Service{{ID: "service_id", Name: "old name", Version: 1}})
+	go subscriber.Run(context.Background())
+
+	<-processed
+	want := map[string]float64{
+		`ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="old name"}`: 1,
+	}
+	assertMetricOutput(t, want, prometheusOutput(t, registry, "ns_ss_requests_total"))
+
+	cache.update([]api.Service{{ID: "service_id", Name: "new name", Version: 1}})
+	client.advance()
+	<-processed // the request in flight was made under the old name
+
+	atomic.StoreInt64(&clock, 1010)
+	client.advance()
+	<-processed // within the grace period, both names coexist
+	want = map[string]float64{
+		`ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="old name"}`: 2,
+		`ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="new name"}`: 1,
+	}
+	assertMetricOutput(t, want, prometheusOutput(t, registry, "ns_ss_requests_total"))
+
+	atomic.StoreInt64(&clock, 1040)
+	client.advance()
+	<-processed // after the grace period, the old name is pruned
+	want = map[string]float64{
+		`ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="new name"}`: 2,
+	}
+	assertMetricOutput(t, want, prometheusOutput(t, registry, "ns_ss_requests_total"))
+	for series := range prometheusOutput(t, registry, "ns_ss_") {
+		if strings.Contains(series, `service_name="old name"`) {
+			t.Errorf("unexpected series after grace period: %s", series)
+		}
+	}
+}
+
+func TestSubscriberServiceNameSanitizer(t *testing.T) {
+	var (
+		response    = `{"Data":[{"datacenter":{"AMS":{"requests":1}}}],"Timestamp":123}`
+		client      = newMockRealtimeClient(response)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		cache       = &mockCache{}
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		sanitize    = func(name string) string { return strings.Join(strings.Fields(name), "_") }
+		options     = []rt.SubscriberOption{rt.WithMetadataProvider(cache), rt.WithPostprocess(postprocess), rt.WithServiceNameSanitizer(sanitize)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	cache.update([]api.Service{{ID: "service_id", Name: "my\tservice", Version: 1}})
+	go subscriber.Run(context.Background())
+
+	<-processed
+	assertMetricOutput(t, map[string]float64{
+		`ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="my_service"}`: 1,
+	}, prometheusOutput(t, registry, "ns_ss_requests_total"))
+	assertMetricOutput(t, map[string]float64{
+		`ns_ss_service_info{service_id="service_id",service_name="my_service",service_version="1"}`: 1,
+	}, prometheusOutput(t, registry, "ns_ss_service_info"))
+	if want, have := 1.0, testutil.ToFloat64(metrics.ServiceNameInfo.WithLabelValues("service_id", "my_service", "my\tservice")); want != have {
+		t.Errorf("raw service name: want %v, have %v", want, have)
+	}
+}
+
+func TestSubscriberVersionComments(t *testing.T) {
+	var (
+		client      = newMockRealtimeClient(`{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		cache       = &mockCache{}
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithMetadataProvider(cache), rt.WithVersionComments(cache), rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	cache.update([]api.Service{{ID: "service_id", Name: "service name", Version: 3, Versions: []api.Version{
+		{Number: 2, Comment: "release-1.1"},
+		{Number: 3, Comment: "release-1.2", Active: true},
+	}}})
+	go subscriber.Run(context.Background())
+
+	<-processed
+
+	want := map[string]float64{
+		`ns_ss_service_info{service_id="service_id",service_name="service name",service_version="release-1.2"}`: 1,
+	}
+	have := prometheusOutput(t, registry, "ns_ss_service_info")
+	assertMetricOutput(t, want, have)
+}
+
+func TestSubscriberRequestCollapse(t *testing.T) {
+	var (
+		response    = `{"Data":[{"datacenter":{"AMS":{"requests":10,"pass":2,"request_collapse_usable_count":4,"request_collapse_unusable_count":1}}}],"Timestamp":123}`
+		client      = newMockRealtimeClient(response, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+
+	want := map[string]float64{
+		`ns_ss_request_collapse_usable_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`:   4,
+		`ns_ss_request_collapse_unusable_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`: 1,
+	}
+	have := prometheusOutput(t, registry, "ns_ss_request_collapse_")
+	assertMetricOutput(t, want, have)
+
+	if want, have := 2.0, prometheusOutput(t, registry, "ns_ss_pass_total")[`ns_ss_pass_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`]; want != have {
+		t.Errorf("pass_total: want %v, have %v", want, have)
+	}
+}
+
+func TestSubscriberDecodeErrors(t *testing.T) {
+	var (
+		response    = `{"Data":[{"datacenter":{"AMS":{"requests":"many"}}}],"Timestamp":123}`
+		client      = newMockRealtimeClient(response, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	client.advance() // the first response fails to decode, so allow a second
+	<-processed
+
+	want := map[string]float64{
+		`ns_ss_decode_errors_total{kind="type",service_id="service_id",service_name="service_id"}`: 1,
+	}
+	have := prometheusOutput(t, registry, "ns_ss_decode_errors_total")
+	assertMetricOutput(t, want, have)
+}
+
+func TestSubscriberReadErrors(t *testing.T) {
+	for _, testcase := range []struct {
+		name   string
+		client rt.HTTPClient
+		want   map[string]float64
+	}{
+		{
+			name:   "broken connection",
+			client: brokenBodyClient{},
+			want:   map[string]float64{},
+		},
+		{
+			name:   "invalid gzip",
+			client: brokenBodyClient{gzip: true},
+			want: map[string]float64{
+				`ns_ss_decode_errors_total{kind="gzip",service_id="service_id",service_name="service_id"}`: 1,
+			},
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			var (
+				registry    = prometheus.NewRegistry()
+				metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+				subscriber  = rt.NewSubscriber(testcase.client, "token", "service_id", metrics)
+				ctx, cancel = context.WithCancel(context.Background())
+			)
+			defer cancel()
+			go subscriber.Run(ctx)
+
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if _, _, ok := subscriber.LastError(); ok {
+					break
+				}
+			}
+			if _, _, ok := subscriber.LastError(); !ok {
+				t.Fatal("no error recorded")
+			}
+			assertMetricOutput(t, testcase.want, prometheusOutput(t, registry, "ns_ss_decode_errors_total"))
+		})
+	}
+}
+
+func TestSubscriberEmptyResponses(t *testing.T) {
+	var (
+		noData      = `{"Data":[],"Timestamp":123,"Error":"No data available, please retry"}`
+		response    = `{"Data":[{"datacenter":{"AMS":{"requests":1}}}],"Timestamp":124}`
+		client      = newMockRealtimeClient(``, noData, response)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	client.advance() // the first response is empty, so allow a second
+	<-processed      // the second response has no buckets, which isn't empty
+	client.advance()
+	<-processed
+
+	var (
+		series = `{service_id="service_id",service_name="service_id"}`
+		output = prometheusOutput(t, registry, "ns_ss_")
+	)
+	if want, have := 1.0, output[`ns_ss_empty_responses_total`+series]; want != have {
+		t.Errorf("empty responses: want %v, have %v", want, have)
+	}
+	if want, have := 0.0, output[`ns_ss_realtime_api_requests_total{result="error",service_id="service_id",service_name="service_id"}`]; want != have {
+		t.Errorf("error results: want %v, have %v", want, have)
+	}
+	for k := range output {
+		if strings.HasPrefix(k, "ns_ss_decode_errors_total") {
+			t.Errorf("unexpected decode error: %s", k)
+		}
+	}
+}
+
+func TestSubscriberBytesTotal(t *testing.T) {
+	var (
+		response    = `{"Data":[{"datacenter":{"AMS":{"edge_resp_header_bytes":300,"edge_resp_body_bytes":4000}}},{"datacenter":{"AMS":{"edge_resp_header_bytes":20,"edge_resp_body_bytes":500}}}],"Timestamp":123}`
+		client      = newMockRealtimeClient(response, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+
+	want := map[string]float64{
+		`ns_ss_bytes_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`: 4820,
+	}
+	have := prometheusOutput(t, registry, "ns_ss_bytes_total")
+	assertMetricOutput(t, want, have)
+}
+
+func TestSubscriberRequestRates(t *testing.T) {
+	var (
+		first       = `{"Data":[{"datacenter":{"AMS":{"requests":4},"LHR":{"requests":2}},"recorded":100}],"Timestamp":101}`
+		second      = `{"Data":[{"datacenter":{"AMS":{"requests":10}},"recorded":102}],"Timestamp":103}`
+		client      = newMockRealtimeClient(first, second)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithRequestRates(true), rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed // bucket 100 only sets the baseline
+	assertMetricOutput(t, map[string]float64{}, prometheusOutput(t, registry, "ns_ss_requests_per_second"))
+
+	client.advance()
+	<-processed // bucket 102 has 10 requests over 2 seconds, and no LHR data
+	want := map[string]float64{
+		`ns_ss_requests_per_second{datacenter="AMS",service_id="service_id",service_name="service_id"}`: 5,
+	}
+	have := prometheusOutput(t, registry, "ns_ss_requests_per_second")
+	assertMetricOutput(t, want, have)
+}
+
+func TestSubscriberGzip(t *testing.T) {
+	var (
+		response    = `{"Data":[{"datacenter":{"AMS":{"requests":7}}}],"Timestamp":123}`
+		client      = &gzipRealtimeClient{mockRealtimeClient: newMockRealtimeClient(response)}
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+
+	if atomic.LoadUint64(&client.compressed) == 0 {
+		t.Fatal("subscriber didn't accept a gzip-encoded response")
+	}
+
+	want := map[string]float64{
+		`ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`: 7,
+	}
+	have := prometheusOutput(t, registry, "ns_ss_requests_total")
+	assertMetricOutput(t, want, have)
+}
+
+func TestSubscriberDatacenterShares(t *testing.T) {
+	var (
+		response    = `{"Data":[{"datacenter":{"AMS":{"requests":1},"LHR":{"requests":3}}}],"Timestamp":123}`
+		client      = newMockRealtimeClient(response, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithDatacenterShares(true), rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+
+	want := map[string]float64{
+		`ns_ss_datacenter_share{datacenter="AMS",service_id="service_id",service_name="service_id"}`: 0.25,
+		`ns_ss_datacenter_share{datacenter="LHR",service_id="service_id",service_name="service_id"}`: 0.75,
+	}
+	have := prometheusOutput(t, registry, "ns_ss_datacenter_share")
+	assertMetricOutput(t, want, have)
+
+	var sum float64
+	for _, share := range have {
+		sum += share
+	}
+	if math.Abs(sum-1) > 1e-9 {
+		t.Errorf("sum of shares: want 1, have %v", sum)
+	}
+}
+
+func TestSubscriberErrorRatios(t *testing.T) {
+	var (
+		first       = `{"Data":[{"datacenter":{"AMS":{"requests":8,"status_5xx":2},"LHR":{"requests":5},"NYC":{"requests":0}}}],"Timestamp":123}`
+		second      = `{"Data":[{"datacenter":{"AMS":{"requests":0},"LHR":{"requests":10,"status_5xx":1}}}],"Timestamp":124}`
+		client      = newMockRealtimeClient(first, second, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithErrorRatios(true), rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+	want := map[string]float64{
+		`ns_ss_error_ratio{datacenter="AMS",service_id="service_id",service_name="service_id"}`: 0.25,
+		`ns_ss_error_ratio{datacenter="LHR",service_id="service_id",service_name="service_id"}`: 0,
+	}
+	assertMetricOutput(t, want, prometheusOutput(t, registry, "ns_ss_error_ratio"))
+
+	client.advance()
+	<-processed
+	want = map[string]float64{
+		`ns_ss_error_ratio{datacenter="LHR",service_id="service_id",service_name="service_id"}`: 0.1,
+	}
+	assertMetricOutput(t, want, prometheusOutput(t, registry, "ns_ss_error_ratio"))
+}
+
+func TestSubscriberByteSizeHistograms(t *testing.T) {
+	var (
+		response    = `{"Data":[{"datacenter":{"AMS":{"resp_body_bytes":500,"req_body_bytes":7},"LHR":{"resp_body_bytes":5000}}}],"Timestamp":123}`
+		client      = newMockRealtimeClient(response, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithByteSizeHistograms("resp_body_bytes", "requests"), rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+	have := prometheusOutput(t, registry, "ns_ss_byte_size_bytes_bucket")
+	for bucket, want := range map[string]float64{
+		`ns_ss_byte_size_bytes_bucket{datacenter="AMS",field="resp_body_bytes",service_id="service_id",service_name="service_id",le="1024"}`:  1,
+		`ns_ss_byte_size_bytes_bucket{datacenter="LHR",field="resp_body_bytes",service_id="service_id",service_name="service_id",le="1024"}`:  0,
+		`ns_ss_byte_size_bytes_bucket{datacenter="LHR",field="resp_body_bytes",service_id="service_id",service_name="service_id",le="10240"}`: 1,
+	} {
+		if have := have[bucket]; want != have {
+			t.Errorf("%s: want %v, have %v", bucket, want, have)
+		}
+	}
+	for series := range have {
+		if !strings.Contains(series, `field="resp_body_bytes"`) {
+			t.Errorf("unexpected series %s", series)
+		}
+	}
+}
+
+func TestSubscriberHTTPVersions(t *testing.T) {
+	for _, testcase := range []struct {
+		name      string
+		allowlist []string
+		want      map[string]float64
+	}{
+		{
+			name:      "all",
+			allowlist: []string{"2", "non_http2"},
+			want: map[string]float64{
+				`ns_ss_http_version_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id",version="non_http2"}`: 6,
+				`ns_ss_http_version_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id",version="2"}`:         4,
+				`ns_ss_http_version_requests_total{datacenter="LHR",service_id="service_id",service_name="service_id",version="non_http2"}`: 3,
+				`ns_ss_http_version_requests_total{datacenter="LHR",service_id="service_id",service_name="service_id",version="2"}`:         0,
+			},
+		},
+		{
+			name:      "fold",
+			allowlist: []string{"2"},
+			want: map[string]float64{
+				`ns_ss_http_version_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id",version="2"}`:     4,
+				`ns_ss_http_version_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id",version="other"}`: 6,
+				`ns_ss_http_version_requests_total{datacenter="LHR",service_id="service_id",service_name="service_id",version="2"}`:     0,
+				`ns_ss_http_version_requests_total{datacenter="LHR",service_id="service_id",service_name="service_id",version="other"}`: 3,
+			},
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			var (
+				response    = `{"Data":[{"datacenter":{"AMS":{"requests":10,"http2":4},"LHR":{"requests":3}}}],"Timestamp":123}`
+				client      = newMockRealtimeClient(response, `{}`)
+				registry    = prometheus.NewRegistry()
+				metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+				processed   = make(chan struct{}, 100)
+				postprocess = func() { processed <- struct{}{} }
+				options     = []rt.SubscriberOption{rt.WithHTTPVersions(testcase.allowlist...), rt.WithPostprocess(postprocess)}
+				subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+			)
+			go subscriber.Run(context.Background())
+
+			<-processed
+			assertMetricOutput(t, testcase.want, prometheusOutput(t, registry, "ns_ss_http_version_requests_total"))
+		})
+	}
+}
+
+func TestSubscriberForbiddenLimit(t *testing.T) {
+	var (
+		client     = fixedResponseClient{code: http.StatusForbidden, response: `{"Error":"forbidden"}`}
+		registry   = prometheus.NewRegistry()
+		metrics    = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		subscriber = rt.NewSubscriber(client, "token", "service_id", metrics, rt.WithForbiddenLimit(1))
+		done       = make(chan error, 1)
+	)
+	go func() { done <- subscriber.Run(context.Background()) }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, rt.ErrForbidden) {
+			t.Fatalf("want %v, have %v", rt.ErrForbidden, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber didn't stop")
+	}
+
+	want := map[string]float64{
+		`ns_ss_forbidden{service_id="service_id",service_name="service_id"}`: 1,
+	}
+	assertMetricOutput(t, want, prometheusOutput(t, registry, "ns_ss_forbidden"))
+}
+
+func TestSubscriberFleetTotals(t *testing.T) {
+	var (
+		requests  = prometheus.NewCounter(prometheus.CounterOpts{Name: "fleet_requests_total"})
+		bytes     = prometheus.NewCounter(prometheus.CounterOpts{Name: "fleet_bytes_total"})
+		registry  = prometheus.NewRegistry()
+		metrics   = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed = make(chan struct{}, 100)
+		options   = []rt.SubscriberOption{rt.WithFleetTotals(requests, bytes), rt.WithPostprocess(func() { processed <- struct{}{} })}
+		first     = rt.NewSubscriber(newMockRealtimeClient(`{"Data":[{"datacenter":{"AMS":{"requests":3,"edge_resp_body_bytes":100},"LHR":{"requests":4,"edge_resp_header_bytes":20}}}],"Timestamp":1}`, `{}`), "token", "AAA", metrics, options...)
+		second    = rt.NewSubscriber(newMockRealtimeClient(`{"Data":[{"datacenter":{"NYC":{"requests":5,"edge_resp_body_bytes":300}}}],"Timestamp":1}`, `{}`), "token", "BBB", metrics, options...)
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go first.Run(ctx)
+	go second.Run(ctx)
+
+	<-processed
+	<-processed
+
+	var sumRequests, sumBytes float64
+	for _, series := range []string{"AAA", "BBB"} {
+		for _, datacenter := range []string{"AMS", "LHR", "NYC"} {
+			sumRequests += testutil.ToFloat64(metrics.RequestsTotal.WithLabelValues(series, series, datacenter))
+			sumBytes += testutil.ToFloat64(metrics.BytesTotal.WithLabelValues(series, series, datacenter))
+		}
+	}
+	if want, have := sumRequests, testutil.ToFloat64(requests); want != have || have != 12 {
+		t.Errorf("fleet requests: want %v (12), have %v", want, have)
+	}
+	if want, have := sumBytes, testutil.ToFloat64(bytes); want != have || have != 420 {
+		t.Errorf("fleet bytes: want %v (420), have %v", want, have)
+	}
+}
+
+func TestSubscriberDatacenterLimit(t *testing.T) {
+	var (
+		first       = `{"Data":[{"datacenter":{"AMS":{"requests":1},"LHR":{"requests":2}}}],"Timestamp":1}`
+		second      = `{"Data":[{"datacenter":{"AMS":{"requests":3},"JFK":{"requests":4},"SYD":{"requests":5}}}],"Timestamp":2}`
+		client      = newMockRealtimeClient(first, second, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithDatacenterLimit(2, "other"), rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+	client.advance()
+	<-processed
+
+	assertMetricOutput(t, map[string]float64{
+		`ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`:   4,
+		`ns_ss_requests_total{datacenter="LHR",service_id="service_id",service_name="service_id"}`:   2,
+		`ns_ss_requests_total{datacenter="other",service_id="service_id",service_name="service_id"}`: 9,
+	}, prometheusOutput(t, registry, "ns_ss_requests_total"))
+
+	assertMetricOutput(t, map[string]float64{
+		`ns_ss_datacenter_overflow_total{service_id="service_id",service_name="service_id"}`: 2,
+	}, prometheusOutput(t, registry, "ns_ss_datacenter_overflow_total"))
+}
+
+func TestSubscriberEdgeAndShield(t *testing.T) {
+	var (
+		response    = `{"Data":[{"datacenter":{"AMS":{"requests":5,"edge_requests":4,"shield":2},"LHR":{"requests":3,"edge_requests":3}}}],"Timestamp":123}`
+		client      = newMockRealtimeClient(response, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, rt.WithPostprocess(postprocess))
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+	assertMetricOutput(t, map[string]float64{
+		`ns_ss_edge_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`: 4,
+		`ns_ss_edge_total{datacenter="LHR",service_id="service_id",service_name="service_id"}`: 3,
+	}, prometheusOutput(t, registry, "ns_ss_edge_total"))
+	assertMetricOutput(t, map[string]float64{
+		`ns_ss_shield_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`: 2,
+		`ns_ss_shield_total{datacenter="LHR",service_id="service_id",service_name="service_id"}`: 0,
+	}, prometheusOutput(t, registry, "ns_ss_shield_total{"))
+}
+
+func TestSubscriberSmoothedRequestRate(t *testing.T) {
+	bucket := func(recorded, requests int) string {
+		return fmt.Sprintf(`{"Data":[{"recorded":%d,"datacenter":{"AMS":{"requests":%d}}}],"Timestamp":%d}`, recorded, requests, recorded+1)
+	}
+	var (
+		client      = newMockRealtimeClient(bucket(100, 10), bucket(101, 10), bucket(102, 100), bucket(103, 100), bucket(104, 100), bucket(105, 100), `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess), rt.WithSmoothedRequestRate(0.5)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	smoothed := func() float64 {
+		return testutil.ToFloat64(metrics.RequestsRateSmoothed.WithLabelValues("service_id", "service_id"))
+	}
+	go subscriber.Run(context.Background())
+
+	<-processed // baseline
+	client.advance()
+	<-processed
+	if want, have := 10.0, smoothed(); want != have {
+		t.Fatalf("before step: want %v, have %v", want, have)
+	}
+
+	for _, want := range []float64{55, 77.5, 88.75, 94.375} {
+		client.advance()
+		<-processed
+		if have := smoothed(); want != have {
+			t.Errorf("after step: want %v, have %v", want, have)
+		}
+	}
+}
+
+func TestSubscriberLastBucketTimestamp(t *testing.T) {
+	var (
+		first       = `{"Data":[{"recorded":1600000000,"datacenter":{"AMS":{"requests":1}}}],"Timestamp":1600000001}`
+		second      = `{"Data":[{"recorded":1600000001,"datacenter":{"AMS":{"requests":1}}},{"recorded":1600000002,"datacenter":{"AMS":{"requests":1}}}],"Timestamp":1600000003}`
+		client      = newMockRealtimeClient(first, second, `{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, rt.WithPostprocess(postprocess))
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+	if want, have := 1600000000.0, testutil.ToFloat64(metrics.LastBucketTimestamp.WithLabelValues("service_id", "service_id")); want != have {
+		t.Errorf("first response: want %v, have %v", want, have)
+	}
+
+	client.advance()
+	<-processed
+	if want, have := 1600000002.0, testutil.ToFloat64(metrics.LastBucketTimestamp.WithLabelValues("service_id", "service_id")); want != have {
+		t.Errorf("second response: want %v, have %v", want, have)
+	}
+}
+
+func TestSubscriberPollInterval(t *testing.T) {
+	var (
+		overrides = map[string]time.Duration{"AAA": 5 * time.Second}
+		registry  = prometheus.NewRegistry()
+		metrics   = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed = make(chan struct{}, 100)
+		options   = []rt.SubscriberOption{
+			rt.WithPollInterval(time.Second, overrides),
+			rt.WithPostprocess(func() { processed <- struct{}{} }),
+		}
+		overridden = rt.NewSubscriber(newMockRealtimeClient(`{}`), "token", "AAA", metrics, options...)
+		standard   = rt.NewSubscriber(newMockRealtimeClient(`{}`), "token", "BBB", metrics, options...)
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go overridden.Run(ctx)
+	go standard.Run(ctx)
+
+	<-processed
+	<-processed
+
+	// The gauge is set once the response has been processed, so wait for it.
+	var have map[string]float64
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if have = prometheusOutput(t, registry, "ns_ss_poll_interval_seconds"); len(have) == 2 {
+			break
+		}
+	}
+
+	want := map[string]float64{
+		`ns_ss_poll_interval_seconds{service_id="AAA",service_name="AAA"}`: 5,
+		`ns_ss_poll_interval_seconds{service_id="BBB",service_name="BBB"}`: 1,
+	}
+	assertMetricOutput(t, want, have)
+}
+
+func TestSubscriberMinimumBucketAge(t *testing.T) {
+	var (
+		first       = `{"Data":[{"datacenter":{"AMS":{"requests":1}},"recorded":100},{"datacenter":{"AMS":{"requests":10}},"recorded":102}],"Timestamp":103}`
+		second      = `{"Data":[{"datacenter":{"AMS":{"requests":20}},"recorded":102}],"Timestamp":104}`
+		client      = newMockRealtimeClient(first, second)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		clock       = int64(103)
+		now         = func() time.Time { return time.Unix(atomic.LoadInt64(&clock), 0) }
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithMinimumBucketAge(2 * time.Second), rt.WithClock(now), rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+		series      = `ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed // bucket 100 is old enough, bucket 102 is deferred
+	if want, have := 1.0, prometheusOutput(t, registry, "ns_ss_requests_total")[series]; want != have {
+		t.Fatalf("after first response: want %v, have %v", want, have)
+	}
+
+	atomic.StoreInt64(&clock, 104)
+	client.advance()
+	<-processed // bucket 102 is revised, and now old enough
+	if want, have := 21.0, prometheusOutput(t, registry, "ns_ss_requests_total")[series]; want != have {
+		t.Fatalf("after second response: want %v, have %v", want, have)
+	}
+}
+
+func TestSubscriberOldestPendingBucketAge(t *testing.T) {
+	var (
+		first       = `{"Data":[{"datacenter":{"AMS":{"requests":1}},"recorded":100}],"Timestamp":101}`
+		second      = `{"Data":[],"Timestamp":102}`
+		client      = newMockRealtimeClient(first, second)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		clock       = int64(103)
+		now         = func() time.Time { return time.Unix(atomic.LoadInt64(&clock), 0) }
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithMinimumBucketAge(time.Minute), rt.WithClock(now), rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+		series      = `ns_ss_oldest_pending_bucket_age_seconds{service_id="service_id",service_name="service_id"}`
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed // bucket 100 is deferred
+	if want, have := 3.0, prometheusOutput(t, registry, "ns_ss_oldest_pending_bucket_age_seconds")[series]; want != have {
+		t.Fatalf("after first response: want %v, have %v", want, have)
+	}
+
+	atomic.StoreInt64(&clock, 110)
+	client.advance()
+	<-processed // bucket 100 is still deferred, and older
+	if want, have := 10.0, prometheusOutput(t, registry, "ns_ss_oldest_pending_bucket_age_seconds")[series]; want != have {
+		t.Fatalf("after second response: want %v, have %v", want, have)
+	}
+}
+
+func TestSubscriberClockSkew(t *testing.T) {
+	var (
+		server      = time.Unix(1000, 0)
+		client      = datedRealtimeClient{newMockRealtimeClient(`{}`), server}
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		now         = func() time.Time { return server.Add(3 * time.Second) }
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithClock(now), rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+
+	want := map[string]float64{
+		`ns_ss_clock_skew_seconds{service_id="service_id",service_name="service_id"}`: 3,
+	}
+	have := prometheusOutput(t, registry, "ns_ss_clock_skew_seconds")
+	assertMetricOutput(t, want, have)
+}
+
+func TestSubscriberAlwaysPresent(t *testing.T) {
+	var (
+		client      = newMockRealtimeClient(`{}`)
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		datacenters = staticDatacenters{"AMS", "NYC"}
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithAlwaysPresent(datacenters, "ns_ss_requests_total", "ns_ss_status_code_total"), rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	go subscriber.Run(context.Background())
+
+	<-processed
+
+	want := map[string]float64{
+		`ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`: 0,
+		`ns_ss_requests_total{datacenter="NYC",service_id="service_id",service_name="service_id"}`: 0,
+	}
+	have := prometheusOutput(t, registry, "ns_ss_requests_total")
+	assertMetricOutput(t, want, have)
+
+	if have := prometheusOutput(t, registry, "ns_ss_status_code_total"); len(have) != 0 {
+		t.Errorf("status_code_total has extra labels, want it ignored, have %v", have)
+	}
+}
+
+func TestSubscriberReplay(t *testing.T) {
+	var (
+		first       = `{"Data":[{"datacenter":{"AMS":{"requests":1}},"recorded":100},{"datacenter":{"AMS":{"requests":2}},"recorded":101}],"Timestamp":102}`
+		second      = `{"Data":[{"datacenter":{"AMS":{"requests":3}},"recorded":102}],"Timestamp":103}`
+		client      = &recordingRealtimeClient{mockRealtimeClient: newMockRealtimeClient(first, second, `{"Timestamp":103}`)}
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		replay      = rt.NewReplay(100)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithReplay(replay), rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+		series      = `ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- subscriber.Run(ctx) }()
+
+	<-processed // buckets 100 and 101
+	client.advance()
+	<-processed // bucket 102, caught up
+	cancel()
+	<-done
+
+	if want, have := 6.0, prometheusOutput(t, registry, "ns_ss_requests_total")[series]; want != have {
+		t.Errorf("after replay: want %v, have %v", want, have)
+	}
+
+	if want, have := []string{"/v1/channel/service_id/ts/100", "/v1/channel/service_id/ts/102"}, client.requested()[:2]; !cmp.Equal(want, have) {
+		t.Errorf("requested paths: %s", cmp.Diff(want, have))
+	}
+
+	// A restarted subscriber for the same service starts from live data,
+	// rather than replaying (and double counting) the same buckets.
+	var (
+		restartedClient = &recordingRealtimeClient{mockRealtimeClient: newMockRealtimeClient(`{"Timestamp":104}`)}
+		restarted       = rt.NewSubscriber(restartedClient, "token", "service_id", metrics, options...)
+	)
+	go restarted.Run(context.Background())
+
+	<-processed
+
+	if want, have := "/v1/channel/service_id/ts/0", restartedClient.requested()[0]; want != have {
+		t.Errorf("restarted first request: want %s, have %s", want, have)
+	}
+}
+
+func TestSubscriberNoOverlappingFetches(t *testing.T) {
+	var (
+		client      = &slowRealtimeClient{delay: 20 * time.Millisecond, response: `{"Data":[{"datacenter":{"AMS":{"requests":1}},"recorded":100}],"Timestamp":101}`}
+		registry    = prometheus.NewRegistry()
+		metrics     = gen.NewMetrics("ns", "ss", filter.Filter{}, registry)
+		processed   = make(chan struct{}, 100)
+		postprocess = func() { processed <- struct{}{} }
+		options     = []rt.SubscriberOption{rt.WithPostprocess(postprocess)}
+		subscriber  = rt.NewSubscriber(client, "token", "service_id", metrics, options...)
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- subscriber.Run(ctx) }()
+
+	for i := 0; i < 5; i++ {
+		<-processed
+	}
+	cancel()
+	<-done
+
+	if want, have := int64(0), atomic.LoadInt64(&client.overlaps); want != have {
+		t.Errorf("overlapping fetches: want %d, have %d", want, have)
+	}
+
+	// Every fetched bucket is processed exactly once.
+	var (
+		served = atomic.LoadUint64(&client.served)
+		series = `ns_ss_requests_total{datacenter="AMS",service_id="service_id",service_name="service_id"}`
+	)
+	if want, have := float64(served), prometheusOutput(t, registry, "ns_ss_requests_total")[series]; want != have {
+		t.Errorf("requests_total: want %v, have %v", want, have)
+	}
+}